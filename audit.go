@@ -0,0 +1,203 @@
+package hypertrace
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AuditGetTracing         = "getTracing"
+	AuditGetTracingStreamed = "getTracingStreamed" // traces of an ndjson getTracing once streamed
+	AuditGetUploadToken     = "getUploadToken"
+	AuditPurgeTracing       = "purgeTracing"
+	AuditRegisterOfficer    = "registerOfficer"
+	AuditDeleteOfficer      = "deleteOfficer"
+	AuditSetOfficerRoles    = "setOfficerRoles"
+	AuditDeleteUser         = "deleteUser"
+	AuditUpdateOfficer      = "updateOfficer"
+	AuditRotateSecret       = "rotateOfficerSecret"
+	AuditSetTempIDPolicy    = "setTempIDPolicy"
+	AuditGetContactEpisodes = "getContactEpisodes"
+
+	auditGenesisPrevHash   = "" // PrevHash of the first record
+	auditQueryLimitDefault = 1000
+)
+
+var (
+	ErrAuditChainBroken = fmt.Errorf("audit chain broken")
+
+	auditLog = logrus.WithField("module", "Audit")
+)
+
+// AuditRecord is one entry of the audit log: who did what, when, about which UID and on how many records.
+// Records are chained, Hash covers every other field including PrevHash, the Hash of the record before,
+// so a record can not be changed, removed or inserted without breaking the chain from there on.
+type AuditRecord struct {
+	Seq       int64  `json:"seq" bson:"seq"`
+	Timestamp int64  `json:"timestamp" bson:"timestamp"` // unix seconds
+	Actor     string `json:"actor" bson:"actor"`         // OID of the officer, or admin
+	Action    string `json:"action" bson:"action"`
+	UID       string `json:"uid,omitempty" bson:"uid,omitempty"`
+	OID       string `json:"oid,omitempty" bson:"oid,omitempty"` // officer acted upon
+	Records   int    `json:"records" bson:"records"`
+	Detail    string `json:"detail,omitempty" bson:"detail,omitempty"`
+	PrevHash  string `json:"prevHash" bson:"prevHash"`
+	Hash      string `json:"hash" bson:"hash"`
+}
+
+// computeHash returns the SHA-256, in hex, of the JSON of the record without its Hash.
+func (rec *AuditRecord) computeHash() string {
+	unhashed := *rec
+	unhashed.Hash = ""
+	recJson, _ := json.Marshal(&unhashed)
+	sum := sha256.Sum256(recJson)
+	return hex.EncodeToString(sum[:])
+}
+
+// chain makes rec the record following prev, nil for the first record of the log.
+func (rec *AuditRecord) chain(prev *AuditRecord) {
+	rec.Seq = 1
+	rec.PrevHash = auditGenesisPrevHash
+	if prev != nil {
+		rec.Seq = prev.Seq + 1
+		rec.PrevHash = prev.Hash
+	}
+	if rec.Timestamp == 0 {
+		rec.Timestamp = time.Now().Unix()
+	}
+	rec.Hash = rec.computeHash()
+}
+
+// AuditFilter selects audit records, empty fields match anything. From and To are unix seconds, both inclusive.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	UID    string
+	OID    string
+	From   int64
+	To     int64
+	Limit  int // at most that many records, the oldest first. 0 is auditQueryLimitDefault
+	// AfterSeq only selects the records following that sequence number, to read the log page by page.
+	AfterSeq int64
+}
+
+func (filter *AuditFilter) match(rec *AuditRecord) bool {
+	return rec.Seq > filter.AfterSeq &&
+		(len(filter.Actor) == 0 || rec.Actor == filter.Actor) &&
+		(len(filter.Action) == 0 || rec.Action == filter.Action) &&
+		(len(filter.UID) == 0 || rec.UID == filter.UID) &&
+		(len(filter.OID) == 0 || rec.OID == filter.OID) &&
+		(filter.From == 0 || rec.Timestamp >= filter.From) &&
+		(filter.To == 0 || rec.Timestamp <= filter.To)
+}
+
+func (filter *AuditFilter) limit() int {
+	if filter.Limit <= 0 {
+		return auditQueryLimitDefault
+	}
+	return filter.Limit
+}
+
+// AuditVerification is the outcome of AuditLog.Verify.
+type AuditVerification struct {
+	Records int64  `json:"records"`
+	Head    string `json:"head"` // hash of the last record, keep a copy elsewhere to detect the log being truncated
+}
+
+// AuditLog is the append only, hash chained log of the officer data accesses.
+type AuditLog interface {
+	// Append chains rec to the last record and stores it, filling Seq, Timestamp when zero, PrevHash and Hash.
+	Append(ctx context.Context, rec *AuditRecord) (err error)
+	// Query returns the records matching filter in sequence order.
+	Query(ctx context.Context, filter *AuditFilter) (records []*AuditRecord, err error)
+	// Verify walks the whole chain and returns ErrAuditChainBroken at the first record that was tampered with.
+	Verify(ctx context.Context) (verification *AuditVerification, err error)
+}
+
+// auditChainVerifier checks records handed one by one in sequence order.
+type auditChainVerifier struct {
+	prev *AuditRecord
+}
+
+func (verifier *auditChainVerifier) next(rec *AuditRecord) error {
+	expectSeq, expectPrevHash := int64(1), auditGenesisPrevHash
+	if verifier.prev != nil {
+		expectSeq, expectPrevHash = verifier.prev.Seq+1, verifier.prev.Hash
+	}
+	switch {
+	case rec.Seq != expectSeq:
+		return fmt.Errorf("%w : expect record %d, got record %d", ErrAuditChainBroken, expectSeq, rec.Seq)
+	case rec.PrevHash != expectPrevHash:
+		return fmt.Errorf("%w : record %d does not follow record %d", ErrAuditChainBroken, rec.Seq, expectSeq-1)
+	case rec.Hash != rec.computeHash():
+		return fmt.Errorf("%w : record %d was modified", ErrAuditChainBroken, rec.Seq)
+	}
+	verifier.prev = rec
+	return nil
+}
+
+func (verifier *auditChainVerifier) verification() *AuditVerification {
+	if verifier.prev == nil {
+		return &AuditVerification{}
+	}
+	return &AuditVerification{Records: verifier.prev.Seq, Head: verifier.prev.Hash}
+}
+
+// NewInMemoryAuditLog creates an AuditLog kept in memory, the next restart clears it.
+func NewInMemoryAuditLog() AuditLog {
+	return &InMemoryAuditLog{Records: make([]*AuditRecord, 0)}
+}
+
+// InMemoryAuditLog is an AuditLog that keeps its records in memory. It is safe for concurrent use.
+type InMemoryAuditLog struct {
+	Records []*AuditRecord
+	mutex   sync.RWMutex
+}
+
+func (audit *InMemoryAuditLog) Append(ctx context.Context, rec *AuditRecord) (err error) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	var prev *AuditRecord
+	if len(audit.Records) > 0 {
+		prev = audit.Records[len(audit.Records)-1]
+	}
+	rec.chain(prev)
+	stored := *rec
+	audit.Records = append(audit.Records, &stored)
+	return nil
+}
+
+func (audit *InMemoryAuditLog) Query(ctx context.Context, filter *AuditFilter) (records []*AuditRecord, err error) {
+	audit.mutex.RLock()
+	defer audit.mutex.RUnlock()
+	records = make([]*AuditRecord, 0)
+	for _, rec := range audit.Records {
+		if len(records) == filter.limit() {
+			break
+		}
+		if filter.match(rec) {
+			found := *rec
+			records = append(records, &found)
+		}
+	}
+	return records, nil
+}
+
+func (audit *InMemoryAuditLog) Verify(ctx context.Context) (verification *AuditVerification, err error) {
+	audit.mutex.RLock()
+	defer audit.mutex.RUnlock()
+	verifier := &auditChainVerifier{}
+	for _, rec := range audit.Records {
+		if err := verifier.next(rec); err != nil {
+			return nil, err
+		}
+	}
+	return verifier.verification(), nil
+}
@@ -0,0 +1,185 @@
+package hypertrace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	auditFileLineMax = 1024 * 1024
+)
+
+// NewFileAuditLog creates an AuditLog appending one JSON record per line to the file at path.
+// An existing file is verified and new records are chained to its last one.
+func NewFileAuditLog(path string) AuditLog {
+	audit := &FileAuditLog{path: path}
+	verification, err := audit.Verify(context.Background())
+	if err != nil && !os.IsNotExist(err) {
+		// the records are still appended, chained to the last one, Verify keeps reporting the broken record
+		auditLog.Errorf("audit file %s does not verify. got %s", path, err.Error())
+	}
+	last, err := audit.lastRecord()
+	if err != nil && !os.IsNotExist(err) {
+		auditLog.Fatalf("error reading audit file %s. got %s", path, err.Error())
+		return nil
+	}
+	audit.last = last
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		auditLog.Fatalf("error opening audit file %s. got %s", path, err.Error())
+		return nil
+	}
+	audit.file = file
+	if err := audit.terminateLastLine(); err != nil {
+		auditLog.Fatalf("error repairing audit file %s. got %s", path, err.Error())
+		return nil
+	}
+	if verification != nil {
+		auditLog.Infof("audit file %s holds %d records, head %s", path, verification.Records, verification.Head)
+	}
+	return audit
+}
+
+// FileAuditLog is an AuditLog stored in a JSON lines file, every line holds one AuditRecord.
+// It is safe for concurrent use within one process, the file must not be shared by several servers.
+type FileAuditLog struct {
+	path  string
+	file  *os.File
+	last  *AuditRecord
+	mutex sync.RWMutex
+}
+
+// terminateLastLine ends the file with a new line if the last write was cut short,
+// so the next record is not glued to the partial one.
+func (audit *FileAuditLog) terminateLastLine() error {
+	info, err := audit.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	reader, err := os.Open(audit.path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	lastByte := make([]byte, 1)
+	if _, err := reader.ReadAt(lastByte, info.Size()-1); err != nil {
+		return err
+	}
+	if lastByte[0] != '\n' {
+		_, err = audit.file.Write([]byte("\n"))
+	}
+	return err
+}
+
+// lastRecord returns the last readable record of the file, nil if there is none.
+func (audit *FileAuditLog) lastRecord() (last *AuditRecord, err error) {
+	err = audit.each(func(rec *AuditRecord, err error) error {
+		if err == nil {
+			last = rec
+		}
+		return nil
+	})
+	return last, err
+}
+
+// each calls fn with every line of the file decoded, or with the decoding error of the lines which are not a record.
+func (audit *FileAuditLog) each(fn func(rec *AuditRecord, err error) error) error {
+	file, err := os.Open(audit.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), auditFileLineMax)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			err = fmt.Errorf("%w : line %d is not an audit record", ErrAuditChainBroken, line)
+			if err := fn(nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(rec, nil); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (audit *FileAuditLog) Append(ctx context.Context, rec *AuditRecord) (err error) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	rec.chain(audit.last)
+	recJson, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := audit.file.Write(append(recJson, '\n')); err != nil {
+		auditLog.Errorf("Append . file.Write got %s", err.Error())
+		return err
+	}
+	if err := audit.file.Sync(); err != nil {
+		auditLog.Errorf("Append . file.Sync got %s", err.Error())
+		return err
+	}
+	stored := *rec
+	audit.last = &stored
+	return nil
+}
+
+func (audit *FileAuditLog) Query(ctx context.Context, filter *AuditFilter) (records []*AuditRecord, err error) {
+	audit.mutex.RLock()
+	defer audit.mutex.RUnlock()
+	records = make([]*AuditRecord, 0)
+	err = audit.each(func(rec *AuditRecord, err error) error {
+		if err != nil {
+			return err
+		}
+		if len(records) == filter.limit() {
+			return io.EOF
+		}
+		if filter.match(rec) {
+			records = append(records, rec)
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (audit *FileAuditLog) Verify(ctx context.Context) (verification *AuditVerification, err error) {
+	audit.mutex.RLock()
+	defer audit.mutex.RUnlock()
+	verifier := &auditChainVerifier{}
+	err = audit.each(func(rec *AuditRecord, err error) error {
+		if err != nil {
+			return err
+		}
+		return verifier.next(rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return verifier.verification(), nil
+}
+
+// Close closes the audit file.
+func (audit *FileAuditLog) Close() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	return audit.file.Close()
+}
@@ -0,0 +1,142 @@
+package hypertrace
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditCollection = "audit"
+
+	// auditAppendAttempts is how many times Append chains a record again after another server appended first.
+	auditAppendAttempts = 10
+)
+
+// MongoDBAuditLog is an AuditLog stored in the audit collection. Several servers may append to it,
+// the unique index on seq makes the one losing the race chain its record again.
+type MongoDBAuditLog struct {
+	database string
+	client   *mongo.Client
+}
+
+func NewMongoDBAuditLog(database, host string, port int, user, password string) AuditLog {
+	client, err := mongo.NewClient(options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@%s:%d", user, password, host, port)))
+	if err != nil {
+		mongoLog.Fatal(err)
+		return nil
+	}
+	err = client.Connect(context.TODO())
+	if err != nil {
+		mongoLog.Fatal(err)
+		return nil
+	}
+	audit := &MongoDBAuditLog{
+		database: database,
+		client:   client,
+	}
+	_, err = audit.collection().Indexes().CreateMany(context.TODO(), []mongo.IndexModel{
+		{Keys: bson.M{"seq": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"uid": 1}},
+		{Keys: bson.M{"actor": 1}},
+	})
+	if err != nil {
+		mongoLog.Fatalf("ensureIndexes . auditCollection.Indexes got %s", err.Error())
+		return nil
+	}
+	return audit
+}
+
+func (audit *MongoDBAuditLog) collection() *mongo.Collection {
+	return audit.client.Database(audit.database).Collection(auditCollection)
+}
+
+func (audit *MongoDBAuditLog) Append(ctx context.Context, rec *AuditRecord) (err error) {
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		last := &AuditRecord{}
+		err = audit.collection().FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"seq": -1})).Decode(last)
+		if err == mongo.ErrNoDocuments {
+			last = nil
+		} else if err != nil {
+			mongoLog.Errorf("Append . auditCollection.FindOne got %s", err.Error())
+			return err
+		}
+		rec.chain(last)
+		_, err = audit.collection().InsertOne(ctx, rec)
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+	}
+	if err != nil {
+		mongoLog.Errorf("Append . auditCollection.InsertOne got %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (audit *MongoDBAuditLog) Query(ctx context.Context, filter *AuditFilter) (records []*AuditRecord, err error) {
+	query := bson.M{"seq": bson.M{"$gt": filter.AfterSeq}}
+	if len(filter.Actor) > 0 {
+		query["actor"] = filter.Actor
+	}
+	if len(filter.Action) > 0 {
+		query["action"] = filter.Action
+	}
+	if len(filter.UID) > 0 {
+		query["uid"] = filter.UID
+	}
+	if len(filter.OID) > 0 {
+		query["oid"] = filter.OID
+	}
+	timestamp := bson.M{}
+	if filter.From != 0 {
+		timestamp["$gte"] = filter.From
+	}
+	if filter.To != 0 {
+		timestamp["$lte"] = filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	cursor, err := audit.collection().Find(ctx, query, options.Find().SetSort(bson.M{"seq": 1}).SetLimit(int64(filter.limit())))
+	if err != nil {
+		mongoLog.Errorf("Query . auditCollection.Find got %s", err.Error())
+		return nil, err
+	}
+	records = make([]*AuditRecord, 0)
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("%w : Query . audit cursor", err)
+	}
+	return records, nil
+}
+
+func (audit *MongoDBAuditLog) Verify(ctx context.Context) (verification *AuditVerification, err error) {
+	cursor, err := audit.collection().Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"seq": 1}))
+	if err != nil {
+		mongoLog.Errorf("Verify . auditCollection.Find got %s", err.Error())
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	verifier := &auditChainVerifier{}
+	for cursor.Next(ctx) {
+		rec := &AuditRecord{}
+		if err := cursor.Decode(rec); err != nil {
+			return nil, fmt.Errorf("%w : Verify . audit cursor", err)
+		}
+		if err := verifier.next(rec); err != nil {
+			return nil, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return verifier.verification(), nil
+}
+
+// Close disconnects from MongoDB.
+func (audit *MongoDBAuditLog) Close() error {
+	return audit.client.Disconnect(context.TODO())
+}
@@ -0,0 +1,261 @@
+package hypertrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAuditLog(t *testing.T, audit AuditLog) {
+	ctx := context.Background()
+	records := []*AuditRecord{
+		{Actor: "officer1", Action: AuditGetTracing, UID: "auditUID0000000000001", Records: 3, Timestamp: 100},
+		{Actor: "officer1", Action: AuditGetUploadToken, UID: "auditUID0000000000002", Records: 1, Timestamp: 200},
+		{Actor: AdminUser, Action: AuditRegisterOfficer, OID: "officer9", Timestamp: 300},
+		{Actor: "officer2", Action: AuditGetTracing, UID: "auditUID0000000000001", Records: 0, Timestamp: 400},
+	}
+	for i, rec := range records {
+		if err := audit.Append(ctx, rec); err != nil {
+			t.Fatalf("Append got %v", err)
+		}
+		if rec.Seq != int64(i+1) || len(rec.Hash) == 0 {
+			t.Fatalf("expect record %d to be chained, got %+v", i+1, rec)
+		}
+	}
+	if records[1].PrevHash != records[0].Hash {
+		t.Errorf("expect record 2 to follow record 1, got %+v", records[1])
+	}
+
+	tests := []struct {
+		name   string
+		filter *AuditFilter
+		expect []int64
+	}{
+		{"all", &AuditFilter{}, []int64{1, 2, 3, 4}},
+		{"uid", &AuditFilter{UID: "auditUID0000000000001"}, []int64{1, 4}},
+		{"actor and action", &AuditFilter{Actor: "officer1", Action: AuditGetTracing}, []int64{1}},
+		{"oid", &AuditFilter{OID: "officer9"}, []int64{3}},
+		{"time range", &AuditFilter{From: 200, To: 300}, []int64{2, 3}},
+		{"page", &AuditFilter{AfterSeq: 1, Limit: 2}, []int64{2, 3}},
+	}
+	for _, tt := range tests {
+		found, err := audit.Query(ctx, tt.filter)
+		if err != nil {
+			t.Fatalf("%s : Query got %v", tt.name, err)
+		}
+		seqs := make([]int64, 0)
+		for _, rec := range found {
+			seqs = append(seqs, rec.Seq)
+		}
+		if len(seqs) != len(tt.expect) {
+			t.Errorf("%s : expect records %v, got %v", tt.name, tt.expect, seqs)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != tt.expect[i] {
+				t.Errorf("%s : expect records %v, got %v", tt.name, tt.expect, seqs)
+				break
+			}
+		}
+	}
+
+	verification, err := audit.Verify(ctx)
+	if err != nil {
+		t.Fatalf("Verify got %v", err)
+	}
+	if verification.Records != 4 || verification.Head != records[3].Hash {
+		t.Errorf("expect 4 records up to %s, got %+v", records[3].Hash, verification)
+	}
+}
+
+func TestInMemoryAuditLog(t *testing.T) {
+	audit := NewInMemoryAuditLog()
+	testAuditLog(t, audit)
+
+	audit.(*InMemoryAuditLog).Records[1].Records = 0
+	if _, err := audit.Verify(context.Background()); !errors.Is(err, ErrAuditChainBroken) || !strings.Contains(err.Error(), "record 2") {
+		t.Fatalf("expect the modified record 2 to break the chain, got %v", err)
+	}
+}
+
+func TestFileAuditLog(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit := NewFileAuditLog(path)
+	testAuditLog(t, audit)
+	if err := audit.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	audit = NewFileAuditLog(path)
+	rec := &AuditRecord{Actor: AdminUser, Action: AuditPurgeTracing, Records: 7}
+	if err := audit.Append(ctx, rec); err != nil {
+		t.Fatalf("Append after reopen got %v", err)
+	}
+	if verification, err := audit.Verify(ctx); err != nil || verification.Records != 5 || rec.Seq != 5 {
+		t.Fatalf("expect the reopened log to go on with record 5, got %+v, %v", verification, err)
+	}
+	audit.(io.Closer).Close()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(content), `"records":3`, `"records":1`, 1)
+	if err := ioutil.WriteFile(path, []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	audit = NewFileAuditLog(path)
+	defer audit.(io.Closer).Close()
+	if _, err := audit.Verify(ctx); !errors.Is(err, ErrAuditChainBroken) || !strings.Contains(err.Error(), "record 1") {
+		t.Fatalf("expect the modified record 1 to break the chain, got %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	removed := strings.Join(append(lines[:1], lines[2:]...), "\n") + "\n"
+	if err := ioutil.WriteFile(path, []byte(removed), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit.Verify(ctx); !errors.Is(err, ErrAuditChainBroken) || !strings.Contains(err.Error(), "expect record 2") {
+		t.Fatalf("expect the removed record 2 to break the chain, got %v", err)
+	}
+}
+
+// TestMongoDBAuditLog runs against the mongo.* configured server when TRACE_TEST_MONGODB is true.
+func TestMongoDBAuditLog(t *testing.T) {
+	if os.Getenv("TRACE_TEST_MONGODB") != "true" {
+		t.Skip("set TRACE_TEST_MONGODB=true to run against MongoDB")
+	}
+	database := fmt.Sprintf("hypertrace_audit_%d", time.Now().UnixNano())
+	audit := NewMongoDBAuditLog(database, ConfigGet("mongo.host"), ConfigGetInt("mongo.port"), ConfigGet("mongo.user"), ConfigGet("mongo.password"))
+	defer func() {
+		_ = audit.(*MongoDBAuditLog).client.Database(database).Drop(context.Background())
+		_ = audit.(*MongoDBAuditLog).Close()
+	}()
+	testAuditLog(t, audit)
+}
+
+func TestGetTracing_Audited(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	Audit = NewInMemoryAuditLog()
+	defer func() {
+		Tracing = nil
+		Audit = nil
+	}()
+	ctx := context.Background()
+	uid := "auditUID0000000000001"
+	if _, _, err := Tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "other", Timestamp: 1}, {CUID: "other", Timestamp: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/getTracing?uid="+uid, nil)
+	req.Header.Set("Authorization", "Bearer secret1")
+	recorder := httptest.NewRecorder()
+	AuthMiddleware(RequireRole(RoleTracer)(getTracing)).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	records, err := Audit.Query(ctx, &AuditFilter{UID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Actor != "officer1" || records[0].Action != AuditGetTracing || records[0].Records != 2 {
+		t.Fatalf("expect officer1 getTracing of 2 records to be audited, got %+v", records)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/getTracing?format=ndjson&pageSize=1&uid="+uid, nil)
+	req.Header.Set("Authorization", "Bearer secret1")
+	recorder = httptest.NewRecorder()
+	AuthMiddleware(RequireRole(RoleTracer)(getTracing)).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	records, err = Audit.Query(ctx, &AuditFilter{UID: uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1].Action != AuditGetTracing || records[2].Action != AuditGetTracingStreamed ||
+		records[2].Actor != "officer1" || records[2].Records != 2 || records[2].Detail != "ndjson of record 2" {
+		t.Fatalf("expect the ndjson getTracing audited before and after streaming 2 records, got %+v", records)
+	}
+}
+
+// failingAuditLog refuses every record.
+type failingAuditLog struct {
+	InMemoryAuditLog
+}
+
+func (audit *failingAuditLog) Append(ctx context.Context, rec *AuditRecord) (err error) {
+	return fmt.Errorf("audit log down")
+}
+
+func TestAuditFailure_NothingChanged(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	Audit = &failingAuditLog{}
+	defer func() {
+		Tracing = nil
+		Audit = nil
+	}()
+	ctx := context.Background()
+	uid := "auditUID0000000000001"
+	if _, _, err := Tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "other", Timestamp: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+	}{
+		{"registerOid", registerOfficer, http.MethodGet, "/registerOid?oid=newOfficer&secret=newSecret"},
+		{"deleteOid", deleteOfficer, http.MethodGet, "/deleteOid?oid=officer2"},
+		{"officerRoles", setOfficerRoles, http.MethodPost, "/admin/officerRoles?oid=officer3&roles=admin"},
+		{"updateOfficer", updateOfficer, http.MethodPost, "/admin/officer?oid=officer4&disabled=true"},
+		{"rotateSecret", rotateOfficerSecret, http.MethodPost, "/admin/officer/rotateSecret?oid=officer5"},
+		{"purgeTracing", purgeTracing, http.MethodGet, "/purgeTracing?ageHour=0"},
+		{"deleteUid", deleteUser, http.MethodPost, "/deleteUid?uid=" + uid},
+		{"getTracing ndjson", getTracing, http.MethodGet, "/getTracing?format=ndjson&uid=" + uid},
+		{"getUploadToken", getUploadToken, http.MethodGet, "/getUploadToken?uid=" + uid},
+	} {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		req.SetBasicAuth(AdminUser, ConfigGet("adminpassword"))
+		recorder := httptest.NewRecorder()
+		AuthMiddleware(tt.handler).ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusInternalServerError || strings.Contains(recorder.Body.String(), "other") {
+			t.Errorf("%s : expect %d and no trace, got %d %s", tt.name, http.StatusInternalServerError, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if _, err := Tracing.GetOfficer(ctx, "newOfficer"); !errors.Is(err, ErrOfficerNotFound) {
+		t.Errorf("expect newOfficer not to be registered, got %v", err)
+	}
+	if _, err := Tracing.GetOfficer(ctx, "officer2"); err != nil {
+		t.Errorf("expect officer2 not to be deleted, got %v", err)
+	}
+	if off, err := Tracing.GetOfficer(ctx, "officer3"); err != nil || strings.Join(off.EffectiveRoles(), ",") == RoleAdmin {
+		t.Errorf("expect officer3 roles unchanged, got %+v, %v", off, err)
+	}
+	if off, err := Tracing.GetOfficer(ctx, "officer4"); err != nil || off.Disabled {
+		t.Errorf("expect officer4 not to be disabled, got %+v, %v", off, err)
+	}
+	if oid, err := Tracing.GetOfficerID(ctx, "secret5"); err != nil || oid != "officer5" {
+		t.Errorf("expect the secret of officer5 kept, got %q, %v", oid, err)
+	}
+	if traces, err := Tracing.GetTraceData(ctx, uid); err != nil || len(traces) != 1 {
+		t.Errorf("expect the trace not to be purged nor erased, got %d, %v", len(traces), err)
+	}
+	if tokens := Tracing.(*InMemoryTracing).UploadTokens; len(tokens) != 0 {
+		t.Errorf("expect no upload token registered, got %d", len(tokens))
+	}
+}
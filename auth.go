@@ -0,0 +1,184 @@
+package hypertrace
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// AdminUser is the user name of the administrator in the Basic Authorization header.
+	AdminUser = "admin"
+
+	// officerTouchInterval is how stale, in seconds, Officer.LastUsedAt may get, it is written at most that often.
+	officerTouchInterval = 60
+)
+
+var (
+	authLog = logrus.WithField("module", "Auth")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	OID   string // officer id, empty for the administrator
+	Roles []string
+}
+
+// Name returns the OID of the principal, or AdminUser for the administrator.
+func (principal *Principal) Name() string {
+	if len(principal.OID) == 0 {
+		return AdminUser
+	}
+	return principal.OID
+}
+
+// HasRole tells whether the principal holds any of roles.
+func (principal *Principal) HasRole(roles ...string) bool {
+	return principal != nil && hasAnyRole(principal.Roles, roles...)
+}
+
+type principalContextKey struct{}
+
+// PrincipalFromContext returns the caller authenticated by AuthMiddleware, or nil for an anonymous request.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// WithPrincipal returns a copy of ctx carrying principal.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// AuthMiddleware authenticates the caller from the Authorization header and puts it in the request context.
+// Officers send "Bearer <access token>", see /auth/login, and the administrator sends Basic credentials of AdminUser
+// with the admin password. While auth.query.enabled is set, the deprecated long-lived credentials are accepted too:
+// an officer secret as Bearer token and, when there is no header, the secret and pass query parameters.
+// A request which can not be authenticated goes on anonymous, RequireRole rejects it where needed.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var principal *Principal
+		if authorization := r.Header.Get("Authorization"); len(authorization) > 0 {
+			principal = authenticateHeader(r, authorization)
+		} else if ConfigGetBoolean("auth.query.enabled") {
+			principal = authenticateQuery(r)
+			if principal != nil {
+				authLog.Warnf("%s authenticated with query string credentials, they are deprecated in favor of the Authorization header", r.URL.Path)
+				w.Header().Set("Deprecation", "true")
+			}
+		}
+		if principal != nil {
+			r = r.WithContext(WithPrincipal(r.Context(), principal))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authenticateHeader(r *http.Request, authorization string) *Principal {
+	parts := strings.SplitN(authorization, " ", 2)
+	switch strings.ToLower(parts[0]) {
+	case "bearer":
+		if len(parts) < 2 {
+			return nil
+		}
+		token := strings.TrimSpace(parts[1])
+		if strings.Count(token, ".") == 2 {
+			return authenticateSession(token)
+		}
+		if ConfigGetBoolean("auth.query.enabled") {
+			if principal := authenticateOfficer(r.Context(), token); principal != nil {
+				authLog.Warnf("%s authenticated with an officer secret, it is deprecated in favor of the /auth/login access token", r.URL.Path)
+				return principal
+			}
+		}
+	case "basic":
+		user, password, ok := r.BasicAuth()
+		if ok && user == AdminUser && isAdminPassword(password) {
+			return &Principal{Roles: []string{RoleAdmin}}
+		}
+	}
+	return nil
+}
+
+// authenticateQuery reads the deprecated pass and secret query parameters, pass first since
+// the secret parameter of /registerOid is the secret of the officer to register.
+func authenticateQuery(r *http.Request) *Principal {
+	if pass := r.URL.Query().Get("pass"); len(pass) > 0 && isAdminPassword(pass) {
+		return &Principal{Roles: []string{RoleAdmin}}
+	}
+	if secret := r.URL.Query().Get("secret"); len(secret) > 0 {
+		return authenticateOfficer(r.Context(), secret)
+	}
+	return nil
+}
+
+// authenticateSession verifies a session access token, the officer is not looked up in the storage.
+func authenticateSession(token string) *Principal {
+	claims, err := ParseSessionToken(token, SessionTokenAccess, CryptKeys)
+	if err != nil {
+		authLog.Debugf("session token rejected. got %s", err.Error())
+		return nil
+	}
+	return &Principal{OID: claims.Subject, Roles: claims.Roles}
+}
+
+func authenticateOfficer(ctx context.Context, secret string) *Principal {
+	if len(secret) == 0 {
+		return nil
+	}
+	oid, err := Tracing.GetOfficerID(ctx, secret)
+	if err != nil {
+		return nil
+	}
+	off, err := Tracing.GetOfficer(ctx, oid)
+	if err != nil || off.Disabled {
+		return nil
+	}
+	touchOfficer(ctx, Tracing, off)
+	return &Principal{OID: oid, Roles: off.EffectiveRoles()}
+}
+
+// touchOfficer records that off authenticated now, a failure is only logged.
+func touchOfficer(ctx context.Context, tracing ITracing, off *Officer) {
+	now := time.Now().Unix()
+	if now-off.LastUsedAt < officerTouchInterval {
+		return
+	}
+	if err := tracing.TouchOfficer(ctx, off.OID, now); err != nil {
+		authLog.Warnf("error recording the use of officer %s. got %s", off.OID, err.Error())
+	}
+}
+
+func isAdminPassword(password string) bool {
+	return subtle.ConstantTimeCompare([]byte(password), []byte(ConfigGet("adminpassword"))) == 1
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer, Basic realm="hypertrace"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("unauthorized"))
+}
+
+// RequireRole lets through the requests of a principal holding any of roles. Anonymous requests
+// are unauthorized and requests of a principal without any of roles are forbidden.
+func RequireRole(roles ...string) func(handler http.HandlerFunc) http.HandlerFunc {
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			principal := PrincipalFromContext(r.Context())
+			if principal == nil {
+				unauthorized(w)
+				return
+			}
+			if !principal.HasRole(roles...) {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("forbidden"))
+				return
+			}
+			handler(w, r)
+		}
+	}
+}
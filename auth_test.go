@@ -0,0 +1,98 @@
+package hypertrace
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	defer func() {
+		Tracing = nil
+		SetConfig("auth.query.enabled", "true")
+	}()
+	ctx := context.Background()
+	if err := Tracing.SetOfficerRoles(ctx, "officer3", []string{RoleAuditor}); err != nil {
+		t.Fatal(err)
+	}
+	off, err := Tracing.GetOfficer(ctx, "officer1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := NewSessionTokens(off, CryptKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whoami := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(PrincipalFromContext(r.Context()).Name()))
+	}
+	tracer := RequireRole(RoleTracer)
+	admin := RequireRole(RoleAdmin)
+	reader := RequireRole(RoleTracer, RoleAuditor)
+
+	tests := []struct {
+		name          string
+		queryEnabled  bool
+		wrap          func(http.HandlerFunc) http.HandlerFunc
+		url           string
+		authorization string
+		basicPass     string
+		expectCode    int
+		expectBody    string
+		deprecated    bool
+	}{
+		{"bearer access token", false, tracer, "/", "Bearer " + tokens.AccessToken, "", http.StatusOK, "officer1", false},
+		{"bearer refresh token", false, tracer, "/", "Bearer " + tokens.RefreshToken, "", http.StatusUnauthorized, "unauthorized", false},
+		{"bearer secret enabled", true, tracer, "/", "Bearer secret1", "", http.StatusOK, "officer1", false},
+		{"bearer secret disabled", false, tracer, "/", "Bearer secret1", "", http.StatusUnauthorized, "unauthorized", false},
+		{"bearer unknown secret", true, tracer, "/", "Bearer nosuchsecret", "", http.StatusUnauthorized, "unauthorized", false},
+		{"no credentials", true, tracer, "/", "", "", http.StatusUnauthorized, "unauthorized", false},
+		{"basic admin", false, admin, "/", "", ConfigGet("adminpassword"), http.StatusOK, "admin", false},
+		{"basic wrong password", false, admin, "/", "", "wrong", http.StatusUnauthorized, "unauthorized", false},
+		{"default roles are not admin", false, admin, "/", "Bearer " + tokens.AccessToken, "", http.StatusForbidden, "forbidden", false},
+		{"admin is not tracer", false, tracer, "/", "", ConfigGet("adminpassword"), http.StatusForbidden, "forbidden", false},
+		{"auditor reads", true, reader, "/", "Bearer secret3", "", http.StatusOK, "officer3", false},
+		{"auditor is not tracer", true, tracer, "/", "Bearer secret3", "", http.StatusForbidden, "forbidden", false},
+		{"query secret enabled", true, tracer, "/?secret=secret2", "", "", http.StatusOK, "officer2", true},
+		{"query pass enabled", true, admin, "/?pass=" + url.QueryEscape(ConfigGet("adminpassword")), "", "", http.StatusOK, "admin", true},
+		{"query secret disabled", false, tracer, "/?secret=secret2", "", "", http.StatusUnauthorized, "unauthorized", false},
+		{"header wins over query", true, tracer, "/?secret=secret2", "Bearer " + tokens.AccessToken, "", http.StatusOK, "officer1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.queryEnabled {
+				SetConfig("auth.query.enabled", "true")
+			} else {
+				SetConfig("auth.query.enabled", "false")
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if len(tt.authorization) > 0 {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if len(tt.basicPass) > 0 {
+				req.SetBasicAuth(AdminUser, tt.basicPass)
+			}
+			recorder := httptest.NewRecorder()
+			AuthMiddleware(tt.wrap(whoami)).ServeHTTP(recorder, req)
+			if recorder.Code != tt.expectCode || recorder.Body.String() != tt.expectBody {
+				t.Fatalf("expect %d %s, got %d %s", tt.expectCode, tt.expectBody, recorder.Code, recorder.Body.String())
+			}
+			if deprecated := recorder.Header().Get("Deprecation") == "true"; deprecated != tt.deprecated {
+				t.Fatalf("expect deprecation header %v, got %v", tt.deprecated, deprecated)
+			}
+		})
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, err := ParseRoles(" tracer,auditor,,tracer ")
+	if err != nil || len(roles) != 2 || roles[0] != RoleAuditor || roles[1] != RoleTracer {
+		t.Fatalf("expect [auditor tracer], got %v, %v", roles, err)
+	}
+	if _, err := ParseRoles("tracer,root"); err == nil {
+		t.Fatal("expect unknown role root to fail")
+	}
+}
@@ -21,11 +21,17 @@ func init() {
 	defCfg["loglevel"] = "warn" // trace,debug,info,warn,error,fatal
 
 	defCfg["adminpassword"] = "admin password is a secret"
+	defCfg["auth.query.enabled"] = "true"            // deprecated, also accept the secret and pass query parameters and officer secrets as Bearer token
+	defCfg["auth.default.roles"] = "tracer,uploader" // roles of the officers registered before roles existed
+	defCfg["auth.access.ttl.minute"] = "15"
+	defCfg["auth.refresh.ttl.hour"] = "24"
+
+	defCfg["secret.hash.cost"] = "10" // bcrypt cost of the stored officer secrets and user PINs
 
 	defCfg["server.host"] = "0.0.0.0"
 	defCfg["server.port"] = "8080"
 
-	defCfg["database"] = "inmemory" // set to "mongodb" to use mongo
+	defCfg["database"] = "inmemory" // set to "mongodb" to use mongo, "postgres" to use postgresql or "bolt" to use an embedded file
 
 	defCfg["mongo.database"] = "hypertrace"
 	defCfg["mongo.host"] = "localhost"
@@ -33,9 +39,58 @@ func init() {
 	defCfg["mongo.user"] = "root"
 	defCfg["mongo.password"] = "root"
 
-	defCfg["tempid.valid.period.hour"] = "1"
-	defCfg["tempid.count"] = "100"
+	defCfg["postgres.database"] = "hypertrace"
+	defCfg["postgres.host"] = "localhost"
+	defCfg["postgres.port"] = "5432"
+	defCfg["postgres.user"] = "postgres"
+	defCfg["postgres.password"] = "postgres"
+	defCfg["postgres.sslmode"] = "disable"
+
+	defCfg["bolt.path"] = "hypertrace.db"
+
+	defCfg["inmemory.snapshot.path"] = ""              // set to a file path to keep inmemory data across restarts
+	defCfg["inmemory.snapshot.interval.second"] = "60" // 0 only writes the snapshot on shutdown
+
+	defCfg["seed.file"] = "" // YAML or JSON file of officers, users and traces added to the database on start, see seed.example.yaml
+
+	defCfg["audit.log"] = "inmemory" // set to "file" for a hash chained JSON lines file or "mongodb" to use the mongo.* database
+	defCfg["audit.file.path"] = "hypertrace-audit.jsonl"
+
+	defCfg["tracing.page.size.max"] = "1000"
+	defCfg["tracing.query.records.max"] = "10000"  // traces /getTracing without pageSize and /getContactEpisodes may load at once, 0 allows all
+	defCfg["episode.gap.second"] = "300"           // longest silence between two sightings of the same episode
+	defCfg["episode.min.duration.second"] = "0"    // shorter contact episodes are left out
+	defCfg["tracing.encryption.enabled"] = "false" // encrypt the stored trace data, see EncryptedTracing
+	defCfg["tracing.encryption.key"] = ""          // key sealing the traces, 32 bytes. It is never rotated and must never change once traces are stored
+	defCfg["tracing.encryption.index.key"] = ""    // key of the blind indexes, at least 32 bytes. It must never change once traces are stored
+
+	defCfg["tempid.valid.period.hour"] = "1"  // deprecated, see tempid.period.minute
+	defCfg["tempid.period.minute"] = ""       // validity of a TempID, tempid.valid.period.hour when empty
+	defCfg["tempid.overlap.second"] = "60"    // a TempID is valid that long before its period starts
+	defCfg["tempid.count"] = "100"            // TempIDs per batch
+	defCfg["tempid.refresh.lead.minute"] = "" // the app asks for the next batch that long before its last TempID expires, a day after the issuance when empty
+	defCfg["tempid.align"] = "false"          // start the TempID periods at multiples of the period, eg. on the hour
+	defCfg["tempid.format"] = "hypertrace"    // hypertrace, or bluetrace to interoperate with the stock OpenTrace apps
+	defCfg["tempid.auth.required"] = "false"  // set to true once the apps are updated, false still issues TempIDs to a registered uid without its pin or device token, answering a Deprecation header
+	defCfg["tempid.device.ttl.hour"] = "720"  // validity of the device tokens answered by /getTempIDs
+	defCfg["tempid.issue.limit"] = "20"       // TempID issuances allowed per uid within tempid.issue.window.minute, 0 allows all
+	defCfg["tempid.issue.window.minute"] = "60"
+	defCfg["tempid.proof.failure.limit"] = "10" // failed pin or device token proofs allowed per uid and per client address within tempid.proof.failure.window.minute, 0 allows all
+	defCfg["tempid.proof.failure.window.minute"] = "15"
 	defCfg["tempid.crypt.key"] = "tH1Sis4nEncryPt10nKeydOn0tsHar3!"
+	defCfg["tempid.key.provider"] = ""        // config, file or kms
+	defCfg["tempid.key.file.dir"] = ""        // directory holding one file per key, named after the key id
+	defCfg["tempid.key.kms.master.file"] = "" // local KMS master key file, the configured keys are then the wrapped keys in base64
+	defCfg["tempid.keyring.ids"] = ""         // comma separated key ids, the key of id N is tempid.keyring.N. Empty uses tempid.crypt.key as key 1
+	defCfg["tempid.keyring.active"] = ""      // id of the key to encrypt with, the highest id by default
+	defCfg["tempid.keyring.retired"] = ""     // comma separated ids of keys that must no longer decrypt
+	defCfg["tempid.keyring.rotate.id"] = ""
+	defCfg["tempid.keyring.rotate.at"] = ""          // RFC3339 time at which tempid.keyring.rotate.id becomes active
+	defCfg["tempid.keyring.retire.after.hour"] = "0" // retire the replaced key that long after the rotation, 0 never does
+
+	defCfg["upload.tempid.skew.second"] = "120"
+	defCfg["upload.tempid.window.policy"] = "reject" // reject, flag or drop records outside of their tempID validity
+	defCfg["upload.partial.accept"] = "false"        // save the valid records of an upload even if some are rejected
 
 	for k := range defCfg {
 		err := viper.BindEnv(k)
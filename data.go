@@ -2,6 +2,9 @@ package hypertrace
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -15,31 +18,182 @@ var (
 	ErrRegisterUIDError = fmt.Errorf("uid registration error")
 	ErrUIDNotFound      = fmt.Errorf("uid not found")
 	ErrTokenNotFound    = fmt.Errorf("token not found")
+	ErrTokenConsumed    = fmt.Errorf("token already used")
+	ErrTokenRevoked     = fmt.Errorf("token revoked")
 	ErrSecretNotValid   = fmt.Errorf("secret not valid")
+	ErrOfficerNotFound  = fmt.Errorf("officer not found")
 	ErrInvalidParameter = fmt.Errorf("invalid parameter")
+	ErrInvalidCursor    = fmt.Errorf("invalid cursor")
 )
 
+// ITracing is the storage of users, officers and trace data.
+// Every implementation must behave the same way, this is verified by the conformance suite in tracing_conformance_test.go.
+// Empty identifiers are always rejected with ErrInvalidParameter.
+// User PINs and officer secrets are only stored hashed, see NewUser and NewOfficer.
 type ITracing interface {
+	// RegisterNewUser registers UID with its handshake PIN. Registering an existing UID replaces its PIN.
 	RegisterNewUser(ctx context.Context, UID, PIN string) (err error)
-	GetHandshakePIN(ctx context.Context, UID string) (PIN string, err error)
+	// VerifyHandshakePIN checks PIN against the one of UID. It returns ErrUIDNotFound if UID is not registered
+	// and ErrPINNotValid if PIN does not match.
+	VerifyHandshakePIN(ctx context.Context, UID, PIN string) (err error)
+	// GetUser returns the user UID, or ErrUIDNotFound if it is not registered.
+	GetUser(ctx context.Context, UID string) (user *User, err error)
+	// DeleteUser erases UID: the user, the traces it uploaded, the traces uploaded by others with UID as CUID
+	// and its upload tokens. Deleting an unknown UID is not an error, it deletes nothing.
+	DeleteUser(ctx context.Context, UID string) (deletion *UserDeletion, err error)
 
-	SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (err error)
-	PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (err error)
+	// SaveTraceData stores data as uploaded by UID with the upload token issued by OID.
+	// The UID and OID of every record are overwritten with the given ones, OID may be empty.
+	// Records are deduplicated on UID, CUID, Timestamp and ModelP, a record already stored, or repeated
+	// within data, is skipped and counted as duplicate. saved holds the records of data actually stored, in order.
+	SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (saved []*TraceData, duplicates int, err error)
+	// PurgeOldTraceData removes every trace with a timestamp strictly older than oldestTimeStamp and returns how many.
+	PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (purged int, err error)
+	// GetTraceData returns all traces uploaded by UID, an unknown UID yields an empty list.
 	GetTraceData(ctx context.Context, UID string) (traces []*TraceData, err error)
+	// QueryTraceData returns at most pageSize traces matching filter, continuing after the given cursor.
+	// An empty cursor starts from the beginning and an empty next cursor means there are no more traces.
+	// Cursors are opaque, backend specific and only valid with the same filter, a malformed one yields ErrInvalidCursor.
+	QueryTraceData(ctx context.Context, filter *TraceFilter, cursor string, pageSize int) (traces []*TraceData, next string, err error)
 
+	// RegisterNewOfficer registers OID with its secret. Registering an existing OID replaces its secret and keeps
+	// its roles, disabled state and timestamps.
 	RegisterNewOfficer(ctx context.Context, OID, secret string) (err error)
+	// RotateOfficerSecret replaces the secret of OID, or returns ErrOfficerNotFound if it is not registered.
+	RotateOfficerSecret(ctx context.Context, OID, secret string) (err error)
+	// SetOfficerRoles replaces the roles of OID, or returns ErrOfficerNotFound if it is not registered.
+	SetOfficerRoles(ctx context.Context, OID string, roles []string) (err error)
+	// UpdateOfficer applies every field of update to OID at once, or returns ErrOfficerNotFound if it is not registered.
+	UpdateOfficer(ctx context.Context, OID string, update *OfficerUpdate) (err error)
+	// TouchOfficer sets the LastUsedAt of OID, or returns ErrOfficerNotFound if it is not registered.
+	TouchOfficer(ctx context.Context, OID string, lastUsedAt int64) (err error)
+	// GetOfficerID returns the OID owning secret, or ErrSecretNotValid if no officer has it.
+	// The officers sharing the lookup prefix of secret are verified against its hash.
 	GetOfficerID(ctx context.Context, secret string) (OID string, err error)
+	// GetOfficer returns the officer OID, or ErrOfficerNotFound if it is not registered.
+	GetOfficer(ctx context.Context, OID string) (officer *Officer, err error)
+	// ListOfficers returns every officer ordered by OID.
+	ListOfficers(ctx context.Context) (officers []*Officer, err error)
+	// DeleteOfficer removes OID, deleting an unknown OID is not an error.
 	DeleteOfficer(ctx context.Context, OID string) (err error)
+
+	// RegisterUploadToken records ut as issued, so it can be consumed once.
+	RegisterUploadToken(ctx context.Context, ut *UploadToken) (err error)
+	// ConsumeUploadToken marks the issued token JTI as used. It returns ErrTokenConsumed if it was already used,
+	// ErrTokenRevoked if it was revoked and ErrTokenNotFound if it was never registered.
+	ConsumeUploadToken(ctx context.Context, JTI string) (err error)
+	// ReleaseUploadToken makes the consumed token JTI usable again, after the upload it was consumed for failed.
+	// A token revoked or not consumed is left untouched, an unknown one yields ErrTokenNotFound.
+	ReleaseUploadToken(ctx context.Context, JTI string) (err error)
+	// RevokeUploadTokens revokes the token JTI issued by OID, or every outstanding token of OID if JTI is empty.
+	// Tokens already used or revoked are left untouched and not counted.
+	RevokeUploadTokens(ctx context.Context, OID, JTI string) (revoked int, err error)
+	// PurgeUploadTokens forgets every token expired strictly before oldestTimeStamp,
+	// upload tokens and used refresh tokens alike.
+	PurgeUploadTokens(ctx context.Context, oldestTimeStamp int64) (err error)
+
+	// ConsumeRefreshToken records the refresh token JTI, valid until validUntil, as used.
+	// It returns ErrTokenConsumed if it was already used.
+	ConsumeRefreshToken(ctx context.Context, JTI string, validUntil int64) (err error)
+
+	// GetTempIDPolicy returns the policy stored with SetTempIDPolicy, or ErrTempIDPolicyNotFound if there is none.
+	GetTempIDPolicy(ctx context.Context) (policy *TempIDPolicy, err error)
+	// SetTempIDPolicy stores policy for every server sharing the storage, a nil policy removes the stored one.
+	SetTempIDPolicy(ctx context.Context, policy *TempIDPolicy) (err error)
+}
+
+// UserDeletion counts what ITracing.DeleteUser erased.
+type UserDeletion struct {
+	User          bool `json:"user"`          // whether the UID was registered
+	Traces        int  `json:"traces"`        // traces uploaded by the UID
+	ContactTraces int  `json:"contactTraces"` // traces uploaded by others with the UID as CUID
+	UploadTokens  int  `json:"uploadTokens"`
+}
+
+// encodeCursor wraps a backend specific position into an opaque, URL safe cursor.
+func encodeCursor(position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// decodeCursor returns the backend specific position held by a cursor made by encodeCursor.
+func decodeCursor(cursor string) (position string, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("%w : %s", ErrInvalidCursor, err.Error())
+	}
+	return string(decoded), nil
+}
+
+// TraceFilter selects the traces returned by ITracing.QueryTraceData.
+// UID is mandatory, every other zero valued field does not filter.
+type TraceFilter struct {
+	UID     string
+	From    int64 // inclusive, in unix seconds
+	To      int64 // inclusive, in unix seconds
+	MinRSSI *int
+	CUID    string
+	OID     string
+	Org     string
+}
+
+// Validate returns ErrInvalidParameter if the filter can not be used for a query.
+func (filter *TraceFilter) Validate() error {
+	if filter == nil || len(filter.UID) == 0 {
+		return ErrInvalidParameter
+	}
+	if filter.From > 0 && filter.To > 0 && filter.From > filter.To {
+		return ErrInvalidParameter
+	}
+	return nil
+}
+
+// Match tells whether td satisfies the filter.
+func (filter *TraceFilter) Match(td *TraceData) bool {
+	switch {
+	case td.UID != filter.UID:
+		return false
+	case filter.From > 0 && td.Timestamp < filter.From:
+		return false
+	case filter.To > 0 && td.Timestamp > filter.To:
+		return false
+	case filter.MinRSSI != nil && td.RSSI < *filter.MinRSSI:
+		return false
+	case len(filter.CUID) > 0 && td.CUID != filter.CUID:
+		return false
+	case len(filter.OID) > 0 && td.OID != filter.OID:
+		return false
+	case len(filter.Org) > 0 && td.Org != filter.Org:
+		return false
+	}
+	return true
 }
 
 type User struct {
-	UID string `json:"uid" bson:"uid"`
-	PIN string `json:"pin" bson:"pin"`
+	UID     string `json:"uid" bson:"uid"`
+	PIN     string `json:"pin,omitempty" bson:"pin,omitempty"` // plaintext PIN, only found in data stored before PINs were hashed
+	PINHash string `json:"pinHash" bson:"pinHash"`
 }
 
 type Officer struct {
-	OID    string `json:"oid" bson:"oid"`
-	Secret string `json:"secret" bson:"secret"`
+	OID          string   `json:"oid" bson:"oid"`
+	Secret       string   `json:"secret,omitempty" bson:"secret,omitempty"` // plaintext secret, only found in data stored before secrets were hashed
+	SecretPrefix string   `json:"secretPrefix" bson:"secretPrefix"`
+	SecretHash   string   `json:"secretHash" bson:"secretHash"`
+	Roles        []string `json:"roles,omitempty" bson:"roles,omitempty"` // empty for officers registered before roles, see EffectiveRoles
+	Disabled     bool     `json:"disabled,omitempty" bson:"disabled,omitempty"`
+	CreatedAt    int64    `json:"createdAt,omitempty" bson:"createdAt,omitempty"`   // unix seconds, 0 for officers registered before it was recorded
+	LastUsedAt   int64    `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"` // unix seconds of the last login, refresh or secret authentication
+}
+
+// OfficerUpdate holds the changes of ITracing.UpdateOfficer, a nil field is left unchanged.
+type OfficerUpdate struct {
+	Roles    []string
+	Disabled *bool
+}
+
+// IsEmpty tells whether update changes nothing.
+func (update *OfficerUpdate) IsEmpty() bool {
+	return update == nil || (update.Roles == nil && update.Disabled == nil)
 }
 
 type TraceData struct {
@@ -52,19 +206,43 @@ type TraceData struct {
 	RSSI      int    `json:"rssi" bson:"rssi"`
 	TxPower   int    `json:"txPower" bson:"txPower"`
 	Org       string `json:"org" bson:"org"`
+	Suspect   bool   `json:"suspect,omitempty" bson:"suspect,omitempty"` // timestamp outside of the TempID validity window
+	Sealed    string `json:"sealed,omitempty" bson:"sealed,omitempty"`   // encrypted fields, see EncryptedTracing
+}
+
+// traceDataKey identifies an encounter, two traces with the same key are duplicates.
+type traceDataKey struct {
+	UID       string
+	CUID      string
+	Timestamp int64
+	ModelP    string
+}
+
+func (td *TraceData) key() traceDataKey {
+	return traceDataKey{
+		UID:       td.UID,
+		CUID:      td.CUID,
+		Timestamp: td.Timestamp,
+		ModelP:    td.ModelP,
+	}
 }
 
-func NewUploadToken(uid, oid string, validHour int) *UploadToken {
+func NewUploadToken(uid, oid string, validHour int) (*UploadToken, error) {
+	jti := make([]byte, UploadTokenLength)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, fmt.Errorf("%w : upload token id error", err)
+	}
 	return &UploadToken{
+		ID:         hex.EncodeToString(jti),
 		OID:        oid,
 		UID:        uid,
 		ValidFrom:  time.Now().Unix(),
 		ValidUntil: time.Now().Add(time.Duration(validHour) * time.Hour).Unix(),
-	}
+	}, nil
 }
 
-func NewUploadTokenFromString(token string, key []byte) (*UploadToken, error) {
-	dataJson, err := decodeAndDecrypt(token, key)
+func NewUploadTokenFromString(token string, keys *Keyring) (*UploadToken, error) {
+	dataJson, err := decodeAndDecrypt(token, keys)
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +252,7 @@ func NewUploadTokenFromString(token string, key []byte) (*UploadToken, error) {
 }
 
 type UploadToken struct {
+	ID         string `json:"jti" bson:"jti"`
 	OID        string `json:"oid" bson:"oid"`
 	UID        string `json:"uid" bson:"uid"`
 	ValidFrom  int64  `json:"nbf" bson:"nbf"`
@@ -85,12 +264,24 @@ func (ut *UploadToken) IsValid() bool {
 	return n > ut.ValidFrom && n < ut.ValidUntil
 }
 
-func (ut *UploadToken) ToToken(key []byte) (token string, err error) {
+const (
+	UploadTokenIssued   = "ISSUED"
+	UploadTokenConsumed = "CONSUMED"
+	UploadTokenRevoked  = "REVOKED"
+)
+
+// IssuedUploadToken is the server side state of an UploadToken, see ITracing.ConsumeUploadToken.
+type IssuedUploadToken struct {
+	UploadToken `bson:",inline"`
+	Status      string `json:"status" bson:"status"`
+}
+
+func (ut *UploadToken) ToToken(keys *Keyring) (token string, err error) {
 	utBytes, err := json.Marshal(ut)
 	if err != nil {
 		return "", err
 	}
-	return encryptAndEncode(utBytes, key)
+	return encryptAndEncode(utBytes, keys)
 }
 
 type DataUpload struct {
@@ -0,0 +1,858 @@
+package hypertrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltLog = logrus.WithField("DB", "Bolt")
+
+	boltUserBucket     = []byte("user")
+	boltOfficerBucket  = []byte("officer")
+	boltTraceBucket    = []byte("trace")
+	boltTraceKeyBucket = []byte("tracekey")
+	boltTokenBucket    = []byte("uploadtoken")
+	boltRefreshBucket  = []byte("refreshtoken")
+	boltSettingBucket  = []byte("setting")
+
+	boltTempIDPolicyKey = []byte("tempidpolicy")
+)
+
+// BoltTracing is an ITracing backed by a single bbolt database file.
+// It needs no database server, survives restarts and is safe for concurrent use
+// since bbolt serializes writers and lets readers run in parallel.
+type BoltTracing struct {
+	path string
+
+	db *bolt.DB
+}
+
+func NewBoltTracing(path string) ITracing {
+	tracing := &BoltTracing{
+		path: path,
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		boltLog.Fatal(err)
+		return nil
+	}
+	tracing.db = db
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltUserBucket, boltOfficerBucket, boltTraceBucket, boltTokenBucket, boltRefreshBucket, boltSettingBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(boltTraceKeyBucket) == nil {
+			if err := createBoltTraceKeyBucket(tx); err != nil {
+				return err
+			}
+		}
+		return hashBoltLegacySecrets(tx)
+	})
+	if err != nil {
+		boltLog.Fatal(err)
+		return nil
+	}
+
+	return tracing
+}
+
+// Close closes the database file.
+func (trace *BoltTracing) Close() error {
+	return trace.db.Close()
+}
+
+// traceKeyPrefix returns the key prefix shared by all trace records uploaded by UID.
+func traceKeyPrefix(UID string) []byte {
+	return append([]byte(UID), 0)
+}
+
+// traceKey builds the trace bucket key UID 0x00 timestamp sequence, so records of a UID
+// are stored next to each other ordered by their timestamp.
+func traceKey(UID string, timestamp int64, seq uint64) []byte {
+	key := traceKeyPrefix(UID)
+	suffix := make([]byte, 16)
+	binary.BigEndian.PutUint64(suffix[:8], uint64(timestamp))
+	binary.BigEndian.PutUint64(suffix[8:], seq)
+	return append(key, suffix...)
+}
+
+// traceDedupKey builds the tracekey bucket key that identifies the encounter of td, see TraceData.key.
+func traceDedupKey(td *TraceData) []byte {
+	key := append([]byte(td.UID), 0)
+	key = append(key, td.CUID...)
+	key = append(key, 0)
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(td.Timestamp))
+	key = append(key, timestamp...)
+	return append(key, td.ModelP...)
+}
+
+// createBoltTraceKeyBucket creates the tracekey bucket, which maps traceDedupKey to the trace bucket key,
+// and indexes the traces already stored by files written before deduplication existed.
+func createBoltTraceKeyBucket(tx *bolt.Tx) error {
+	keyBucket, err := tx.CreateBucket(boltTraceKeyBucket)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltTraceBucket).ForEach(func(k, v []byte) error {
+		td := &TraceData{}
+		if err := json.Unmarshal(v, td); err != nil {
+			return err
+		}
+		return keyBucket.Put(traceDedupKey(td), k)
+	})
+}
+
+// hashBoltLegacySecrets hashes the plaintext PINs and officer secrets stored before they were hashed.
+func hashBoltLegacySecrets(tx *bolt.Tx) error {
+	updates := make(map[string][]byte)
+	userBucket := tx.Bucket(boltUserBucket)
+	err := userBucket.ForEach(func(k, v []byte) error {
+		usr := &User{}
+		if err := json.Unmarshal(v, usr); err != nil {
+			return err
+		}
+		if changed, err := usr.HashLegacyPIN(); err != nil || !changed {
+			return err
+		}
+		userBytes, err := json.Marshal(usr)
+		updates[string(k)] = userBytes
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updates {
+		if err := userBucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	if len(updates) > 0 {
+		boltLog.Infof("hashed the PIN of %d users", len(updates))
+	}
+
+	updates = make(map[string][]byte)
+	offBucket := tx.Bucket(boltOfficerBucket)
+	err = offBucket.ForEach(func(k, v []byte) error {
+		off := &Officer{}
+		if err := json.Unmarshal(v, off); err != nil {
+			return err
+		}
+		if changed, err := off.HashLegacySecret(); err != nil || !changed {
+			return err
+		}
+		offBytes, err := json.Marshal(off)
+		updates[string(k)] = offBytes
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updates {
+		if err := offBucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	if len(updates) > 0 {
+		boltLog.Infof("hashed the secret of %d officers", len(updates))
+	}
+	return nil
+}
+
+// traceKeyTimestamp extracts the timestamp part of a key made by traceKey.
+func traceKeyTimestamp(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-16 : len(key)-8]))
+}
+
+func (trace *BoltTracing) RegisterNewUser(ctx context.Context, UID, PIN string) (err error) {
+	boltLog.Tracef("RegisterNewUser UID:%s", UID)
+	if len(UID) == 0 || len(PIN) == 0 {
+		return ErrInvalidParameter
+	}
+	usr, err := NewUser(UID, PIN)
+	if err != nil {
+		return err
+	}
+	userBytes, err := json.Marshal(usr)
+	if err != nil {
+		return err
+	}
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserBucket).Put([]byte(UID), userBytes)
+	})
+}
+func (trace *BoltTracing) VerifyHandshakePIN(ctx context.Context, UID, PIN string) (err error) {
+	boltLog.Tracef("VerifyHandshakePIN UID:%s", UID)
+	if len(UID) == 0 || len(PIN) == 0 {
+		return ErrInvalidParameter
+	}
+	usr := &User{}
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		userBytes := tx.Bucket(boltUserBucket).Get([]byte(UID))
+		if userBytes == nil {
+			return ErrUIDNotFound
+		}
+		return json.Unmarshal(userBytes, usr)
+	})
+	if err != nil {
+		return err
+	}
+	if !verifySecret(usr.PINHash, PIN) {
+		return ErrPINNotValid
+	}
+	return nil
+}
+
+func (trace *BoltTracing) GetUser(ctx context.Context, UID string) (user *User, err error) {
+	boltLog.Tracef("GetUser UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	user = &User{}
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		userBytes := tx.Bucket(boltUserBucket).Get([]byte(UID))
+		if userBytes == nil {
+			return ErrUIDNotFound
+		}
+		return json.Unmarshal(userBytes, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// DeleteUser erases UID in a single transaction, finding the traces where UID is the CUID takes a scan of every trace.
+func (trace *BoltTracing) DeleteUser(ctx context.Context, UID string) (deletion *UserDeletion, err error) {
+	boltLog.Tracef("DeleteUser UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	err = trace.db.Update(func(tx *bolt.Tx) error {
+		deletion = &UserDeletion{}
+		users := tx.Bucket(boltUserBucket)
+		if users.Get([]byte(UID)) != nil {
+			if err := users.Delete([]byte(UID)); err != nil {
+				return err
+			}
+			deletion.User = true
+		}
+
+		bucket := tx.Bucket(boltTraceBucket)
+		keyBucket := tx.Bucket(boltTraceKeyBucket)
+		keys := make([][]byte, 0)
+		dedupKeys := make([][]byte, 0)
+		err := bucket.ForEach(func(k, v []byte) error {
+			td := &TraceData{}
+			if err := json.Unmarshal(v, td); err != nil {
+				return err
+			}
+			switch UID {
+			case td.UID:
+				deletion.Traces++
+			case td.CUID:
+				deletion.ContactTraces++
+			default:
+				return nil
+			}
+			keys = append(keys, k)
+			dedupKeys = append(dedupKeys, traceDedupKey(td))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			if err := keyBucket.Delete(dedupKeys[i]); err != nil {
+				return err
+			}
+		}
+
+		tokens := tx.Bucket(boltTokenBucket)
+		jtis := make([][]byte, 0)
+		err = tokens.ForEach(func(k, v []byte) error {
+			iut := &IssuedUploadToken{}
+			if err := json.Unmarshal(v, iut); err != nil {
+				return err
+			}
+			if iut.UID == UID {
+				jtis = append(jtis, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range jtis {
+			if err := tokens.Delete(k); err != nil {
+				return err
+			}
+		}
+		deletion.UploadTokens = len(jtis)
+		return nil
+	})
+	if err != nil {
+		boltLog.Errorf("DeleteUser got %s", err)
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// SaveTraceData refuses records with a negative timestamp, traceKey would sort them after every other record of UID.
+func (trace *BoltTracing) SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (saved []*TraceData, duplicates int, err error) {
+	if len(UID) == 0 {
+		return nil, 0, ErrInvalidParameter
+	}
+	for _, d := range data {
+		if d.Timestamp < 0 {
+			return nil, 0, fmt.Errorf("%w : negative timestamp %d", ErrInvalidParameter, d.Timestamp)
+		}
+	}
+	boltLog.Tracef("SaveTraceData UID:%s OID:%s, %d items", UID, OID, len(data))
+	err = trace.db.Update(func(tx *bolt.Tx) error {
+		saved, duplicates = make([]*TraceData, 0, len(data)), 0
+		bucket := tx.Bucket(boltTraceBucket)
+		keyBucket := tx.Bucket(boltTraceKeyBucket)
+		for _, d := range data {
+			d.UID = UID
+			d.OID = OID
+			dedupKey := traceDedupKey(d)
+			if keyBucket.Get(dedupKey) != nil {
+				duplicates++
+				continue
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			traceBytes, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			key := traceKey(UID, d.Timestamp, seq)
+			if err := bucket.Put(key, traceBytes); err != nil {
+				return err
+			}
+			if err := keyBucket.Put(dedupKey, key); err != nil {
+				return err
+			}
+			saved = append(saved, d)
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Errorf("SaveTraceData got %s", err)
+		return nil, 0, err
+	}
+	return saved, duplicates, nil
+}
+func (trace *BoltTracing) PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (purged int, err error) {
+	boltLog.Tracef("PurgeOldTraceData")
+	deleted := 0
+	err = trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTraceBucket)
+		keyBucket := tx.Bucket(boltTraceKeyBucket)
+		keys := make([][]byte, 0)
+		dedupKeys := make([][]byte, 0)
+		err := bucket.ForEach(func(k, v []byte) error {
+			if traceKeyTimestamp(k) < oldestTimeStamp {
+				td := &TraceData{}
+				if err := json.Unmarshal(v, td); err != nil {
+					return err
+				}
+				keys = append(keys, k)
+				dedupKeys = append(dedupKeys, traceDedupKey(td))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			if err := keyBucket.Delete(dedupKeys[i]); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if err != nil {
+		boltLog.Errorf("PurgeOldTraceData got %s", err)
+		return 0, err
+	}
+	boltLog.Tracef("PurgeOldTraceData deleted %d entries", deleted)
+	return deleted, nil
+}
+func (trace *BoltTracing) GetTraceData(ctx context.Context, UID string) (traces []*TraceData, err error) {
+	boltLog.Tracef("GetTraceData UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	traces = make([]*TraceData, 0)
+	prefix := traceKeyPrefix(UID)
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltTraceBucket).Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			td := &TraceData{}
+			if err := json.Unmarshal(v, td); err != nil {
+				return err
+			}
+			traces = append(traces, td)
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Errorf("GetTraceData got %s", err)
+		return nil, err
+	}
+	return traces, nil
+}
+func (trace *BoltTracing) QueryTraceData(ctx context.Context, filter *TraceFilter, cursor string, pageSize int) (traces []*TraceData, next string, err error) {
+	if err := filter.Validate(); err != nil || pageSize <= 0 {
+		return nil, "", ErrInvalidParameter
+	}
+	boltLog.Tracef("QueryTraceData UID:%s cursor:%s", filter.UID, cursor)
+	prefix := traceKeyPrefix(filter.UID)
+	// keys are ordered by timestamp within a UID, so the time window is a key range
+	from := filter.From
+	if from < 0 {
+		from = 0
+	}
+	start := traceKey(filter.UID, from, 0)
+	if len(cursor) > 0 {
+		position, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start = []byte(position)
+		if !bytes.HasPrefix(start, prefix) {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	traces = make([]*TraceData, 0)
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltTraceBucket).Cursor()
+		k, v := c.Seek(start)
+		if len(cursor) > 0 && bytes.Equal(k, start) {
+			k, v = c.Next()
+		}
+		var last []byte
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if filter.To > 0 && traceKeyTimestamp(k) > filter.To {
+				return nil
+			}
+			td := &TraceData{}
+			if err := json.Unmarshal(v, td); err != nil {
+				return err
+			}
+			if !filter.Match(td) {
+				continue
+			}
+			if len(traces) == pageSize {
+				next = encodeCursor(string(last))
+				return nil
+			}
+			traces = append(traces, td)
+			last = k
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Errorf("QueryTraceData got %s", err)
+		return nil, "", err
+	}
+	return traces, next, nil
+}
+
+func (trace *BoltTracing) RegisterNewOfficer(ctx context.Context, OID, secret string) (err error) {
+	boltLog.Tracef("RegisterNewOfficer OID:%s", OID)
+	if len(OID) == 0 || len(secret) == 0 {
+		return ErrInvalidParameter
+	}
+	off, err := NewOfficer(OID, secret)
+	if err != nil {
+		return err
+	}
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltOfficerBucket)
+		if v := bucket.Get([]byte(OID)); v != nil {
+			registered := &Officer{}
+			if err := json.Unmarshal(v, registered); err != nil {
+				return err
+			}
+			off.Roles = registered.Roles
+			off.Disabled = registered.Disabled
+			off.CreatedAt = registered.CreatedAt
+			off.LastUsedAt = registered.LastUsedAt
+		}
+		offBytes, err := json.Marshal(off)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(OID), offBytes)
+	})
+}
+func (trace *BoltTracing) SetOfficerRoles(ctx context.Context, OID string, roles []string) (err error) {
+	boltLog.Tracef("SetOfficerRoles OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		off.Roles = roles
+	})
+}
+func (trace *BoltTracing) RotateOfficerSecret(ctx context.Context, OID, secret string) (err error) {
+	boltLog.Tracef("RotateOfficerSecret OID:%s", OID)
+	if len(OID) == 0 || len(secret) == 0 {
+		return ErrInvalidParameter
+	}
+	rotated, err := NewOfficer(OID, secret)
+	if err != nil {
+		return err
+	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		off.Secret = ""
+		off.SecretPrefix = rotated.SecretPrefix
+		off.SecretHash = rotated.SecretHash
+	})
+}
+func (trace *BoltTracing) UpdateOfficer(ctx context.Context, OID string, update *OfficerUpdate) (err error) {
+	boltLog.Tracef("UpdateOfficer OID:%s", OID)
+	if len(OID) == 0 || update.IsEmpty() {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		if update.Roles != nil {
+			off.Roles = update.Roles
+		}
+		if update.Disabled != nil {
+			off.Disabled = *update.Disabled
+		}
+	})
+}
+func (trace *BoltTracing) TouchOfficer(ctx context.Context, OID string, lastUsedAt int64) (err error) {
+	boltLog.Tracef("TouchOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		off.LastUsedAt = lastUsedAt
+	})
+}
+
+// updateOfficer reads, changes with update and writes back the officer OID in a single transaction.
+func (trace *BoltTracing) updateOfficer(OID string, update func(off *Officer)) error {
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltOfficerBucket)
+		v := bucket.Get([]byte(OID))
+		if v == nil {
+			return ErrOfficerNotFound
+		}
+		off := &Officer{}
+		if err := json.Unmarshal(v, off); err != nil {
+			return err
+		}
+		update(off)
+		offBytes, err := json.Marshal(off)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(OID), offBytes)
+	})
+}
+func (trace *BoltTracing) GetOfficerID(ctx context.Context, secret string) (OID string, err error) {
+	boltLog.Tracef("GetOfficerID secret:****")
+	if len(secret) == 0 {
+		return "", ErrInvalidParameter
+	}
+	prefix := secretPrefix(secret)
+	candidates := make([]*Officer, 0)
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOfficerBucket).ForEach(func(k, v []byte) error {
+			off := &Officer{}
+			if err := json.Unmarshal(v, off); err != nil {
+				return err
+			}
+			if off.SecretPrefix == prefix {
+				candidates = append(candidates, off)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		boltLog.Errorf("GetOfficerID got %s", err)
+		return "", err
+	}
+	return verifyOfficerCandidates(candidates, secret)
+}
+func (trace *BoltTracing) GetOfficer(ctx context.Context, OID string) (officer *Officer, err error) {
+	boltLog.Tracef("GetOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	var offBytes []byte
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltOfficerBucket).Get([]byte(OID)); v != nil {
+			offBytes = append(offBytes, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Errorf("GetOfficer OID:%s got %s", OID, err)
+		return nil, err
+	}
+	if offBytes == nil {
+		return nil, ErrOfficerNotFound
+	}
+	officer = &Officer{}
+	if err := json.Unmarshal(offBytes, officer); err != nil {
+		return nil, err
+	}
+	return officer, nil
+}
+func (trace *BoltTracing) ListOfficers(ctx context.Context) (officers []*Officer, err error) {
+	boltLog.Tracef("ListOfficers")
+	officers = make([]*Officer, 0)
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOfficerBucket).ForEach(func(k, v []byte) error {
+			off := &Officer{}
+			if err := json.Unmarshal(v, off); err != nil {
+				return err
+			}
+			officers = append(officers, off)
+			return nil
+		})
+	})
+	if err != nil {
+		boltLog.Errorf("ListOfficers got %s", err)
+		return nil, err
+	}
+	return officers, nil
+}
+func (trace *BoltTracing) DeleteOfficer(ctx context.Context, OID string) (err error) {
+	boltLog.Tracef("DeleteOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltOfficerBucket).Delete([]byte(OID))
+	})
+}
+
+func (trace *BoltTracing) RegisterUploadToken(ctx context.Context, ut *UploadToken) (err error) {
+	boltLog.Tracef("RegisterUploadToken JTI:%s", ut.ID)
+	if len(ut.ID) == 0 {
+		return ErrInvalidParameter
+	}
+	tokenBytes, err := json.Marshal(&IssuedUploadToken{UploadToken: *ut, Status: UploadTokenIssued})
+	if err != nil {
+		return err
+	}
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokenBucket).Put([]byte(ut.ID), tokenBytes)
+	})
+}
+func (trace *BoltTracing) ConsumeUploadToken(ctx context.Context, JTI string) (err error) {
+	boltLog.Tracef("ConsumeUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTokenBucket)
+		tokenBytes := bucket.Get([]byte(JTI))
+		if tokenBytes == nil {
+			return ErrTokenNotFound
+		}
+		iut := &IssuedUploadToken{}
+		if err := json.Unmarshal(tokenBytes, iut); err != nil {
+			return err
+		}
+		switch iut.Status {
+		case UploadTokenConsumed:
+			return ErrTokenConsumed
+		case UploadTokenRevoked:
+			return ErrTokenRevoked
+		}
+		iut.Status = UploadTokenConsumed
+		tokenBytes, err := json.Marshal(iut)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(JTI), tokenBytes)
+	})
+}
+func (trace *BoltTracing) ReleaseUploadToken(ctx context.Context, JTI string) (err error) {
+	boltLog.Tracef("ReleaseUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTokenBucket)
+		tokenBytes := bucket.Get([]byte(JTI))
+		if tokenBytes == nil {
+			return ErrTokenNotFound
+		}
+		iut := &IssuedUploadToken{}
+		if err := json.Unmarshal(tokenBytes, iut); err != nil {
+			return err
+		}
+		if iut.Status != UploadTokenConsumed {
+			return nil
+		}
+		iut.Status = UploadTokenIssued
+		tokenBytes, err := json.Marshal(iut)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(JTI), tokenBytes)
+	})
+}
+func (trace *BoltTracing) RevokeUploadTokens(ctx context.Context, OID, JTI string) (revoked int, err error) {
+	boltLog.Tracef("RevokeUploadTokens OID:%s JTI:%s", OID, JTI)
+	if len(OID) == 0 {
+		return 0, ErrInvalidParameter
+	}
+	err = trace.db.Update(func(tx *bolt.Tx) error {
+		revoked = 0
+		bucket := tx.Bucket(boltTokenBucket)
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(JTI) > 0 && string(k) != JTI {
+				return nil
+			}
+			iut := &IssuedUploadToken{}
+			if err := json.Unmarshal(v, iut); err != nil {
+				return err
+			}
+			if iut.OID != OID || iut.Status != UploadTokenIssued {
+				return nil
+			}
+			iut.Status = UploadTokenRevoked
+			tokenBytes, err := json.Marshal(iut)
+			if err != nil {
+				return err
+			}
+			updates[string(k)] = tokenBytes
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range updates {
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		revoked = len(updates)
+		return nil
+	})
+	if err != nil {
+		boltLog.Errorf("RevokeUploadTokens got %s", err)
+		return 0, err
+	}
+	return revoked, nil
+}
+func (trace *BoltTracing) PurgeUploadTokens(ctx context.Context, oldestTimeStamp int64) (err error) {
+	boltLog.Tracef("PurgeUploadTokens")
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltTokenBucket)
+		keys := make([][]byte, 0)
+		err := bucket.ForEach(func(k, v []byte) error {
+			iut := &IssuedUploadToken{}
+			if err := json.Unmarshal(v, iut); err != nil {
+				return err
+			}
+			if iut.ValidUntil < oldestTimeStamp {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		refreshBucket := tx.Bucket(boltRefreshBucket)
+		keys = make([][]byte, 0)
+		err = refreshBucket.ForEach(func(k, v []byte) error {
+			if int64(binary.BigEndian.Uint64(v)) < oldestTimeStamp {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := refreshBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+func (trace *BoltTracing) ConsumeRefreshToken(ctx context.Context, JTI string, validUntil int64) (err error) {
+	boltLog.Tracef("ConsumeRefreshToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRefreshBucket)
+		if bucket.Get([]byte(JTI)) != nil {
+			return ErrTokenConsumed
+		}
+		expiry := make([]byte, 8)
+		binary.BigEndian.PutUint64(expiry, uint64(validUntil))
+		return bucket.Put([]byte(JTI), expiry)
+	})
+}
+
+func (trace *BoltTracing) GetTempIDPolicy(ctx context.Context) (policy *TempIDPolicy, err error) {
+	boltLog.Tracef("GetTempIDPolicy")
+	err = trace.db.View(func(tx *bolt.Tx) error {
+		policyBytes := tx.Bucket(boltSettingBucket).Get(boltTempIDPolicyKey)
+		if policyBytes == nil {
+			return ErrTempIDPolicyNotFound
+		}
+		policy = &TempIDPolicy{}
+		return json.Unmarshal(policyBytes, policy)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+func (trace *BoltTracing) SetTempIDPolicy(ctx context.Context, policy *TempIDPolicy) (err error) {
+	boltLog.Tracef("SetTempIDPolicy")
+	return trace.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltSettingBucket)
+		if policy == nil {
+			return bucket.Delete(boltTempIDPolicyKey)
+		}
+		policyBytes, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltTempIDPolicyKey, policyBytes)
+	})
+}
@@ -0,0 +1,343 @@
+package hypertrace
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrSealedTraceNotValid = fmt.Errorf("sealed trace not valid")
+
+	encryptedLog = logrus.WithField("DB", "Encrypted")
+)
+
+const (
+	// positions of the EncryptedTracing cursors, followed by the cursor of the wrapped storage
+	legacyTracePosition = "legacy:"
+	sealedTracePosition = "sealed:"
+)
+
+// EncryptedTracing wraps any ITracing and encrypts the trace data fields telling who met whom before they are stored.
+// UID, CUID, ModelC and ModelP are sealed with the seal key into TraceData.Sealed, UID, CUID and ModelP are
+// replaced by blind indexes, a keyed HMAC-SHA256, so traces can still be looked up, filtered and deduplicated.
+// OID, Timestamp, RSSI, TxPower, Org and Suspect are stored in clear, they are needed to purge and query.
+// Traces stored in clear before the encryption was enabled are still returned, QueryTraceData pages them before the sealed ones.
+type EncryptedTracing struct {
+	tracing    ITracing
+	keys       *Keyring
+	legacyKeys *Keyring
+	indexKey   []byte
+}
+
+// sealedTraceData holds the fields of a TraceData sealed into TraceData.Sealed.
+type sealedTraceData struct {
+	UID    string `json:"uid"`
+	CUID   string `json:"cuid"`
+	ModelC string `json:"modelC"`
+	ModelP string `json:"modelP"`
+}
+
+// NewEncryptedTracing creates an EncryptedTracing storing into tracing. Traces are sealed with sealKey, KeySize bytes,
+// and the blind indexes are keyed with indexKey, which must be at least KeySize bytes. Neither is part of a keyring,
+// they are never rotated nor retired, and must never change once data is stored. Traces sealed with the TempID
+// keyring by earlier versions are still opened with legacyKeys, if not nil.
+func NewEncryptedTracing(tracing ITracing, sealKey, indexKey []byte, legacyKeys *Keyring) ITracing {
+	if len(indexKey) < KeySize {
+		encryptedLog.Fatalf("blind index key is %d bytes, we expect at least %d", len(indexKey), KeySize)
+		return nil
+	}
+	keys := NewKeyring()
+	if err := keys.AddKey(1, sealKey); err != nil {
+		encryptedLog.Fatalf("invalid trace seal key. got %s", err.Error())
+		return nil
+	}
+	_ = keys.SetActive(1)
+	return &EncryptedTracing{
+		tracing:    tracing,
+		keys:       keys,
+		legacyKeys: legacyKeys,
+		indexKey:   indexKey,
+	}
+}
+
+// blindIndex returns the keyed hash of value in the given domain, so equal values of different fields do not share an index.
+func (trace *EncryptedTracing) blindIndex(domain, value string) string {
+	mac := hmac.New(sha256.New, trace.indexKey)
+	mac.Write([]byte(domain))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// userIndex is the blind index of UID and CUID, they share it so a CUID can be matched against the UID it belongs to.
+func (trace *EncryptedTracing) userIndex(UID string) string {
+	return trace.blindIndex("uid", UID)
+}
+
+func (trace *EncryptedTracing) seal(td *TraceData) (*TraceData, error) {
+	sealedJson, err := json.Marshal(&sealedTraceData{
+		UID:    td.UID,
+		CUID:   td.CUID,
+		ModelC: td.ModelC,
+		ModelP: td.ModelP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := encryptAndEncode(sealedJson, trace.keys)
+	if err != nil {
+		return nil, fmt.Errorf("%w : trace seal error", err)
+	}
+	return &TraceData{
+		OID:       td.OID,
+		UID:       trace.userIndex(td.UID),
+		CUID:      trace.userIndex(td.CUID),
+		Timestamp: td.Timestamp,
+		ModelP:    trace.blindIndex("modelP", td.ModelP),
+		RSSI:      td.RSSI,
+		TxPower:   td.TxPower,
+		Org:       td.Org,
+		Suspect:   td.Suspect,
+		Sealed:    sealed,
+	}, nil
+}
+
+// open returns the trace sealed in td. The sealed UID must match the blind index of td,
+// so a sealed value copied over to another trace is detected.
+func (trace *EncryptedTracing) open(td *TraceData) (*TraceData, error) {
+	sealedJson, err := decodeAndDecrypt(td.Sealed, trace.keys)
+	if err != nil && trace.legacyKeys != nil {
+		sealedJson, err = decodeAndDecrypt(td.Sealed, trace.legacyKeys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w : trace open error", err)
+	}
+	sealed := &sealedTraceData{}
+	if err := json.Unmarshal(sealedJson, sealed); err != nil {
+		return nil, fmt.Errorf("%w : trace open error", err)
+	}
+	if !hmac.Equal([]byte(trace.userIndex(sealed.UID)), []byte(td.UID)) {
+		return nil, ErrSealedTraceNotValid
+	}
+	return &TraceData{
+		OID:       td.OID,
+		UID:       sealed.UID,
+		CUID:      sealed.CUID,
+		Timestamp: td.Timestamp,
+		ModelC:    sealed.ModelC,
+		ModelP:    sealed.ModelP,
+		RSSI:      td.RSSI,
+		TxPower:   td.TxPower,
+		Org:       td.Org,
+		Suspect:   td.Suspect,
+	}, nil
+}
+
+// openAll opens the stored traces. A trace that can not be opened is left out and logged, so a single
+// corrupted or tampered trace does not hide every other trace of the user.
+func (trace *EncryptedTracing) openAll(stored []*TraceData) (traces []*TraceData) {
+	traces = make([]*TraceData, 0, len(stored))
+	for _, td := range stored {
+		opened, err := trace.open(td)
+		if err != nil {
+			encryptedLog.Errorf("open trace of %s at %d left out. got %s", td.UID, td.Timestamp, err.Error())
+			continue
+		}
+		traces = append(traces, opened)
+	}
+	return traces
+}
+
+func (trace *EncryptedTracing) RegisterNewUser(ctx context.Context, UID, PIN string) (err error) {
+	return trace.tracing.RegisterNewUser(ctx, UID, PIN)
+}
+func (trace *EncryptedTracing) VerifyHandshakePIN(ctx context.Context, UID, PIN string) (err error) {
+	return trace.tracing.VerifyHandshakePIN(ctx, UID, PIN)
+}
+
+func (trace *EncryptedTracing) GetUser(ctx context.Context, UID string) (user *User, err error) {
+	return trace.tracing.GetUser(ctx, UID)
+}
+
+// DeleteUser erases UID from the wrapped storage twice, as itself for the user, its upload tokens and the traces stored
+// in clear, then as its blind index for the encrypted traces.
+func (trace *EncryptedTracing) DeleteUser(ctx context.Context, UID string) (deletion *UserDeletion, err error) {
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	deletion, err = trace.tracing.DeleteUser(ctx, UID)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := trace.tracing.DeleteUser(ctx, trace.userIndex(UID))
+	if err != nil {
+		return nil, err
+	}
+	deletion.Traces += sealed.Traces
+	deletion.ContactTraces += sealed.ContactTraces
+	return deletion, nil
+}
+
+func (trace *EncryptedTracing) SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (saved []*TraceData, duplicates int, err error) {
+	if len(UID) == 0 {
+		return nil, 0, ErrInvalidParameter
+	}
+	sealed := make([]*TraceData, 0, len(data))
+	plain := make(map[*TraceData]*TraceData, len(data))
+	for _, d := range data {
+		d.UID = UID
+		d.OID = OID
+		td, err := trace.seal(d)
+		if err != nil {
+			encryptedLog.Errorf("SaveTraceData . seal got %s", err.Error())
+			return nil, 0, err
+		}
+		sealed = append(sealed, td)
+		plain[td] = d
+	}
+	savedSealed, duplicates, err := trace.tracing.SaveTraceData(ctx, trace.userIndex(UID), OID, sealed)
+	if err != nil {
+		return nil, 0, err
+	}
+	saved = make([]*TraceData, 0, len(savedSealed))
+	for _, td := range savedSealed {
+		saved = append(saved, plain[td])
+	}
+	return saved, duplicates, nil
+}
+func (trace *EncryptedTracing) PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (purged int, err error) {
+	return trace.tracing.PurgeOldTraceData(ctx, oldestTimeStamp)
+}
+func (trace *EncryptedTracing) GetTraceData(ctx context.Context, UID string) (traces []*TraceData, err error) {
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	legacy, err := trace.tracing.GetTraceData(ctx, UID)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := trace.tracing.GetTraceData(ctx, trace.userIndex(UID))
+	if err != nil {
+		return nil, err
+	}
+	traces = trace.openAll(stored)
+	for _, td := range legacy {
+		if len(td.Sealed) == 0 {
+			traces = append(traces, td)
+		}
+	}
+	return traces, nil
+}
+
+// QueryTraceData returns the traces stored in clear before the encryption was enabled first, then the sealed ones.
+// The cursor tells which of both the next page continues, together with the cursor of the wrapped storage.
+func (trace *EncryptedTracing) QueryTraceData(ctx context.Context, filter *TraceFilter, cursor string, pageSize int) (traces []*TraceData, next string, err error) {
+	if err := filter.Validate(); err != nil || pageSize <= 0 {
+		return nil, "", ErrInvalidParameter
+	}
+	position := legacyTracePosition
+	if len(cursor) > 0 {
+		if position, err = decodeCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+	traces = make([]*TraceData, 0)
+	switch {
+	case strings.HasPrefix(position, legacyTracePosition):
+		// the wrapped storage only holds sealed traces under the blind index, so these are all legacy ones
+		legacy, legacyNext, err := trace.tracing.QueryTraceData(ctx, filter, strings.TrimPrefix(position, legacyTracePosition), pageSize)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, td := range legacy {
+			if len(td.Sealed) == 0 {
+				traces = append(traces, td)
+			}
+		}
+		if len(legacyNext) > 0 {
+			return traces, encodeCursor(legacyTracePosition + legacyNext), nil
+		}
+		if len(legacy) == pageSize {
+			return traces, encodeCursor(sealedTracePosition), nil
+		}
+		pageSize -= len(legacy)
+		position = sealedTracePosition
+	case !strings.HasPrefix(position, sealedTracePosition):
+		return nil, "", ErrInvalidCursor
+	}
+
+	blindFilter := *filter
+	blindFilter.UID = trace.userIndex(filter.UID)
+	if len(filter.CUID) > 0 {
+		blindFilter.CUID = trace.userIndex(filter.CUID)
+	}
+	stored, sealedNext, err := trace.tracing.QueryTraceData(ctx, &blindFilter, strings.TrimPrefix(position, sealedTracePosition), pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(sealedNext) > 0 {
+		next = encodeCursor(sealedTracePosition + sealedNext)
+	}
+	return append(traces, trace.openAll(stored)...), next, nil
+}
+
+func (trace *EncryptedTracing) RegisterNewOfficer(ctx context.Context, OID, secret string) (err error) {
+	return trace.tracing.RegisterNewOfficer(ctx, OID, secret)
+}
+func (trace *EncryptedTracing) RotateOfficerSecret(ctx context.Context, OID, secret string) (err error) {
+	return trace.tracing.RotateOfficerSecret(ctx, OID, secret)
+}
+func (trace *EncryptedTracing) SetOfficerRoles(ctx context.Context, OID string, roles []string) (err error) {
+	return trace.tracing.SetOfficerRoles(ctx, OID, roles)
+}
+func (trace *EncryptedTracing) UpdateOfficer(ctx context.Context, OID string, update *OfficerUpdate) (err error) {
+	return trace.tracing.UpdateOfficer(ctx, OID, update)
+}
+func (trace *EncryptedTracing) TouchOfficer(ctx context.Context, OID string, lastUsedAt int64) (err error) {
+	return trace.tracing.TouchOfficer(ctx, OID, lastUsedAt)
+}
+func (trace *EncryptedTracing) GetOfficerID(ctx context.Context, secret string) (OID string, err error) {
+	return trace.tracing.GetOfficerID(ctx, secret)
+}
+func (trace *EncryptedTracing) GetOfficer(ctx context.Context, OID string) (officer *Officer, err error) {
+	return trace.tracing.GetOfficer(ctx, OID)
+}
+func (trace *EncryptedTracing) ListOfficers(ctx context.Context) (officers []*Officer, err error) {
+	return trace.tracing.ListOfficers(ctx)
+}
+func (trace *EncryptedTracing) DeleteOfficer(ctx context.Context, OID string) (err error) {
+	return trace.tracing.DeleteOfficer(ctx, OID)
+}
+
+func (trace *EncryptedTracing) RegisterUploadToken(ctx context.Context, ut *UploadToken) (err error) {
+	return trace.tracing.RegisterUploadToken(ctx, ut)
+}
+func (trace *EncryptedTracing) ConsumeUploadToken(ctx context.Context, JTI string) (err error) {
+	return trace.tracing.ConsumeUploadToken(ctx, JTI)
+}
+func (trace *EncryptedTracing) ReleaseUploadToken(ctx context.Context, JTI string) (err error) {
+	return trace.tracing.ReleaseUploadToken(ctx, JTI)
+}
+func (trace *EncryptedTracing) RevokeUploadTokens(ctx context.Context, OID, JTI string) (revoked int, err error) {
+	return trace.tracing.RevokeUploadTokens(ctx, OID, JTI)
+}
+func (trace *EncryptedTracing) PurgeUploadTokens(ctx context.Context, oldestTimeStamp int64) (err error) {
+	return trace.tracing.PurgeUploadTokens(ctx, oldestTimeStamp)
+}
+func (trace *EncryptedTracing) ConsumeRefreshToken(ctx context.Context, JTI string, validUntil int64) (err error) {
+	return trace.tracing.ConsumeRefreshToken(ctx, JTI, validUntil)
+}
+
+func (trace *EncryptedTracing) GetTempIDPolicy(ctx context.Context) (policy *TempIDPolicy, err error) {
+	return trace.tracing.GetTempIDPolicy(ctx)
+}
+func (trace *EncryptedTracing) SetTempIDPolicy(ctx context.Context, policy *TempIDPolicy) (err error) {
+	return trace.tracing.SetTempIDPolicy(ctx, policy)
+}
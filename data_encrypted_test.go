@@ -0,0 +1,143 @@
+package hypertrace
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+var (
+	testSealKey  = []byte("thisisthetracesealingkey01234567")
+	testIndexKey = []byte("thisistheblindindexkey0123456789")
+)
+
+func TestEncryptedTracingConformance(t *testing.T) {
+	testTracingConformance(t, func(t *testing.T) ITracing {
+		return NewEncryptedTracing(NewInMemoryTracing(), testSealKey, testIndexKey, nil)
+	})
+}
+
+// TestEncryptedMongoDBTracingConformance runs against the mongo.* configured server when TRACE_TEST_MONGODB is true.
+func TestEncryptedMongoDBTracingConformance(t *testing.T) {
+	if os.Getenv("TRACE_TEST_MONGODB") != "true" {
+		t.Skip("set TRACE_TEST_MONGODB=true to run against MongoDB")
+	}
+	testTracingConformance(t, func(t *testing.T) ITracing {
+		return NewEncryptedTracing(newMongoDBConformanceTracing(t), testSealKey, testIndexKey, nil)
+	})
+}
+
+func TestEncryptedTracing_NoPlaintext(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryTracing().(*InMemoryTracing)
+	tracing := NewEncryptedTracing(inner, testSealKey, testIndexKey, nil)
+	uid := "encryptUID00000000001"
+	cuid := "encryptUID00000000002"
+
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: cuid, Timestamp: 100, ModelC: "phoneC", ModelP: "phoneP"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, dup, err := tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: cuid, Timestamp: 100, ModelP: "phoneP"}}); err != nil || dup != 1 {
+		t.Fatalf("expect the same encounter to be a duplicate, got %d, %v", dup, err)
+	}
+	if len(inner.TraceDatas) != 1 {
+		t.Fatalf("expect 1 stored trace, got %d", len(inner.TraceDatas))
+	}
+	stored := inner.TraceDatas[0]
+	for _, field := range []string{stored.UID, stored.CUID, stored.ModelC, stored.ModelP, stored.Sealed} {
+		for _, plain := range []string{uid, cuid, "phoneC", "phoneP"} {
+			if strings.Contains(field, plain) {
+				t.Fatalf("expect no plaintext %s in the stored trace %+v", plain, stored)
+			}
+		}
+	}
+
+	traces, _, err := tracing.QueryTraceData(ctx, &TraceFilter{UID: uid, CUID: cuid}, "", 10)
+	if err != nil || len(traces) != 1 {
+		t.Fatalf("expect 1 trace, got %v, %v", traces, err)
+	}
+	if td := traces[0]; td.UID != uid || td.CUID != cuid || td.ModelC != "phoneC" || td.ModelP != "phoneP" || len(td.Sealed) > 0 {
+		t.Fatalf("unexpected opened trace %+v", td)
+	}
+
+	// a sealed value moved to the trace of another user must not be opened
+	other := &TraceData{CUID: "x", Timestamp: 100}
+	if _, _, err := tracing.SaveTraceData(ctx, cuid, "officer1", []*TraceData{other}); err != nil {
+		t.Fatal(err)
+	}
+	inner.TraceDatas[1].Sealed = stored.Sealed
+	if traces, err := tracing.GetTraceData(ctx, cuid); err != nil || len(traces) != 0 {
+		t.Fatalf("expect the tampered trace left out, got %v, %v", traces, err)
+	}
+	if opened, err := tracing.(*EncryptedTracing).open(inner.TraceDatas[1]); !errors.Is(err, ErrSealedTraceNotValid) {
+		t.Fatalf("expect ErrSealedTraceNotValid, got %v, %v", opened, err)
+	}
+}
+
+func TestEncryptedTracing_LongFields(t *testing.T) {
+	ctx := context.Background()
+	tracing := NewEncryptedTracing(NewInMemoryTracing(), testSealKey, testIndexKey, nil)
+	uid := "encryptUID00000000001"
+	modelC := strings.Repeat("c", 200)
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "long", Timestamp: 100, ModelC: modelC}}); err != nil {
+		t.Fatal(err)
+	}
+	traces, err := tracing.GetTraceData(ctx, uid)
+	if err != nil || len(traces) != 1 || traces[0].ModelC != modelC {
+		t.Fatalf("expect the trace with its long ModelC, got %v, %v", traces, err)
+	}
+}
+
+func TestEncryptedTracing_SealedWithKeyring(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryTracing()
+	uid := "encryptUID00000000001"
+	// traces sealed by earlier versions with the TempID keyring
+	earlier := &EncryptedTracing{tracing: inner, keys: CryptKeys, indexKey: testIndexKey}
+	if _, _, err := earlier.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "earlier", Timestamp: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if traces, err := NewEncryptedTracing(inner, testSealKey, testIndexKey, nil).GetTraceData(ctx, uid); err != nil || len(traces) != 0 {
+		t.Fatalf("expect the trace not opened without the keyring, got %v, %v", traces, err)
+	}
+	traces, err := NewEncryptedTracing(inner, testSealKey, testIndexKey, CryptKeys).GetTraceData(ctx, uid)
+	if err != nil || len(traces) != 1 || traces[0].CUID != "earlier" {
+		t.Fatalf("expect the trace opened with the keyring, got %v, %v", traces, err)
+	}
+}
+
+func TestEncryptedTracing_LegacyTraces(t *testing.T) {
+	ctx := context.Background()
+	inner := NewInMemoryTracing()
+	uid := "encryptUID00000000001"
+	if _, _, err := inner.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "legacy", Timestamp: 100}}); err != nil {
+		t.Fatal(err)
+	}
+	tracing := NewEncryptedTracing(inner, testSealKey, testIndexKey, nil)
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "sealed", Timestamp: 200}}); err != nil {
+		t.Fatal(err)
+	}
+	traces, err := tracing.GetTraceData(ctx, uid)
+	if err != nil || len(traces) != 2 {
+		t.Fatalf("expect the legacy and the sealed trace, got %v, %v", traces, err)
+	}
+
+	filter := &TraceFilter{UID: uid}
+	if traces, next, err := tracing.QueryTraceData(ctx, filter, "", 10); err != nil || len(traces) != 2 || len(next) != 0 {
+		t.Fatalf("expect the legacy and the sealed trace in one page, got %v, %q, %v", traces, next, err)
+	}
+	traces, next, err := tracing.QueryTraceData(ctx, filter, "", 1)
+	if err != nil || len(traces) != 1 || traces[0].CUID != "legacy" || len(next) == 0 {
+		t.Fatalf("expect the legacy trace first, got %v, %q, %v", traces, next, err)
+	}
+	traces, next, err = tracing.QueryTraceData(ctx, filter, next, 1)
+	if err != nil || len(traces) != 1 || traces[0].CUID != "sealed" || len(next) != 0 {
+		t.Fatalf("expect the sealed trace last, got %v, %q, %v", traces, next, err)
+	}
+	if _, _, err := tracing.QueryTraceData(ctx, filter, encodeCursor("other"), 1); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("expect an unknown position refused, got %v", err)
+	}
+}
@@ -2,6 +2,15 @@ package hypertrace
 
 import (
 	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -11,22 +20,168 @@ var (
 
 func NewInMemoryTracing() ITracing {
 	tracing := &InMemoryTracing{
-		Users:      make(map[string]*User),
-		Officers:   make(map[string]*Officer),
-		TraceDatas: make([]*TraceData, 0),
-	}
-	_ = tracing.RegisterNewOfficer(context.Background(), "officer1", "secret1")
-	_ = tracing.RegisterNewOfficer(context.Background(), "officer2", "secret2")
-	_ = tracing.RegisterNewOfficer(context.Background(), "officer3", "secret3")
-	_ = tracing.RegisterNewOfficer(context.Background(), "officer4", "secret4")
-	_ = tracing.RegisterNewOfficer(context.Background(), "officer5", "secret5")
+		Users:         make(map[string]*User),
+		Officers:      make(map[string]*Officer),
+		TraceDatas:    make([]*TraceData, 0),
+		UploadTokens:  make(map[string]*IssuedUploadToken),
+		RefreshTokens: make(map[string]int64),
+		traceKeys:     make(map[traceDataKey]uint64),
+	}
+	return tracing
+}
+
+// NewInMemoryTracingWithSnapshot creates an InMemoryTracing restored from the snapshot file at path, if it exists,
+// and writes a new snapshot to that path every interval until Close is called. An interval of zero only writes
+// the snapshot on Close.
+func NewInMemoryTracingWithSnapshot(path string, interval time.Duration) ITracing {
+	if interval < 0 {
+		inMemoryLog.Fatalf("invalid snapshot interval %s", interval)
+		return nil
+	}
+	tracing := NewInMemoryTracing().(*InMemoryTracing)
+	err := tracing.LoadSnapshot(path)
+	if err != nil && !os.IsNotExist(err) {
+		inMemoryLog.Fatalf("error restoring snapshot %s. got %s", path, err.Error())
+		return nil
+	}
+	if err == nil {
+		inMemoryLog.Infof("snapshot %s restored", path)
+	}
+	tracing.snapshotPath = path
+	if interval > 0 {
+		tracing.stopSnapshot = make(chan struct{})
+		tracing.snapshotDone = make(chan struct{})
+		go tracing.snapshotLoop(interval)
+	}
 	return tracing
 }
 
+// InMemoryTracing is an ITracing that keeps everything in memory. It is safe for concurrent use.
 type InMemoryTracing struct {
 	Users      map[string]*User
 	Officers   map[string]*Officer
 	TraceDatas []*TraceData
+	// UploadTokens holds the issued upload tokens by their ID
+	UploadTokens map[string]*IssuedUploadToken
+	// RefreshTokens holds the expiry of the used refresh tokens by their ID
+	RefreshTokens map[string]int64
+	// TempIDPolicy is the policy stored with SetTempIDPolicy, nil if there is none
+	TempIDPolicy *TempIDPolicy
+
+	// traceKeys holds the sequence number of every trace in TraceDatas, which is ordered by it
+	traceKeys    map[traceDataKey]uint64
+	traceSeq     uint64
+	mutex        sync.RWMutex
+	snapshotPath string
+	stopSnapshot chan struct{}
+	snapshotDone chan struct{}
+}
+
+func (trace *InMemoryTracing) snapshotLoop(interval time.Duration) {
+	defer close(trace.snapshotDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := trace.SaveSnapshot(trace.snapshotPath); err != nil {
+				inMemoryLog.Errorf("error writing snapshot %s. got %s", trace.snapshotPath, err.Error())
+			}
+		case <-trace.stopSnapshot:
+			return
+		}
+	}
+}
+
+// Close stops the periodic snapshot, if any, and writes a last snapshot.
+func (trace *InMemoryTracing) Close() error {
+	if len(trace.snapshotPath) == 0 {
+		return nil
+	}
+	if trace.stopSnapshot != nil {
+		close(trace.stopSnapshot)
+		<-trace.snapshotDone
+		trace.stopSnapshot = nil
+	}
+	path := trace.snapshotPath
+	trace.snapshotPath = ""
+	return trace.SaveSnapshot(path)
+}
+
+// SaveSnapshot writes all users, officers and trace data as JSON into path.
+// The file is written next to path first and then renamed, so a crash never leaves a half written snapshot.
+func (trace *InMemoryTracing) SaveSnapshot(path string) error {
+	trace.mutex.RLock()
+	snapshot, err := json.Marshal(trace)
+	trace.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(snapshot); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot replaces all users, officers and trace data with the ones in the snapshot file at path.
+func (trace *InMemoryTracing) LoadSnapshot(path string) error {
+	snapshot, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	restored := &InMemoryTracing{}
+	if err = json.Unmarshal(snapshot, restored); err != nil {
+		return err
+	}
+	for _, usr := range restored.Users {
+		if _, err := usr.HashLegacyPIN(); err != nil {
+			return err
+		}
+	}
+	for _, off := range restored.Officers {
+		if _, err := off.HashLegacySecret(); err != nil {
+			return err
+		}
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.Users = make(map[string]*User)
+	for k, v := range restored.Users {
+		trace.Users[k] = v
+	}
+	trace.Officers = make(map[string]*Officer)
+	for k, v := range restored.Officers {
+		trace.Officers[k] = v
+	}
+	trace.UploadTokens = make(map[string]*IssuedUploadToken)
+	for k, v := range restored.UploadTokens {
+		trace.UploadTokens[k] = v
+	}
+	trace.RefreshTokens = make(map[string]int64)
+	for k, v := range restored.RefreshTokens {
+		trace.RefreshTokens[k] = v
+	}
+	trace.TempIDPolicy = restored.TempIDPolicy
+	trace.TraceDatas = make([]*TraceData, 0, len(restored.TraceDatas))
+	trace.traceKeys = make(map[traceDataKey]uint64)
+	trace.traceSeq = 0
+	for _, td := range restored.TraceDatas {
+		if _, ok := trace.traceKeys[td.key()]; !ok {
+			trace.traceSeq++
+			trace.traceKeys[td.key()] = trace.traceSeq
+			trace.TraceDatas = append(trace.TraceDatas, td)
+		}
+	}
+	return nil
 }
 
 func (trace *InMemoryTracing) RegisterNewUser(ctx context.Context, UID, PIN string) (err error) {
@@ -34,70 +189,425 @@ func (trace *InMemoryTracing) RegisterNewUser(ctx context.Context, UID, PIN stri
 	if len(UID) == 0 || len(PIN) == 0 {
 		return ErrInvalidParameter
 	}
-	trace.Users[UID] = &User{
-		UID: UID,
-		PIN: PIN,
+	usr, err := NewUser(UID, PIN)
+	if err != nil {
+		return err
 	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.Users[UID] = usr
 	return nil
 }
-func (trace *InMemoryTracing) GetHandshakePIN(ctx context.Context, UID string) (PIN string, err error) {
-	inMemoryLog.Tracef("GetHandshakePIN UID:%s", UID)
-	if tu, ok := trace.Users[UID]; ok {
-		return tu.PIN, nil
+func (trace *InMemoryTracing) VerifyHandshakePIN(ctx context.Context, UID, PIN string) (err error) {
+	inMemoryLog.Tracef("VerifyHandshakePIN UID:%s", UID)
+	if len(UID) == 0 || len(PIN) == 0 {
+		return ErrInvalidParameter
 	}
-	return "", ErrUIDNotFound
+	trace.mutex.RLock()
+	tu, ok := trace.Users[UID]
+	trace.mutex.RUnlock()
+	if !ok {
+		return ErrUIDNotFound
+	}
+	if !verifySecret(tu.PINHash, PIN) {
+		return ErrPINNotValid
+	}
+	return nil
 }
 
-func (trace *InMemoryTracing) SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (err error) {
+func (trace *InMemoryTracing) GetUser(ctx context.Context, UID string) (user *User, err error) {
+	inMemoryLog.Tracef("GetUser UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	trace.mutex.RLock()
+	defer trace.mutex.RUnlock()
+	tu, ok := trace.Users[UID]
+	if !ok {
+		return nil, ErrUIDNotFound
+	}
+	userCopy := *tu
+	return &userCopy, nil
+}
+func (trace *InMemoryTracing) DeleteUser(ctx context.Context, UID string) (deletion *UserDeletion, err error) {
+	inMemoryLog.Tracef("DeleteUser UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	deletion = &UserDeletion{}
+	if _, ok := trace.Users[UID]; ok {
+		delete(trace.Users, UID)
+		deletion.User = true
+	}
+	newTraceData := make([]*TraceData, 0, len(trace.TraceDatas))
+	for _, td := range trace.TraceDatas {
+		switch UID {
+		case td.UID:
+			deletion.Traces++
+		case td.CUID:
+			deletion.ContactTraces++
+		default:
+			newTraceData = append(newTraceData, td)
+			continue
+		}
+		delete(trace.traceKeys, td.key())
+	}
+	trace.TraceDatas = newTraceData
+	for jti, iut := range trace.UploadTokens {
+		if iut.UID == UID {
+			delete(trace.UploadTokens, jti)
+			deletion.UploadTokens++
+		}
+	}
+	return deletion, nil
+}
+
+func (trace *InMemoryTracing) SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (saved []*TraceData, duplicates int, err error) {
 	inMemoryLog.Tracef("SaveTraceData UID:%s OID:%s", UID, OID)
+	if len(UID) == 0 {
+		return nil, 0, ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	saved = make([]*TraceData, 0, len(data))
 	for _, tdata := range data {
 		tdata.UID = UID
 		tdata.OID = OID
+		if _, ok := trace.traceKeys[tdata.key()]; ok {
+			duplicates++
+			continue
+		}
+		trace.traceSeq++
+		trace.traceKeys[tdata.key()] = trace.traceSeq
+		trace.TraceDatas = append(trace.TraceDatas, tdata)
+		saved = append(saved, tdata)
 	}
-	trace.TraceDatas = append(trace.TraceDatas, data...)
-	return nil
+	return saved, duplicates, nil
 }
-func (trace *InMemoryTracing) PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (err error) {
+func (trace *InMemoryTracing) PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (purged int, err error) {
 	inMemoryLog.Tracef("PurgeOldTraceData")
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
 	newTraceData := make([]*TraceData, 0)
 	for _, td := range trace.TraceDatas {
 		if td.Timestamp >= oldestTimeStamp {
 			newTraceData = append(newTraceData, td)
+		} else {
+			delete(trace.traceKeys, td.key())
+			purged++
 		}
 	}
 	trace.TraceDatas = newTraceData
-	return nil
+	return purged, nil
 }
 func (trace *InMemoryTracing) GetTraceData(ctx context.Context, UID string) (traces []*TraceData, err error) {
 	inMemoryLog.Tracef("GetTraceData UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	trace.mutex.RLock()
+	defer trace.mutex.RUnlock()
 	newTraceData := make([]*TraceData, 0)
 	for _, td := range trace.TraceDatas {
 		if td.UID == UID {
-			newTraceData = append(newTraceData, td)
+			tdCopy := *td
+			newTraceData = append(newTraceData, &tdCopy)
 		}
 	}
 	return newTraceData, nil
 }
+func (trace *InMemoryTracing) QueryTraceData(ctx context.Context, filter *TraceFilter, cursor string, pageSize int) (traces []*TraceData, next string, err error) {
+	if err := filter.Validate(); err != nil || pageSize <= 0 {
+		return nil, "", ErrInvalidParameter
+	}
+	inMemoryLog.Tracef("QueryTraceData UID:%s cursor:%s", filter.UID, cursor)
+	var after uint64
+	if len(cursor) > 0 {
+		position, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		after, err = strconv.ParseUint(position, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	trace.mutex.RLock()
+	defer trace.mutex.RUnlock()
+	// the cursor is the sequence number of the last trace returned, so traces purged or deleted
+	// between pages do not shift the next ones
+	start := sort.Search(len(trace.TraceDatas), func(i int) bool {
+		return trace.traceKeys[trace.TraceDatas[i].key()] > after
+	})
+	traces = make([]*TraceData, 0)
+	var last uint64
+	for _, td := range trace.TraceDatas[start:] {
+		if !filter.Match(td) {
+			continue
+		}
+		if len(traces) == pageSize {
+			return traces, encodeCursor(strconv.FormatUint(last, 10)), nil
+		}
+		last = trace.traceKeys[td.key()]
+		tdCopy := *td
+		traces = append(traces, &tdCopy)
+	}
+	return traces, "", nil
+}
 
 func (trace *InMemoryTracing) RegisterNewOfficer(ctx context.Context, OID, secret string) (err error) {
 	inMemoryLog.Tracef("RegisterNewOfficer OID:%s", OID)
-	trace.Officers[OID] = &Officer{
-		OID:    OID,
-		Secret: secret,
+	if len(OID) == 0 || len(secret) == 0 {
+		return ErrInvalidParameter
+	}
+	off, err := NewOfficer(OID, secret)
+	if err != nil {
+		return err
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	if registered, ok := trace.Officers[OID]; ok {
+		off.Roles = registered.Roles
+		off.Disabled = registered.Disabled
+		off.CreatedAt = registered.CreatedAt
+		off.LastUsedAt = registered.LastUsedAt
+	}
+	trace.Officers[OID] = off
+	return nil
+}
+func (trace *InMemoryTracing) RotateOfficerSecret(ctx context.Context, OID, secret string) (err error) {
+	inMemoryLog.Tracef("RotateOfficerSecret OID:%s", OID)
+	if len(OID) == 0 || len(secret) == 0 {
+		return ErrInvalidParameter
+	}
+	rotated, err := NewOfficer(OID, secret)
+	if err != nil {
+		return err
 	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		off.Secret = ""
+		off.SecretPrefix = rotated.SecretPrefix
+		off.SecretHash = rotated.SecretHash
+	})
+}
+
+// updateOfficer replaces the officer OID by a copy changed by update, stored officers are never modified
+// since GetOfficer callers may still hold them.
+func (trace *InMemoryTracing) updateOfficer(OID string, update func(off *Officer)) error {
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	off, ok := trace.Officers[OID]
+	if !ok {
+		return ErrOfficerNotFound
+	}
+	offCopy := *off
+	update(&offCopy)
+	trace.Officers[OID] = &offCopy
 	return nil
 }
+func (trace *InMemoryTracing) SetOfficerRoles(ctx context.Context, OID string, roles []string) (err error) {
+	inMemoryLog.Tracef("SetOfficerRoles OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		off.Roles = append([]string(nil), roles...)
+	})
+}
+func (trace *InMemoryTracing) UpdateOfficer(ctx context.Context, OID string, update *OfficerUpdate) (err error) {
+	inMemoryLog.Tracef("UpdateOfficer OID:%s", OID)
+	if len(OID) == 0 || update.IsEmpty() {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		if update.Roles != nil {
+			off.Roles = append([]string(nil), update.Roles...)
+		}
+		if update.Disabled != nil {
+			off.Disabled = *update.Disabled
+		}
+	})
+}
+func (trace *InMemoryTracing) TouchOfficer(ctx context.Context, OID string, lastUsedAt int64) (err error) {
+	inMemoryLog.Tracef("TouchOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(OID, func(off *Officer) {
+		off.LastUsedAt = lastUsedAt
+	})
+}
 func (trace *InMemoryTracing) GetOfficerID(ctx context.Context, secret string) (OID string, err error) {
-	inMemoryLog.Tracef("GetOfficerID secret:%s", secret)
-	for oid, off := range trace.Officers {
-		if off.Secret == secret {
-			return oid, nil
+	inMemoryLog.Tracef("GetOfficerID secret:****")
+	if len(secret) == 0 {
+		return "", ErrInvalidParameter
+	}
+	prefix := secretPrefix(secret)
+	candidates := make([]*Officer, 0)
+	trace.mutex.RLock()
+	for _, off := range trace.Officers {
+		if off.SecretPrefix == prefix {
+			candidates = append(candidates, off)
 		}
 	}
-	return "", ErrSecretNotValid
+	trace.mutex.RUnlock()
+	return verifyOfficerCandidates(candidates, secret)
+}
+func (trace *InMemoryTracing) GetOfficer(ctx context.Context, OID string) (officer *Officer, err error) {
+	inMemoryLog.Tracef("GetOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	trace.mutex.RLock()
+	defer trace.mutex.RUnlock()
+	off, ok := trace.Officers[OID]
+	if !ok {
+		return nil, ErrOfficerNotFound
+	}
+	offCopy := *off
+	return &offCopy, nil
+}
+func (trace *InMemoryTracing) ListOfficers(ctx context.Context) (officers []*Officer, err error) {
+	inMemoryLog.Tracef("ListOfficers")
+	trace.mutex.RLock()
+	defer trace.mutex.RUnlock()
+	officers = make([]*Officer, 0, len(trace.Officers))
+	for _, off := range trace.Officers {
+		offCopy := *off
+		officers = append(officers, &offCopy)
+	}
+	sort.Slice(officers, func(i, j int) bool {
+		return officers[i].OID < officers[j].OID
+	})
+	return officers, nil
 }
 func (trace *InMemoryTracing) DeleteOfficer(ctx context.Context, OID string) (err error) {
 	inMemoryLog.Tracef("DeleteOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
 	delete(trace.Officers, OID)
 	return nil
 }
+
+func (trace *InMemoryTracing) RegisterUploadToken(ctx context.Context, ut *UploadToken) (err error) {
+	inMemoryLog.Tracef("RegisterUploadToken JTI:%s", ut.ID)
+	if len(ut.ID) == 0 {
+		return ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	trace.UploadTokens[ut.ID] = &IssuedUploadToken{
+		UploadToken: *ut,
+		Status:      UploadTokenIssued,
+	}
+	return nil
+}
+func (trace *InMemoryTracing) ConsumeUploadToken(ctx context.Context, JTI string) (err error) {
+	inMemoryLog.Tracef("ConsumeUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	iut, ok := trace.UploadTokens[JTI]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	switch iut.Status {
+	case UploadTokenConsumed:
+		return ErrTokenConsumed
+	case UploadTokenRevoked:
+		return ErrTokenRevoked
+	}
+	iut.Status = UploadTokenConsumed
+	return nil
+}
+func (trace *InMemoryTracing) ReleaseUploadToken(ctx context.Context, JTI string) (err error) {
+	inMemoryLog.Tracef("ReleaseUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	iut, ok := trace.UploadTokens[JTI]
+	if !ok {
+		return ErrTokenNotFound
+	}
+	if iut.Status == UploadTokenConsumed {
+		iut.Status = UploadTokenIssued
+	}
+	return nil
+}
+func (trace *InMemoryTracing) RevokeUploadTokens(ctx context.Context, OID, JTI string) (revoked int, err error) {
+	inMemoryLog.Tracef("RevokeUploadTokens OID:%s JTI:%s", OID, JTI)
+	if len(OID) == 0 {
+		return 0, ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	for jti, iut := range trace.UploadTokens {
+		if iut.OID != OID || iut.Status != UploadTokenIssued || (len(JTI) > 0 && jti != JTI) {
+			continue
+		}
+		iut.Status = UploadTokenRevoked
+		revoked++
+	}
+	return revoked, nil
+}
+func (trace *InMemoryTracing) PurgeUploadTokens(ctx context.Context, oldestTimeStamp int64) (err error) {
+	inMemoryLog.Tracef("PurgeUploadTokens")
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	for jti, iut := range trace.UploadTokens {
+		if iut.ValidUntil < oldestTimeStamp {
+			delete(trace.UploadTokens, jti)
+		}
+	}
+	for jti, validUntil := range trace.RefreshTokens {
+		if validUntil < oldestTimeStamp {
+			delete(trace.RefreshTokens, jti)
+		}
+	}
+	return nil
+}
+func (trace *InMemoryTracing) ConsumeRefreshToken(ctx context.Context, JTI string, validUntil int64) (err error) {
+	inMemoryLog.Tracef("ConsumeRefreshToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	if _, ok := trace.RefreshTokens[JTI]; ok {
+		return ErrTokenConsumed
+	}
+	trace.RefreshTokens[JTI] = validUntil
+	return nil
+}
+
+func (trace *InMemoryTracing) GetTempIDPolicy(ctx context.Context) (policy *TempIDPolicy, err error) {
+	inMemoryLog.Tracef("GetTempIDPolicy")
+	trace.mutex.RLock()
+	defer trace.mutex.RUnlock()
+	if trace.TempIDPolicy == nil {
+		return nil, ErrTempIDPolicyNotFound
+	}
+	stored := *trace.TempIDPolicy
+	return &stored, nil
+}
+func (trace *InMemoryTracing) SetTempIDPolicy(ctx context.Context, policy *TempIDPolicy) (err error) {
+	inMemoryLog.Tracef("SetTempIDPolicy")
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	if policy == nil {
+		trace.TempIDPolicy = nil
+		return nil
+	}
+	stored := *policy
+	trace.TempIDPolicy = &stored
+	return nil
+}
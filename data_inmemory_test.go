@@ -0,0 +1,89 @@
+package hypertrace
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMemoryTracing_Concurrent(t *testing.T) {
+	tracing := NewInMemoryTracing()
+	ctx := context.Background()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uid := fmt.Sprintf("concurrentUID%08d", i)
+			_ = tracing.RegisterNewUser(ctx, uid, "1234")
+			_, _, _ = tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "other", Timestamp: int64(i)}})
+			_, _ = tracing.GetTraceData(ctx, uid)
+			_, _ = tracing.GetOfficerID(ctx, "secret1")
+			_, _ = tracing.PurgeOldTraceData(ctx, 5)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestInMemoryTracing_Snapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	ctx := context.Background()
+
+	tracing := NewInMemoryTracingWithSnapshot(path, 0) // written on Close only
+	if err := tracing.RegisterNewUser(ctx, "snapshotUID0000000001", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, "snapshotUID0000000001", "officer1", []*TraceData{{CUID: "other", Timestamp: 100}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracing.(*InMemoryTracing).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewInMemoryTracingWithSnapshot(path, time.Hour)
+	defer restored.(*InMemoryTracing).Close()
+	if err := restored.VerifyHandshakePIN(ctx, "snapshotUID0000000001", "1234"); err != nil {
+		t.Fatalf("expect restored pin 1234 to verify, got %v", err)
+	}
+	if traces, err := restored.GetTraceData(ctx, "snapshotUID0000000001"); err != nil || len(traces) != 1 {
+		t.Fatalf("expect 1 restored trace, got %v, %v", traces, err)
+	}
+}
+
+func TestInMemoryTracing_LegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	ctx := context.Background()
+	legacy := `{"Users":{"legacyUID000000000001":{"uid":"legacyUID000000000001","pin":"1234"}},` +
+		`"Officers":{"legacy-officer":{"oid":"legacy-officer","secret":"legacy-secret"},` +
+		`"legacy-disabled":{"oid":"legacy-disabled","secret":"disabled-secret","roles":["auditor"],"disabled":true,"createdAt":1000,"lastUsedAt":2000}}}`
+	if err := ioutil.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewInMemoryTracingWithSnapshot(path, time.Hour)
+	defer restored.(*InMemoryTracing).Close()
+	if err := restored.VerifyHandshakePIN(ctx, "legacyUID000000000001", "1234"); err != nil {
+		t.Fatalf("expect legacy pin to verify, got %v", err)
+	}
+	if oid, err := restored.GetOfficerID(ctx, "legacy-secret"); err != nil || oid != "legacy-officer" {
+		t.Fatalf("expect legacy-officer, got %q, %v", oid, err)
+	}
+	if off, err := restored.GetOfficer(ctx, "legacy-disabled"); err != nil || !off.Disabled || len(off.Roles) != 1 || off.CreatedAt != 1000 || off.LastUsedAt != 2000 {
+		t.Fatalf("expect the roles, disabled and times of a legacy officer kept, got %+v, %v", off, err)
+	}
+	if err := restored.(*InMemoryTracing).SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(snapshot), "legacy-secret") || strings.Contains(string(snapshot), `"pin"`) {
+		t.Fatalf("expect no plaintext secret in the snapshot, got %s", snapshot)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -13,6 +14,11 @@ const (
 	userCollection    = "user"
 	traceCollection   = "trace"
 	officerCollection = "officer"
+	tokenCollection   = "uploadtoken"
+	refreshCollection = "refreshtoken"
+	settingCollection = "setting"
+
+	tempIDPolicySetting = "tempidpolicy"
 )
 
 var (
@@ -49,27 +55,140 @@ func NewMongoDBTracing(database, host string, port int, user, password string) I
 		mongoLog.Fatal(err)
 		return nil
 	}
+	err = tracing.ensureIndexes(context.TODO())
+	if err != nil {
+		mongoLog.Fatal(err)
+		return nil
+	}
+	err = tracing.hashLegacySecrets(context.TODO())
+	if err != nil {
+		mongoLog.Fatal(err)
+		return nil
+	}
 
 	return tracing
 }
+
+// ensureIndexes creates the trace collection indexes. The unique index on uid, cuid, timestamp and modelP
+// backs the trace deduplication, it can not be created while the collection still holds duplicates
+// and the server does not start without it.
+func (trace *MongoDBTracing) ensureIndexes(ctx context.Context) error {
+	traceCollection := trace.client.Database(trace.database).Collection(traceCollection)
+	_, err := traceCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"uid": 1}},
+		{Keys: bson.M{"cuid": 1}},
+		{Keys: bson.M{"timestamp": 1}},
+	})
+	if err != nil {
+		mongoLog.Warnf("ensureIndexes . traceCollection.Indexes got %s", err.Error())
+	}
+	_, err = traceCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "uid", Value: 1},
+			{Key: "cuid", Value: 1},
+			{Key: "timestamp", Value: 1},
+			{Key: "modelP", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("%w : unique trace index, remove the duplicate trace data first", err)
+	}
+	offCollection := trace.client.Database(trace.database).Collection(officerCollection)
+	_, err = offCollection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.M{"secretPrefix": 1}})
+	if err != nil {
+		mongoLog.Warnf("ensureIndexes . offCollection.Indexes got %s", err.Error())
+	}
+	tokenCollection := trace.client.Database(trace.database).Collection(tokenCollection)
+	_, err = tokenCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"jti": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"oid": 1}},
+		{Keys: bson.M{"uid": 1}},
+	})
+	if err != nil {
+		mongoLog.Warnf("ensureIndexes . tokenCollection.Indexes got %s", err.Error())
+	}
+	refreshCollection := trace.client.Database(trace.database).Collection(refreshCollection)
+	_, err = refreshCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"jti": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("%w : unique refresh token index", err)
+	}
+	return nil
+}
 func (trace *MongoDBTracing) getMongoURL() string {
 	return fmt.Sprintf("mongodb://%s:%s@%s:%d", trace.user, trace.password, trace.server, trace.port)
 }
 
-func (trace *MongoDBTracing) getUser(ctx context.Context, UID string) (user *User, err error) {
+// hashLegacySecrets migrates the user and officer documents stored before PINs and secrets were hashed,
+// replacing their plaintext pin and secret with the hashed fields.
+func (trace *MongoDBTracing) hashLegacySecrets(ctx context.Context) error {
+	legacy := func(field string) bson.M {
+		return bson.M{field: bson.M{"$exists": true, "$ne": ""}}
+	}
+
+	userCollection := trace.client.Database(trace.database).Collection(userCollection)
+	cur, err := userCollection.Find(ctx, legacy("pin"))
+	if err != nil {
+		return fmt.Errorf("%w : hashLegacySecrets . userCollection.Find", err)
+	}
+	users := make([]*User, 0)
+	if err := cur.All(ctx, &users); err != nil {
+		return fmt.Errorf("%w : hashLegacySecrets . users cursor", err)
+	}
+	for _, usr := range users {
+		if _, err := usr.HashLegacyPIN(); err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"pinHash": usr.PINHash}, "$unset": bson.M{"pin": ""}}
+		if _, err := userCollection.UpdateOne(ctx, bson.M{"uid": usr.UID}, update); err != nil {
+			return fmt.Errorf("%w : hashLegacySecrets . userCollection.UpdateOne UID:%s", err, usr.UID)
+		}
+	}
+	if len(users) > 0 {
+		mongoLog.Infof("hashed the PIN of %d users", len(users))
+	}
+
+	offCollection := trace.client.Database(trace.database).Collection(officerCollection)
+	cur, err = offCollection.Find(ctx, legacy("secret"))
+	if err != nil {
+		return fmt.Errorf("%w : hashLegacySecrets . offCollection.Find", err)
+	}
+	officers := make([]*Officer, 0)
+	if err := cur.All(ctx, &officers); err != nil {
+		return fmt.Errorf("%w : hashLegacySecrets . officers cursor", err)
+	}
+	for _, off := range officers {
+		if _, err := off.HashLegacySecret(); err != nil {
+			return err
+		}
+		update := bson.M{"$set": bson.M{"secretPrefix": off.SecretPrefix, "secretHash": off.SecretHash}, "$unset": bson.M{"secret": ""}}
+		if _, err := offCollection.UpdateOne(ctx, bson.M{"oid": off.OID}, update); err != nil {
+			return fmt.Errorf("%w : hashLegacySecrets . offCollection.UpdateOne OID:%s", err, off.OID)
+		}
+	}
+	if len(officers) > 0 {
+		mongoLog.Infof("hashed the secret of %d officers", len(officers))
+	}
+	return nil
+}
+
+func (trace *MongoDBTracing) GetUser(ctx context.Context, UID string) (user *User, err error) {
 	if len(UID) == 0 {
 		return nil, ErrInvalidParameter
 	}
-	mongoLog.Tracef("getUser UID:%s", UID)
+	mongoLog.Tracef("GetUser UID:%s", UID)
 	userCollection := trace.client.Database(trace.database).Collection(userCollection)
 	filter := bson.M{"uid": UID}
 	usr := &User{}
 	err = userCollection.FindOne(ctx, filter).Decode(usr)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, nil
+			return nil, ErrUIDNotFound
 		}
-		mongoLog.Errorf("getUser . userCollection.FindOne UID:%s got %s", UID, err.Error())
+		mongoLog.Errorf("GetUser . userCollection.FindOne UID:%s got %s", UID, err.Error())
 		return nil, err
 	}
 	return usr, nil
@@ -80,46 +199,82 @@ func (trace *MongoDBTracing) RegisterNewUser(ctx context.Context, UID, PIN strin
 	if len(UID) == 0 || len(PIN) == 0 {
 		return ErrInvalidParameter
 	}
-	usr, err := trace.getUser(ctx, UID)
+	usr, err := NewUser(UID, PIN)
 	if err != nil {
 		return err
 	}
-	if usr == nil {
-		userCollection := trace.client.Database(trace.database).Collection(userCollection)
-		res, err := userCollection.InsertOne(ctx, bson.D{{"uid", UID}, {"pin", PIN}})
-		if err != nil {
-			mongoLog.Errorf("RegisterNewUser . userCollection.InsertOne UID:%s got %s", UID, err.Error())
-			return err
-		}
-		mongoLog.Tracef("RegisterNewUser inserted UID:%s with id:%s", UID, res.InsertedID)
-		return nil
+	userCollection := trace.client.Database(trace.database).Collection(userCollection)
+	filter := bson.M{"uid": UID}
+	update := bson.M{"$set": bson.M{"uid": UID, "pinHash": usr.PINHash}, "$unset": bson.M{"pin": ""}}
+	res, err := userCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		mongoLog.Errorf("RegisterNewUser . userCollection.UpdateOne UID:%s got %s", UID, err.Error())
+		return err
 	}
+	mongoLog.Tracef("RegisterNewUser UID:%s upserted %d, modified %d", UID, res.UpsertedCount, res.ModifiedCount)
 	return nil
 }
-func (trace *MongoDBTracing) GetHandshakePIN(ctx context.Context, UID string) (PIN string, err error) {
-	mongoLog.Tracef("GetHandshakePIN UID:%s", UID)
-	if len(UID) == 0 {
-		return "", ErrInvalidParameter
+func (trace *MongoDBTracing) VerifyHandshakePIN(ctx context.Context, UID, PIN string) (err error) {
+	mongoLog.Tracef("VerifyHandshakePIN UID:%s", UID)
+	if len(UID) == 0 || len(PIN) == 0 {
+		return ErrInvalidParameter
 	}
-	usr, err := trace.getUser(ctx, UID)
+	usr, err := trace.GetUser(ctx, UID)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if usr == nil {
-		return "", ErrUIDNotFound
+	if !verifySecret(usr.PINHash, PIN) {
+		return ErrPINNotValid
 	}
-	return usr.PIN, nil
+	return nil
 }
 
-func (trace *MongoDBTracing) SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (err error) {
-	if len(UID) == 0 || len(OID) == 0 {
-		return ErrInvalidParameter
+// DeleteUser deletes from one collection after the other, without a transaction which needs a replica set.
+// If it fails half way, calling it again erases what is left.
+func (trace *MongoDBTracing) DeleteUser(ctx context.Context, UID string) (deletion *UserDeletion, err error) {
+	mongoLog.Tracef("DeleteUser UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	db := trace.client.Database(trace.database)
+	deleted := func(collection string, filter bson.M) (int, error) {
+		res, err := db.Collection(collection).DeleteMany(ctx, filter)
+		if err != nil {
+			mongoLog.Errorf("DeleteUser . %s.DeleteMany got %s", collection, err)
+			return 0, err
+		}
+		return int(res.DeletedCount), nil
+	}
+	deletion = &UserDeletion{}
+	if deletion.Traces, err = deleted(traceCollection, bson.M{"uid": UID}); err != nil {
+		return nil, err
+	}
+	if deletion.ContactTraces, err = deleted(traceCollection, bson.M{"cuid": UID}); err != nil {
+		return nil, err
+	}
+	if deletion.UploadTokens, err = deleted(tokenCollection, bson.M{"uid": UID}); err != nil {
+		return nil, err
 	}
+	users, err := deleted(userCollection, bson.M{"uid": UID})
+	if err != nil {
+		return nil, err
+	}
+	deletion.User = users > 0
+	return deletion, nil
+}
+
+func (trace *MongoDBTracing) SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (saved []*TraceData, duplicates int, err error) {
+	if len(UID) == 0 {
+		return nil, 0, ErrInvalidParameter
+	}
+	saved = make([]*TraceData, 0, len(data))
 	if data != nil && len(data) > 0 {
 		mongoLog.Tracef("SaveTraceData UID:%s OID:%s, %d items", UID, OID, len(data))
 		traceCollection := trace.client.Database(trace.database).Collection(traceCollection)
 		documents := make([]interface{}, len(data))
 		for i, d := range data {
+			d.UID = UID
+			d.OID = OID
 			bd := bson.D{
 				{"oid", d.OID},
 				{"uid", d.UID},
@@ -130,19 +285,38 @@ func (trace *MongoDBTracing) SaveTraceData(ctx context.Context, UID, OID string,
 				{"rssi", d.RSSI},
 				{"txPower", d.TxPower},
 				{"org", d.Org},
+				{"suspect", d.Suspect},
+				{"sealed", d.Sealed},
 			}
 			documents[i] = bd
 		}
-		res, err := traceCollection.InsertMany(ctx, documents)
+		duplicate := make(map[int]bool)
+		_, err := traceCollection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
 		if err != nil {
-			mongoLog.Errorf("SaveTraceData . traceCollection.InsertMany got %s", err)
-			return err
+			bulkErr, ok := err.(mongo.BulkWriteException)
+			if !ok || bulkErr.WriteConcernError != nil {
+				mongoLog.Errorf("SaveTraceData . traceCollection.InsertMany got %s", err)
+				return nil, 0, err
+			}
+			for _, writeErr := range bulkErr.WriteErrors {
+				if writeErr.Code != 11000 {
+					mongoLog.Errorf("SaveTraceData . traceCollection.InsertMany got %s", err)
+					return nil, 0, err
+				}
+				duplicate[writeErr.Index] = true
+			}
+			duplicates = len(bulkErr.WriteErrors)
 		}
-		mongoLog.Tracef("SaveTraceData UID:%s OID:%s, inserted %d of %d items", UID, OID, len(res.InsertedIDs), len(data))
+		for i, d := range data {
+			if !duplicate[i] {
+				saved = append(saved, d)
+			}
+		}
+		mongoLog.Tracef("SaveTraceData UID:%s OID:%s, inserted %d of %d items", UID, OID, len(saved), len(data))
 	}
-	return nil
+	return saved, duplicates, nil
 }
-func (trace *MongoDBTracing) PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (err error) {
+func (trace *MongoDBTracing) PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (purged int, err error) {
 	mongoLog.Tracef("PurgeOldTraceData")
 	traceCollection := trace.client.Database(trace.database).Collection(traceCollection)
 	filter := bson.M{
@@ -152,10 +326,10 @@ func (trace *MongoDBTracing) PurgeOldTraceData(ctx context.Context, oldestTimeSt
 	res, err := traceCollection.DeleteMany(ctx, filter)
 	if err != nil {
 		mongoLog.Errorf("PurgeOldTraceData .  traceCollection.DeleteMany got %s", err)
-		return err
+		return 0, err
 	}
 	mongoLog.Tracef("PurgeOldTraceData deleted %d entries", res.DeletedCount)
-	return nil
+	return int(res.DeletedCount), nil
 }
 func (trace *MongoDBTracing) GetTraceData(ctx context.Context, UID string) (traces []*TraceData, err error) {
 	mongoLog.Tracef("GetTraceData UID:%s", UID)
@@ -182,42 +356,193 @@ func (trace *MongoDBTracing) GetTraceData(ctx context.Context, UID string) (trac
 	return traces, nil
 }
 
-func (trace *MongoDBTracing) getOfficer(ctx context.Context, OID string) (officer *Officer, err error) {
+// mongoTraceDocument is a trace document together with its object id, used as the paging position.
+type mongoTraceDocument struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	*TraceData `bson:",inline"`
+}
+
+// traceFilterDocument translates a TraceFilter into a mongo query document.
+func traceFilterDocument(filter *TraceFilter) bson.M {
+	doc := bson.M{"uid": filter.UID}
+	timestamp := bson.M{}
+	if filter.From > 0 {
+		timestamp["$gte"] = filter.From
+	}
+	if filter.To > 0 {
+		timestamp["$lte"] = filter.To
+	}
+	if len(timestamp) > 0 {
+		doc["timestamp"] = timestamp
+	}
+	if filter.MinRSSI != nil {
+		doc["rssi"] = bson.M{"$gte": *filter.MinRSSI}
+	}
+	if len(filter.CUID) > 0 {
+		doc["cuid"] = filter.CUID
+	}
+	if len(filter.OID) > 0 {
+		doc["oid"] = filter.OID
+	}
+	if len(filter.Org) > 0 {
+		doc["org"] = filter.Org
+	}
+	return doc
+}
+
+func (trace *MongoDBTracing) QueryTraceData(ctx context.Context, traceFilter *TraceFilter, cursor string, pageSize int) (traces []*TraceData, next string, err error) {
+	if err := traceFilter.Validate(); err != nil || pageSize <= 0 {
+		return nil, "", ErrInvalidParameter
+	}
+	mongoLog.Tracef("QueryTraceData UID:%s cursor:%s", traceFilter.UID, cursor)
+	filter := traceFilterDocument(traceFilter)
+	if len(cursor) > 0 {
+		position, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		lastID, err := primitive.ObjectIDFromHex(position)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		filter["_id"] = bson.M{"$gt": lastID}
+	}
+	traceCollection := trace.client.Database(trace.database).Collection(traceCollection)
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(pageSize + 1))
+	cur, err := traceCollection.Find(ctx, filter, opts)
+	if err != nil {
+		mongoLog.Errorf("QueryTraceData . traceCollection.Find got %s", err)
+		return nil, "", err
+	}
+	defer cur.Close(ctx)
+	traces = make([]*TraceData, 0)
+	var lastID primitive.ObjectID
+	for cur.Next(ctx) {
+		if len(traces) == pageSize {
+			next = encodeCursor(lastID.Hex())
+			break
+		}
+		doc := &mongoTraceDocument{TraceData: &TraceData{}}
+		if err := cur.Decode(doc); err != nil {
+			mongoLog.Errorf("QueryTraceData . cursor.Decode got %s", err.Error())
+			return nil, "", err
+		}
+		traces = append(traces, doc.TraceData)
+		lastID = doc.ID
+	}
+	return traces, next, cur.Err()
+}
+
+func (trace *MongoDBTracing) GetOfficer(ctx context.Context, OID string) (officer *Officer, err error) {
 	if len(OID) == 0 {
 		return nil, ErrInvalidParameter
 	}
-	mongoLog.Tracef("getOfficer OID:%s", OID)
+	mongoLog.Tracef("GetOfficer OID:%s", OID)
 	offCollection := trace.client.Database(trace.database).Collection(officerCollection)
 	filter := bson.M{"oid": OID}
 	off := &Officer{}
 	err = offCollection.FindOne(ctx, filter).Decode(off)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, nil
+			return nil, ErrOfficerNotFound
 		}
-		mongoLog.Errorf("getOfficer . offCollection.FindOne OID:%s got %s", OID, err.Error())
+		mongoLog.Errorf("GetOfficer . offCollection.FindOne OID:%s got %s", OID, err.Error())
 		return nil, err
 	}
 	return off, nil
 }
+func (trace *MongoDBTracing) ListOfficers(ctx context.Context) (officers []*Officer, err error) {
+	mongoLog.Tracef("ListOfficers")
+	offCollection := trace.client.Database(trace.database).Collection(officerCollection)
+	cur, err := offCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"oid": 1}))
+	if err != nil {
+		mongoLog.Errorf("ListOfficers . offCollection.Find got %s", err.Error())
+		return nil, err
+	}
+	officers = make([]*Officer, 0)
+	if err := cur.All(ctx, &officers); err != nil {
+		mongoLog.Errorf("ListOfficers . cursor.All got %s", err.Error())
+		return nil, err
+	}
+	return officers, nil
+}
 func (trace *MongoDBTracing) RegisterNewOfficer(ctx context.Context, OID, secret string) (err error) {
 	mongoLog.Tracef("RegisterNewOfficer OID:%s", OID)
 	if len(OID) == 0 || len(secret) == 0 {
 		return ErrInvalidParameter
 	}
-	off, err := trace.getOfficer(ctx, OID)
+	off, err := NewOfficer(OID, secret)
 	if err != nil {
 		return err
 	}
-	if off == nil {
-		offCollection := trace.client.Database(trace.database).Collection(officerCollection)
-		res, err := offCollection.InsertOne(ctx, bson.D{{"oid", OID}, {"secret", secret}})
-		if err != nil {
-			mongoLog.Errorf("RegisterNewOfficer . offCollection.InsertOne OID:%s got %s", OID, err.Error())
-			return err
-		}
-		mongoLog.Tracef("RegisterNewOfficer inserted OID:%s with id:%s", OID, res.InsertedID)
-		return nil
+	offCollection := trace.client.Database(trace.database).Collection(officerCollection)
+	filter := bson.M{"oid": OID}
+	update := bson.M{
+		"$set":         bson.M{"oid": OID, "secretPrefix": off.SecretPrefix, "secretHash": off.SecretHash},
+		"$unset":       bson.M{"secret": ""},
+		"$setOnInsert": bson.M{"createdAt": off.CreatedAt},
+	}
+	res, err := offCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		mongoLog.Errorf("RegisterNewOfficer . offCollection.UpdateOne OID:%s got %s", OID, err.Error())
+		return err
+	}
+	mongoLog.Tracef("RegisterNewOfficer OID:%s upserted %d, modified %d", OID, res.UpsertedCount, res.ModifiedCount)
+	return nil
+}
+func (trace *MongoDBTracing) SetOfficerRoles(ctx context.Context, OID string, roles []string) (err error) {
+	mongoLog.Tracef("SetOfficerRoles OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(ctx, "SetOfficerRoles", OID, bson.M{"$set": bson.M{"roles": roles}})
+}
+func (trace *MongoDBTracing) RotateOfficerSecret(ctx context.Context, OID, secret string) (err error) {
+	mongoLog.Tracef("RotateOfficerSecret OID:%s", OID)
+	if len(OID) == 0 || len(secret) == 0 {
+		return ErrInvalidParameter
+	}
+	rotated, err := NewOfficer(OID, secret)
+	if err != nil {
+		return err
+	}
+	return trace.updateOfficer(ctx, "RotateOfficerSecret", OID, bson.M{
+		"$set":   bson.M{"secretPrefix": rotated.SecretPrefix, "secretHash": rotated.SecretHash},
+		"$unset": bson.M{"secret": ""},
+	})
+}
+func (trace *MongoDBTracing) UpdateOfficer(ctx context.Context, OID string, update *OfficerUpdate) (err error) {
+	mongoLog.Tracef("UpdateOfficer OID:%s", OID)
+	if len(OID) == 0 || update.IsEmpty() {
+		return ErrInvalidParameter
+	}
+	set := bson.M{}
+	if update.Roles != nil {
+		set["roles"] = update.Roles
+	}
+	if update.Disabled != nil {
+		set["disabled"] = *update.Disabled
+	}
+	return trace.updateOfficer(ctx, "UpdateOfficer", OID, bson.M{"$set": set})
+}
+func (trace *MongoDBTracing) TouchOfficer(ctx context.Context, OID string, lastUsedAt int64) (err error) {
+	mongoLog.Tracef("TouchOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(ctx, "TouchOfficer", OID, bson.M{"$set": bson.M{"lastUsedAt": lastUsedAt}})
+}
+
+// updateOfficer applies update to the officer OID, returning ErrOfficerNotFound if there is none. op names the caller in logs.
+func (trace *MongoDBTracing) updateOfficer(ctx context.Context, op, OID string, update bson.M) error {
+	offCollection := trace.client.Database(trace.database).Collection(officerCollection)
+	res, err := offCollection.UpdateOne(ctx, bson.M{"oid": OID}, update)
+	if err != nil {
+		mongoLog.Errorf("%s . offCollection.UpdateOne OID:%s got %s", op, OID, err.Error())
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrOfficerNotFound
 	}
 	return nil
 }
@@ -227,17 +552,18 @@ func (trace *MongoDBTracing) GetOfficerID(ctx context.Context, secret string) (O
 		return "", ErrInvalidParameter
 	}
 	offCollection := trace.client.Database(trace.database).Collection(officerCollection)
-	filter := bson.M{"secret": secret}
-	off := &Officer{}
-	err = offCollection.FindOne(ctx, filter).Decode(off)
+	filter := bson.M{"secretPrefix": secretPrefix(secret)}
+	cur, err := offCollection.Find(ctx, filter)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return "", nil
-		}
-		mongoLog.Errorf("getOfficer . offCollection.FindOne OID:%s got %s", OID, err.Error())
+		mongoLog.Errorf("GetOfficerID . offCollection.Find got %s", err.Error())
 		return "", err
 	}
-	return off.OID, nil
+	candidates := make([]*Officer, 0)
+	if err := cur.All(ctx, &candidates); err != nil {
+		mongoLog.Errorf("GetOfficerID . cursor.All got %s", err.Error())
+		return "", err
+	}
+	return verifyOfficerCandidates(candidates, secret)
 }
 func (trace *MongoDBTracing) DeleteOfficer(ctx context.Context, OID string) (err error) {
 	mongoLog.Tracef("DeleteOfficer OID:%s", OID)
@@ -254,3 +580,161 @@ func (trace *MongoDBTracing) DeleteOfficer(ctx context.Context, OID string) (err
 	mongoLog.Tracef("DeleteOfficer OID:%s deleted", OID)
 	return nil
 }
+
+func (trace *MongoDBTracing) RegisterUploadToken(ctx context.Context, ut *UploadToken) (err error) {
+	mongoLog.Tracef("RegisterUploadToken JTI:%s", ut.ID)
+	if len(ut.ID) == 0 {
+		return ErrInvalidParameter
+	}
+	tokenCollection := trace.client.Database(trace.database).Collection(tokenCollection)
+	_, err = tokenCollection.InsertOne(ctx, &IssuedUploadToken{UploadToken: *ut, Status: UploadTokenIssued})
+	if err != nil {
+		mongoLog.Errorf("RegisterUploadToken . tokenCollection.InsertOne JTI:%s got %s", ut.ID, err.Error())
+		return err
+	}
+	return nil
+}
+func (trace *MongoDBTracing) ConsumeUploadToken(ctx context.Context, JTI string) (err error) {
+	mongoLog.Tracef("ConsumeUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	tokenCollection := trace.client.Database(trace.database).Collection(tokenCollection)
+	filter := bson.M{"jti": JTI, "status": UploadTokenIssued}
+	update := bson.M{"$set": bson.M{"status": UploadTokenConsumed}}
+	res, err := tokenCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		mongoLog.Errorf("ConsumeUploadToken . tokenCollection.UpdateOne JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if res.ModifiedCount == 1 {
+		return nil
+	}
+	iut := &IssuedUploadToken{}
+	err = tokenCollection.FindOne(ctx, bson.M{"jti": JTI}).Decode(iut)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrTokenNotFound
+		}
+		mongoLog.Errorf("ConsumeUploadToken . tokenCollection.FindOne JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if iut.Status == UploadTokenRevoked {
+		return ErrTokenRevoked
+	}
+	return ErrTokenConsumed
+}
+func (trace *MongoDBTracing) ReleaseUploadToken(ctx context.Context, JTI string) (err error) {
+	mongoLog.Tracef("ReleaseUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	tokenCollection := trace.client.Database(trace.database).Collection(tokenCollection)
+	filter := bson.M{"jti": JTI, "status": UploadTokenConsumed}
+	update := bson.M{"$set": bson.M{"status": UploadTokenIssued}}
+	res, err := tokenCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		mongoLog.Errorf("ReleaseUploadToken . tokenCollection.UpdateOne JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+	count, err := tokenCollection.CountDocuments(ctx, bson.M{"jti": JTI})
+	if err != nil {
+		mongoLog.Errorf("ReleaseUploadToken . tokenCollection.CountDocuments JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if count == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+func (trace *MongoDBTracing) RevokeUploadTokens(ctx context.Context, OID, JTI string) (revoked int, err error) {
+	mongoLog.Tracef("RevokeUploadTokens OID:%s JTI:%s", OID, JTI)
+	if len(OID) == 0 {
+		return 0, ErrInvalidParameter
+	}
+	tokenCollection := trace.client.Database(trace.database).Collection(tokenCollection)
+	filter := bson.M{"oid": OID, "status": UploadTokenIssued}
+	if len(JTI) > 0 {
+		filter["jti"] = JTI
+	}
+	update := bson.M{"$set": bson.M{"status": UploadTokenRevoked}}
+	res, err := tokenCollection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		mongoLog.Errorf("RevokeUploadTokens . tokenCollection.UpdateMany OID:%s got %s", OID, err.Error())
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+func (trace *MongoDBTracing) PurgeUploadTokens(ctx context.Context, oldestTimeStamp int64) (err error) {
+	mongoLog.Tracef("PurgeUploadTokens")
+	tokenCollection := trace.client.Database(trace.database).Collection(tokenCollection)
+	res, err := tokenCollection.DeleteMany(ctx, bson.M{"exp": bson.M{"$lt": oldestTimeStamp}})
+	if err != nil {
+		mongoLog.Errorf("PurgeUploadTokens . tokenCollection.DeleteMany got %s", err)
+		return err
+	}
+	mongoLog.Tracef("PurgeUploadTokens deleted %d entries", res.DeletedCount)
+	refreshCollection := trace.client.Database(trace.database).Collection(refreshCollection)
+	res, err = refreshCollection.DeleteMany(ctx, bson.M{"exp": bson.M{"$lt": oldestTimeStamp}})
+	if err != nil {
+		mongoLog.Errorf("PurgeUploadTokens . refreshCollection.DeleteMany got %s", err)
+		return err
+	}
+	mongoLog.Tracef("PurgeUploadTokens deleted %d used refresh tokens", res.DeletedCount)
+	return nil
+}
+func (trace *MongoDBTracing) ConsumeRefreshToken(ctx context.Context, JTI string, validUntil int64) (err error) {
+	mongoLog.Tracef("ConsumeRefreshToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	refreshCollection := trace.client.Database(trace.database).Collection(refreshCollection)
+	_, err = refreshCollection.InsertOne(ctx, bson.M{"jti": JTI, "exp": validUntil})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrTokenConsumed
+	}
+	if err != nil {
+		mongoLog.Errorf("ConsumeRefreshToken . refreshCollection.InsertOne JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	return nil
+}
+
+// mongoTempIDPolicy is the setting document holding the stored TempIDPolicy.
+type mongoTempIDPolicy struct {
+	ID     string        `bson:"_id"`
+	Policy *TempIDPolicy `bson:"policy"`
+}
+
+func (trace *MongoDBTracing) GetTempIDPolicy(ctx context.Context) (policy *TempIDPolicy, err error) {
+	mongoLog.Tracef("GetTempIDPolicy")
+	settingCollection := trace.client.Database(trace.database).Collection(settingCollection)
+	setting := &mongoTempIDPolicy{}
+	err = settingCollection.FindOne(ctx, bson.M{"_id": tempIDPolicySetting}).Decode(setting)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrTempIDPolicyNotFound
+		}
+		mongoLog.Errorf("GetTempIDPolicy . settingCollection.FindOne got %s", err.Error())
+		return nil, err
+	}
+	return setting.Policy, nil
+}
+func (trace *MongoDBTracing) SetTempIDPolicy(ctx context.Context, policy *TempIDPolicy) (err error) {
+	mongoLog.Tracef("SetTempIDPolicy")
+	settingCollection := trace.client.Database(trace.database).Collection(settingCollection)
+	filter := bson.M{"_id": tempIDPolicySetting}
+	if policy == nil {
+		_, err = settingCollection.DeleteOne(ctx, filter)
+	} else {
+		_, err = settingCollection.ReplaceOne(ctx, filter, &mongoTempIDPolicy{ID: tempIDPolicySetting, Policy: policy}, options.Replace().SetUpsert(true))
+	}
+	if err != nil {
+		mongoLog.Errorf("SetTempIDPolicy . settingCollection got %s", err.Error())
+		return err
+	}
+	return nil
+}
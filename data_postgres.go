@@ -0,0 +1,759 @@
+package hypertrace
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	postgresLog = logrus.WithField("DB", "Postgres")
+
+	//go:embed migrations/postgres/*.sql
+	postgresMigrations embed.FS
+)
+
+// postgresTempIDPolicySetting names the row of the settings table holding the stored TempIDPolicy.
+const postgresTempIDPolicySetting = "tempidpolicy"
+
+type PostgresTracing struct {
+	database string
+	server   string
+	port     int
+	user     string
+	password string
+	sslMode  string
+
+	db *sql.DB
+}
+
+func NewPostgresTracing(database, host string, port int, user, password, sslMode string) ITracing {
+	tracing := &PostgresTracing{
+		database: database,
+		server:   host,
+		port:     port,
+		user:     user,
+		password: password,
+		sslMode:  sslMode,
+	}
+
+	db, err := sql.Open("postgres", tracing.getPostgresURL())
+	if err != nil {
+		postgresLog.Fatal(err)
+		return nil
+	}
+	tracing.db = db
+	err = db.PingContext(context.TODO())
+	if err != nil {
+		postgresLog.Fatal(err)
+		return nil
+	}
+	err = tracing.migrate(context.TODO())
+	if err != nil {
+		postgresLog.Fatal(err)
+		return nil
+	}
+	err = tracing.hashLegacySecrets(context.TODO())
+	if err != nil {
+		postgresLog.Fatal(err)
+		return nil
+	}
+
+	return tracing
+}
+
+func (trace *PostgresTracing) getPostgresURL() string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		trace.server, trace.port, trace.user, trace.password, trace.database, trace.sslMode)
+}
+
+// Close releases the underlying connection pool.
+func (trace *PostgresTracing) Close() error {
+	return trace.db.Close()
+}
+
+// migrate applies every embedded migration that is not yet recorded in the schema_migrations table.
+// Migration files are named NNNN_description.sql and are applied in version order, each in its own transaction.
+func (trace *PostgresTracing) migrate(ctx context.Context) error {
+	_, err := trace.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER NOT NULL PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("%w : error creating schema_migrations table", err)
+	}
+
+	files, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		name := file[strings.LastIndex(file, "/")+1:]
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("%w : invalid migration file name %s", err, name)
+		}
+		var applied bool
+		err = trace.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", version).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("%w : error checking migration %s", err, name)
+		}
+		if applied {
+			continue
+		}
+		script, err := postgresMigrations.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		tx, err := trace.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, string(script)); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%w : error applying migration %s", err, name)
+		}
+		if _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("%w : error recording migration %s", err, name)
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		postgresLog.Infof("migration %s applied", name)
+	}
+	return nil
+}
+
+// hashLegacySecrets hashes the plaintext pin and secret columns of the rows stored before PINs and secrets
+// were hashed, and blanks them.
+func (trace *PostgresTracing) hashLegacySecrets(ctx context.Context) error {
+	rows, err := trace.db.QueryContext(ctx, "SELECT uid, pin FROM users WHERE pin <> ''")
+	if err != nil {
+		return fmt.Errorf("%w : error reading legacy user pins", err)
+	}
+	users := make([]*User, 0)
+	for rows.Next() {
+		usr := &User{}
+		if err := rows.Scan(&usr.UID, &usr.PIN); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, usr)
+	}
+	rows.Close()
+	for _, usr := range users {
+		if _, err := usr.HashLegacyPIN(); err != nil {
+			return err
+		}
+		_, err = trace.db.ExecContext(ctx, "UPDATE users SET pin_hash = $1, pin = '' WHERE uid = $2", usr.PINHash, usr.UID)
+		if err != nil {
+			return fmt.Errorf("%w : error hashing the pin of uid %s", err, usr.UID)
+		}
+	}
+	if len(users) > 0 {
+		postgresLog.Infof("hashed the PIN of %d users", len(users))
+	}
+
+	rows, err = trace.db.QueryContext(ctx, "SELECT oid, secret FROM officers WHERE secret <> ''")
+	if err != nil {
+		return fmt.Errorf("%w : error reading legacy officer secrets", err)
+	}
+	officers := make([]*Officer, 0)
+	for rows.Next() {
+		off := &Officer{}
+		if err := rows.Scan(&off.OID, &off.Secret); err != nil {
+			rows.Close()
+			return err
+		}
+		officers = append(officers, off)
+	}
+	rows.Close()
+	for _, off := range officers {
+		if _, err := off.HashLegacySecret(); err != nil {
+			return err
+		}
+		_, err = trace.db.ExecContext(ctx, "UPDATE officers SET secret_prefix = $1, secret_hash = $2, secret = '' WHERE oid = $3",
+			off.SecretPrefix, off.SecretHash, off.OID)
+		if err != nil {
+			return fmt.Errorf("%w : error hashing the secret of oid %s", err, off.OID)
+		}
+	}
+	if len(officers) > 0 {
+		postgresLog.Infof("hashed the secret of %d officers", len(officers))
+	}
+	return nil
+}
+
+func (trace *PostgresTracing) RegisterNewUser(ctx context.Context, UID, PIN string) (err error) {
+	postgresLog.Tracef("RegisterNewUser UID:%s", UID)
+	if len(UID) == 0 || len(PIN) == 0 {
+		return ErrInvalidParameter
+	}
+	usr, err := NewUser(UID, PIN)
+	if err != nil {
+		return err
+	}
+	_, err = trace.db.ExecContext(ctx, `INSERT INTO users (uid, pin_hash) VALUES ($1, $2)
+		ON CONFLICT (uid) DO UPDATE SET pin_hash = EXCLUDED.pin_hash, pin = ''`, UID, usr.PINHash)
+	if err != nil {
+		postgresLog.Errorf("RegisterNewUser . db.ExecContext UID:%s got %s", UID, err.Error())
+		return err
+	}
+	return nil
+}
+func (trace *PostgresTracing) VerifyHandshakePIN(ctx context.Context, UID, PIN string) (err error) {
+	postgresLog.Tracef("VerifyHandshakePIN UID:%s", UID)
+	if len(UID) == 0 || len(PIN) == 0 {
+		return ErrInvalidParameter
+	}
+	var pinHash string
+	err = trace.db.QueryRowContext(ctx, "SELECT pin_hash FROM users WHERE uid = $1", UID).Scan(&pinHash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUIDNotFound
+		}
+		postgresLog.Errorf("VerifyHandshakePIN . db.QueryRowContext UID:%s got %s", UID, err.Error())
+		return err
+	}
+	if !verifySecret(pinHash, PIN) {
+		return ErrPINNotValid
+	}
+	return nil
+}
+
+func (trace *PostgresTracing) GetUser(ctx context.Context, UID string) (user *User, err error) {
+	postgresLog.Tracef("GetUser UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	user = &User{}
+	err = trace.db.QueryRowContext(ctx, "SELECT uid, pin_hash FROM users WHERE uid = $1", UID).Scan(&user.UID, &user.PINHash)
+	if err == sql.ErrNoRows {
+		return nil, ErrUIDNotFound
+	}
+	if err != nil {
+		postgresLog.Errorf("GetUser . db.QueryRowContext UID:%s got %s", UID, err.Error())
+		return nil, err
+	}
+	return user, nil
+}
+
+func (trace *PostgresTracing) DeleteUser(ctx context.Context, UID string) (deletion *UserDeletion, err error) {
+	postgresLog.Tracef("DeleteUser UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	tx, err := trace.db.BeginTx(ctx, nil)
+	if err != nil {
+		postgresLog.Errorf("DeleteUser . db.BeginTx got %s", err)
+		return nil, err
+	}
+	deleted := func(query string) (int, error) {
+		res, err := tx.ExecContext(ctx, query, UID)
+		if err != nil {
+			postgresLog.Errorf("DeleteUser . tx.ExecContext %q got %s", query, err)
+			return 0, err
+		}
+		affected, _ := res.RowsAffected()
+		return int(affected), nil
+	}
+	deletion = &UserDeletion{}
+	users := 0
+	for _, step := range []struct {
+		query string
+		count *int
+	}{
+		{"DELETE FROM trace_data WHERE uid = $1", &deletion.Traces},
+		{"DELETE FROM trace_data WHERE cuid = $1", &deletion.ContactTraces},
+		{"DELETE FROM upload_tokens WHERE uid = $1", &deletion.UploadTokens},
+		{"DELETE FROM users WHERE uid = $1", &users},
+	} {
+		if *step.count, err = deleted(step.query); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		postgresLog.Errorf("DeleteUser . tx.Commit got %s", err)
+		return nil, err
+	}
+	deletion.User = users > 0
+	return deletion, nil
+}
+
+func (trace *PostgresTracing) SaveTraceData(ctx context.Context, UID, OID string, data []*TraceData) (saved []*TraceData, duplicates int, err error) {
+	if len(UID) == 0 {
+		return nil, 0, ErrInvalidParameter
+	}
+	saved = make([]*TraceData, 0, len(data))
+	if len(data) == 0 {
+		return saved, 0, nil
+	}
+	postgresLog.Tracef("SaveTraceData UID:%s OID:%s, %d items", UID, OID, len(data))
+	tx, err := trace.db.BeginTx(ctx, nil)
+	if err != nil {
+		postgresLog.Errorf("SaveTraceData . db.BeginTx got %s", err)
+		return nil, 0, err
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO trace_data (oid, uid, cuid, timestamp, model_c, model_p, rssi, tx_power, org, suspect, sealed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		_ = tx.Rollback()
+		postgresLog.Errorf("SaveTraceData . tx.PrepareContext got %s", err)
+		return nil, 0, err
+	}
+	defer stmt.Close()
+	for _, d := range data {
+		d.UID = UID
+		d.OID = OID
+		res, err := stmt.ExecContext(ctx, d.OID, d.UID, d.CUID, d.Timestamp, d.ModelC, d.ModelP, d.RSSI, d.TxPower, d.Org, d.Suspect, d.Sealed)
+		if err != nil {
+			_ = tx.Rollback()
+			postgresLog.Errorf("SaveTraceData . stmt.ExecContext got %s", err)
+			return nil, 0, err
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			duplicates++
+		} else {
+			saved = append(saved, d)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		postgresLog.Errorf("SaveTraceData . tx.Commit got %s", err)
+		return nil, 0, err
+	}
+	return saved, duplicates, nil
+}
+func (trace *PostgresTracing) PurgeOldTraceData(ctx context.Context, oldestTimeStamp int64) (purged int, err error) {
+	postgresLog.Tracef("PurgeOldTraceData")
+	res, err := trace.db.ExecContext(ctx, "DELETE FROM trace_data WHERE timestamp < $1", oldestTimeStamp)
+	if err != nil {
+		postgresLog.Errorf("PurgeOldTraceData . db.ExecContext got %s", err)
+		return 0, err
+	}
+	deleted, _ := res.RowsAffected()
+	postgresLog.Tracef("PurgeOldTraceData deleted %d entries", deleted)
+	return int(deleted), nil
+}
+func (trace *PostgresTracing) GetTraceData(ctx context.Context, UID string) (traces []*TraceData, err error) {
+	postgresLog.Tracef("GetTraceData UID:%s", UID)
+	if len(UID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	rows, err := trace.db.QueryContext(ctx, `SELECT oid, uid, cuid, timestamp, model_c, model_p, rssi, tx_power, org, suspect, sealed
+		FROM trace_data WHERE uid = $1 ORDER BY id`, UID)
+	if err != nil {
+		postgresLog.Errorf("GetTraceData . db.QueryContext got %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+	traces = make([]*TraceData, 0)
+	for rows.Next() {
+		td := &TraceData{}
+		err := rows.Scan(&td.OID, &td.UID, &td.CUID, &td.Timestamp, &td.ModelC, &td.ModelP, &td.RSSI, &td.TxPower, &td.Org, &td.Suspect, &td.Sealed)
+		if err != nil {
+			postgresLog.Errorf("GetTraceData . rows.Scan got %s", err.Error())
+			return nil, err
+		}
+		traces = append(traces, td)
+	}
+	return traces, rows.Err()
+}
+func (trace *PostgresTracing) QueryTraceData(ctx context.Context, filter *TraceFilter, cursor string, pageSize int) (traces []*TraceData, next string, err error) {
+	if err := filter.Validate(); err != nil || pageSize <= 0 {
+		return nil, "", ErrInvalidParameter
+	}
+	postgresLog.Tracef("QueryTraceData UID:%s cursor:%s", filter.UID, cursor)
+	var lastID int64
+	if len(cursor) > 0 {
+		position, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		lastID, err = strconv.ParseInt(position, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	conditions := []string{"uid = $1", "id > $2"}
+	args := []interface{}{filter.UID, lastID}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.From > 0 {
+		addCondition("timestamp >= $%d", filter.From)
+	}
+	if filter.To > 0 {
+		addCondition("timestamp <= $%d", filter.To)
+	}
+	if filter.MinRSSI != nil {
+		addCondition("rssi >= $%d", *filter.MinRSSI)
+	}
+	if len(filter.CUID) > 0 {
+		addCondition("cuid = $%d", filter.CUID)
+	}
+	if len(filter.OID) > 0 {
+		addCondition("oid = $%d", filter.OID)
+	}
+	if len(filter.Org) > 0 {
+		addCondition("org = $%d", filter.Org)
+	}
+	args = append(args, pageSize+1)
+	query := fmt.Sprintf(`SELECT id, oid, uid, cuid, timestamp, model_c, model_p, rssi, tx_power, org, suspect, sealed
+		FROM trace_data WHERE %s ORDER BY id LIMIT $%d`, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := trace.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		postgresLog.Errorf("QueryTraceData . db.QueryContext got %s", err)
+		return nil, "", err
+	}
+	defer rows.Close()
+	traces = make([]*TraceData, 0)
+	for rows.Next() {
+		if len(traces) == pageSize {
+			next = encodeCursor(strconv.FormatInt(lastID, 10))
+			break
+		}
+		td := &TraceData{}
+		err := rows.Scan(&lastID, &td.OID, &td.UID, &td.CUID, &td.Timestamp, &td.ModelC, &td.ModelP, &td.RSSI, &td.TxPower, &td.Org, &td.Suspect, &td.Sealed)
+		if err != nil {
+			postgresLog.Errorf("QueryTraceData . rows.Scan got %s", err.Error())
+			return nil, "", err
+		}
+		traces = append(traces, td)
+	}
+	return traces, next, rows.Err()
+}
+
+func (trace *PostgresTracing) RegisterNewOfficer(ctx context.Context, OID, secret string) (err error) {
+	postgresLog.Tracef("RegisterNewOfficer OID:%s", OID)
+	if len(OID) == 0 || len(secret) == 0 {
+		return ErrInvalidParameter
+	}
+	off, err := NewOfficer(OID, secret)
+	if err != nil {
+		return err
+	}
+	_, err = trace.db.ExecContext(ctx, `INSERT INTO officers (oid, secret_prefix, secret_hash, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (oid) DO UPDATE SET secret_prefix = EXCLUDED.secret_prefix, secret_hash = EXCLUDED.secret_hash, secret = ''`,
+		OID, off.SecretPrefix, off.SecretHash, off.CreatedAt)
+	if err != nil {
+		postgresLog.Errorf("RegisterNewOfficer . db.ExecContext OID:%s got %s", OID, err.Error())
+		return err
+	}
+	return nil
+}
+func (trace *PostgresTracing) SetOfficerRoles(ctx context.Context, OID string, roles []string) (err error) {
+	postgresLog.Tracef("SetOfficerRoles OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(ctx, "SetOfficerRoles", OID, "roles = $2", pq.Array(roles))
+}
+func (trace *PostgresTracing) RotateOfficerSecret(ctx context.Context, OID, secret string) (err error) {
+	postgresLog.Tracef("RotateOfficerSecret OID:%s", OID)
+	if len(OID) == 0 || len(secret) == 0 {
+		return ErrInvalidParameter
+	}
+	rotated, err := NewOfficer(OID, secret)
+	if err != nil {
+		return err
+	}
+	return trace.updateOfficer(ctx, "RotateOfficerSecret", OID, "secret_prefix = $2, secret_hash = $3, secret = ''", rotated.SecretPrefix, rotated.SecretHash)
+}
+func (trace *PostgresTracing) UpdateOfficer(ctx context.Context, OID string, update *OfficerUpdate) (err error) {
+	postgresLog.Tracef("UpdateOfficer OID:%s", OID)
+	if len(OID) == 0 || update.IsEmpty() {
+		return ErrInvalidParameter
+	}
+	sets := make([]string, 0, 2)
+	args := make([]interface{}, 0, 2)
+	if update.Roles != nil {
+		args = append(args, pq.Array(update.Roles))
+		sets = append(sets, fmt.Sprintf("roles = $%d", len(args)+1))
+	}
+	if update.Disabled != nil {
+		args = append(args, *update.Disabled)
+		sets = append(sets, fmt.Sprintf("disabled = $%d", len(args)+1))
+	}
+	return trace.updateOfficer(ctx, "UpdateOfficer", OID, strings.Join(sets, ", "), args...)
+}
+func (trace *PostgresTracing) TouchOfficer(ctx context.Context, OID string, lastUsedAt int64) (err error) {
+	postgresLog.Tracef("TouchOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	return trace.updateOfficer(ctx, "TouchOfficer", OID, "last_used_at = $2", lastUsedAt)
+}
+
+// updateOfficer runs UPDATE officers SET set WHERE oid = $1, the values of set are args from $2 on.
+// It returns ErrOfficerNotFound if no officer was updated, op names the caller in logs.
+func (trace *PostgresTracing) updateOfficer(ctx context.Context, op, OID, set string, args ...interface{}) error {
+	res, err := trace.db.ExecContext(ctx, "UPDATE officers SET "+set+" WHERE oid = $1", append([]interface{}{OID}, args...)...)
+	if err != nil {
+		postgresLog.Errorf("%s . db.ExecContext OID:%s got %s", op, OID, err.Error())
+		return err
+	}
+	if updated, _ := res.RowsAffected(); updated == 0 {
+		return ErrOfficerNotFound
+	}
+	return nil
+}
+func (trace *PostgresTracing) GetOfficerID(ctx context.Context, secret string) (OID string, err error) {
+	postgresLog.Tracef("GetOfficerID secret:****")
+	if len(secret) == 0 {
+		return "", ErrInvalidParameter
+	}
+	rows, err := trace.db.QueryContext(ctx, "SELECT oid, secret_hash FROM officers WHERE secret_prefix = $1", secretPrefix(secret))
+	if err != nil {
+		postgresLog.Errorf("GetOfficerID . db.QueryContext got %s", err.Error())
+		return "", err
+	}
+	defer rows.Close()
+	candidates := make([]*Officer, 0)
+	for rows.Next() {
+		off := &Officer{}
+		if err := rows.Scan(&off.OID, &off.SecretHash); err != nil {
+			postgresLog.Errorf("GetOfficerID . rows.Scan got %s", err.Error())
+			return "", err
+		}
+		candidates = append(candidates, off)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return verifyOfficerCandidates(candidates, secret)
+}
+func (trace *PostgresTracing) GetOfficer(ctx context.Context, OID string) (officer *Officer, err error) {
+	postgresLog.Tracef("GetOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return nil, ErrInvalidParameter
+	}
+	officer, err = scanOfficer(trace.db.QueryRowContext(ctx, "SELECT "+officerColumns+" FROM officers WHERE oid = $1", OID))
+	if err == sql.ErrNoRows {
+		return nil, ErrOfficerNotFound
+	}
+	if err != nil {
+		postgresLog.Errorf("GetOfficer . db.QueryRowContext OID:%s got %s", OID, err.Error())
+		return nil, err
+	}
+	return officer, nil
+}
+func (trace *PostgresTracing) ListOfficers(ctx context.Context) (officers []*Officer, err error) {
+	postgresLog.Tracef("ListOfficers")
+	rows, err := trace.db.QueryContext(ctx, "SELECT "+officerColumns+" FROM officers ORDER BY oid")
+	if err != nil {
+		postgresLog.Errorf("ListOfficers . db.QueryContext got %s", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+	officers = make([]*Officer, 0)
+	for rows.Next() {
+		off, err := scanOfficer(rows)
+		if err != nil {
+			postgresLog.Errorf("ListOfficers . rows.Scan got %s", err.Error())
+			return nil, err
+		}
+		officers = append(officers, off)
+	}
+	return officers, rows.Err()
+}
+
+// officerColumns are the officers columns read by scanOfficer.
+const officerColumns = "oid, secret_prefix, secret_hash, roles, disabled, created_at, last_used_at"
+
+// rowScanner is either a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOfficer(row rowScanner) (*Officer, error) {
+	off := &Officer{}
+	err := row.Scan(&off.OID, &off.SecretPrefix, &off.SecretHash, pq.Array(&off.Roles), &off.Disabled, &off.CreatedAt, &off.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return off, nil
+}
+func (trace *PostgresTracing) DeleteOfficer(ctx context.Context, OID string) (err error) {
+	postgresLog.Tracef("DeleteOfficer OID:%s", OID)
+	if len(OID) == 0 {
+		return ErrInvalidParameter
+	}
+	_, err = trace.db.ExecContext(ctx, "DELETE FROM officers WHERE oid = $1", OID)
+	if err != nil {
+		postgresLog.Errorf("DeleteOfficer OID:%s got %s", OID, err.Error())
+		return err
+	}
+	postgresLog.Tracef("DeleteOfficer OID:%s deleted", OID)
+	return nil
+}
+
+func (trace *PostgresTracing) RegisterUploadToken(ctx context.Context, ut *UploadToken) (err error) {
+	postgresLog.Tracef("RegisterUploadToken JTI:%s", ut.ID)
+	if len(ut.ID) == 0 {
+		return ErrInvalidParameter
+	}
+	_, err = trace.db.ExecContext(ctx, `INSERT INTO upload_tokens (jti, oid, uid, nbf, exp, status) VALUES ($1, $2, $3, $4, $5, $6)`,
+		ut.ID, ut.OID, ut.UID, ut.ValidFrom, ut.ValidUntil, UploadTokenIssued)
+	if err != nil {
+		postgresLog.Errorf("RegisterUploadToken . db.ExecContext JTI:%s got %s", ut.ID, err.Error())
+		return err
+	}
+	return nil
+}
+func (trace *PostgresTracing) ConsumeUploadToken(ctx context.Context, JTI string) (err error) {
+	postgresLog.Tracef("ConsumeUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	res, err := trace.db.ExecContext(ctx, "UPDATE upload_tokens SET status = $1 WHERE jti = $2 AND status = $3",
+		UploadTokenConsumed, JTI, UploadTokenIssued)
+	if err != nil {
+		postgresLog.Errorf("ConsumeUploadToken . db.ExecContext JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if updated, _ := res.RowsAffected(); updated == 1 {
+		return nil
+	}
+	var status string
+	err = trace.db.QueryRowContext(ctx, "SELECT status FROM upload_tokens WHERE jti = $1", JTI).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTokenNotFound
+		}
+		postgresLog.Errorf("ConsumeUploadToken . db.QueryRowContext JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if status == UploadTokenRevoked {
+		return ErrTokenRevoked
+	}
+	return ErrTokenConsumed
+}
+func (trace *PostgresTracing) ReleaseUploadToken(ctx context.Context, JTI string) (err error) {
+	postgresLog.Tracef("ReleaseUploadToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	res, err := trace.db.ExecContext(ctx, "UPDATE upload_tokens SET status = $1 WHERE jti = $2 AND status = $3",
+		UploadTokenIssued, JTI, UploadTokenConsumed)
+	if err != nil {
+		postgresLog.Errorf("ReleaseUploadToken . db.ExecContext JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if updated, _ := res.RowsAffected(); updated == 1 {
+		return nil
+	}
+	var exists bool
+	err = trace.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM upload_tokens WHERE jti = $1)", JTI).Scan(&exists)
+	if err != nil {
+		postgresLog.Errorf("ReleaseUploadToken . db.QueryRowContext JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if !exists {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+func (trace *PostgresTracing) RevokeUploadTokens(ctx context.Context, OID, JTI string) (revoked int, err error) {
+	postgresLog.Tracef("RevokeUploadTokens OID:%s JTI:%s", OID, JTI)
+	if len(OID) == 0 {
+		return 0, ErrInvalidParameter
+	}
+	query := "UPDATE upload_tokens SET status = $1 WHERE oid = $2 AND status = $3"
+	args := []interface{}{UploadTokenRevoked, OID, UploadTokenIssued}
+	if len(JTI) > 0 {
+		query += " AND jti = $4"
+		args = append(args, JTI)
+	}
+	res, err := trace.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		postgresLog.Errorf("RevokeUploadTokens . db.ExecContext OID:%s got %s", OID, err.Error())
+		return 0, err
+	}
+	updated, _ := res.RowsAffected()
+	return int(updated), nil
+}
+func (trace *PostgresTracing) PurgeUploadTokens(ctx context.Context, oldestTimeStamp int64) (err error) {
+	postgresLog.Tracef("PurgeUploadTokens")
+	res, err := trace.db.ExecContext(ctx, "DELETE FROM upload_tokens WHERE exp < $1", oldestTimeStamp)
+	if err != nil {
+		postgresLog.Errorf("PurgeUploadTokens . db.ExecContext got %s", err)
+		return err
+	}
+	deleted, _ := res.RowsAffected()
+	postgresLog.Tracef("PurgeUploadTokens deleted %d entries", deleted)
+	res, err = trace.db.ExecContext(ctx, "DELETE FROM refresh_tokens WHERE exp < $1", oldestTimeStamp)
+	if err != nil {
+		postgresLog.Errorf("PurgeUploadTokens . db.ExecContext refresh_tokens got %s", err)
+		return err
+	}
+	deleted, _ = res.RowsAffected()
+	postgresLog.Tracef("PurgeUploadTokens deleted %d used refresh tokens", deleted)
+	return nil
+}
+func (trace *PostgresTracing) ConsumeRefreshToken(ctx context.Context, JTI string, validUntil int64) (err error) {
+	postgresLog.Tracef("ConsumeRefreshToken JTI:%s", JTI)
+	if len(JTI) == 0 {
+		return ErrInvalidParameter
+	}
+	res, err := trace.db.ExecContext(ctx, "INSERT INTO refresh_tokens (jti, exp) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING", JTI, validUntil)
+	if err != nil {
+		postgresLog.Errorf("ConsumeRefreshToken . db.ExecContext JTI:%s got %s", JTI, err.Error())
+		return err
+	}
+	if inserted, _ := res.RowsAffected(); inserted == 0 {
+		return ErrTokenConsumed
+	}
+	return nil
+}
+
+func (trace *PostgresTracing) GetTempIDPolicy(ctx context.Context) (policy *TempIDPolicy, err error) {
+	postgresLog.Tracef("GetTempIDPolicy")
+	var policyJson string
+	err = trace.db.QueryRowContext(ctx, "SELECT value FROM settings WHERE name = $1", postgresTempIDPolicySetting).Scan(&policyJson)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrTempIDPolicyNotFound
+		}
+		postgresLog.Errorf("GetTempIDPolicy . db.QueryRowContext got %s", err.Error())
+		return nil, err
+	}
+	policy = &TempIDPolicy{}
+	if err := json.Unmarshal([]byte(policyJson), policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+func (trace *PostgresTracing) SetTempIDPolicy(ctx context.Context, policy *TempIDPolicy) (err error) {
+	postgresLog.Tracef("SetTempIDPolicy")
+	if policy == nil {
+		_, err = trace.db.ExecContext(ctx, "DELETE FROM settings WHERE name = $1", postgresTempIDPolicySetting)
+	} else {
+		var policyJson []byte
+		if policyJson, err = json.Marshal(policy); err != nil {
+			return err
+		}
+		_, err = trace.db.ExecContext(ctx, `INSERT INTO settings (name, value) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value`, postgresTempIDPolicySetting, string(policyJson))
+	}
+	if err != nil {
+		postgresLog.Errorf("SetTempIDPolicy . db.ExecContext got %s", err.Error())
+		return err
+	}
+	return nil
+}
@@ -4,14 +4,40 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"math"
 )
 
-func encode(cyperText, iv []byte) (encoded []byte, err error) {
+// envelopeMarker starts every envelope carrying a key id. Envelopes made before key ids start with
+// the length of the cypher text instead, which is never 0 since it includes the GCM tag.
+const envelopeMarker = 0
+
+// envelopeMarkerLong starts the envelopes of a cypher text longer than 255 bytes, whose length takes 2 bytes.
+// It is never the first byte of an envelope made before key ids either, the GCM tag alone is 16 bytes.
+const envelopeMarkerLong = 1
+
+// nonceSize is the size of the GCM nonce made by encrypt.
+const nonceSize = 12
+
+// encode frames cypherText and iv into the envelope 0x00, keyID, cypher length, cypher, iv length, iv.
+// A cypher text longer than 255 bytes is framed as 0x01, keyID, 2 bytes big endian cypher length, cypher, iv length, iv.
+func encode(keyID byte, cyperText, iv []byte) (encoded []byte, err error) {
+	if len(cyperText) > math.MaxUint16 || len(iv) > math.MaxUint8 {
+		return nil, fmt.Errorf("encode error : cypher text of %d bytes or iv of %d bytes too long", len(cyperText), len(iv))
+	}
 	buff := &bytes.Buffer{}
-	err = buff.WriteByte(byte(len(cyperText)))
+	if len(cyperText) > math.MaxUint8 {
+		buff.Write([]byte{envelopeMarkerLong, keyID})
+		err = binary.Write(buff, binary.BigEndian, uint16(len(cyperText)))
+	} else {
+		buff.Write([]byte{envelopeMarker, keyID})
+		err = buff.WriteByte(byte(len(cyperText)))
+	}
 	if err != nil {
 		return nil, fmt.Errorf("%w : encode error", err)
 	}
@@ -32,39 +58,50 @@ func encode(cyperText, iv []byte) (encoded []byte, err error) {
 	return buff.Bytes(), nil
 }
 
-func decode(encoded []byte) (cyperText, iv []byte, err error) {
-	var cyperData, ivData []byte
-	buff := bytes.NewBuffer(encoded)
-
-	cypherLen, err := buff.ReadByte()
-	if err != nil {
-		return nil, nil, fmt.Errorf("%w : decode error during reading 1 byte from buffer to find out cypher len", err)
-	}
-	cyperData = make([]byte, cypherLen)
-	_, err = buff.Read(cyperData)
-	if err != nil {
-		return nil, nil, fmt.Errorf("%w : decode error during reading %d bytes of cypher data ", err, cypherLen)
-	}
-
-	ivLen, err := buff.ReadByte()
-	if err != nil {
-		return nil, nil, fmt.Errorf("%w : decode error during reading 1 byte from buffer to find out IV len", err)
-	}
-
-	ivData = make([]byte, ivLen)
-	_, err = buff.Read(ivData)
-	if err != nil {
-		return nil, nil, fmt.Errorf("%w : decode error during reading %d bytes of iv data", err, ivLen)
-	}
-
-	return cyperData, ivData, nil
+// decode reads an envelope made by encode. keyID is 0 for an envelope made before key ids were embedded.
+func decode(encoded []byte) (keyID byte, cyperText, iv []byte, err error) {
+	var cypherLen int
+	var framed []byte
+	switch {
+	case len(encoded) > 4 && encoded[0] == envelopeMarkerLong:
+		keyID = encoded[1]
+		cypherLen = int(binary.BigEndian.Uint16(encoded[2:4]))
+		framed = encoded[4:]
+	case len(encoded) > 2 && encoded[0] == envelopeMarker:
+		keyID = encoded[1]
+		cypherLen = int(encoded[2])
+		framed = encoded[3:]
+		// envelopes of a cypher text longer than 255 bytes used to be framed with its length truncated to a byte,
+		// the length is then the one left between the length byte and the nonce
+		if long := len(framed) - 1 - nonceSize; long > math.MaxUint8 && byte(long) == encoded[2] && framed[long] == nonceSize {
+			cypherLen = long
+		}
+	case len(encoded) > 0:
+		cypherLen = int(encoded[0])
+		framed = encoded[1:]
+	default:
+		return 0, nil, nil, fmt.Errorf("decode error : empty envelope")
+	}
+
+	if len(framed) < cypherLen+1 {
+		return 0, nil, nil, fmt.Errorf("decode error : envelope too short for %d bytes of cypher data", cypherLen)
+	}
+	cyperText = framed[:cypherLen]
+	ivLen := int(framed[cypherLen])
+	framed = framed[cypherLen+1:]
+	if len(framed) < ivLen {
+		return 0, nil, nil, fmt.Errorf("decode error : envelope too short for %d bytes of iv data", ivLen)
+	}
+	iv = framed[:ivLen]
+
+	return keyID, cyperText, iv, nil
 }
 
 func encrypt(data, key []byte) (cypherText, iv []byte, err error) {
 	if len(key) != 32 {
 		return nil, nil, fmt.Errorf("invalid key size %d, we expect 32", len(key))
 	}
-	iv = make([]byte, 12)
+	iv = make([]byte, nonceSize)
 	_, err = rand.Read(iv)
 	if err != nil {
 		return nil, nil, fmt.Errorf("%w : encrypt error", err)
@@ -96,6 +133,9 @@ func decrypt(cypherText, iv, key []byte) (data []byte, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("%w : decrypt error", err)
 	}
+	if len(iv) != decryptor.NonceSize() {
+		return nil, fmt.Errorf("decrypt error : invalid iv size %d, we expect %d", len(iv), decryptor.NonceSize())
+	}
 	data, err = decryptor.Open(nil, iv, cypherText, nil)
 	if err != nil {
 		return nil, fmt.Errorf("%w : decryptor.Open error", err)
@@ -103,23 +143,54 @@ func decrypt(cypherText, iv, key []byte) (data []byte, err error) {
 	return data, err
 }
 
-func encryptAndEncode(data, key []byte) (crypted string, err error) {
+// deriveKey derives from key a key dedicated to purpose, so a keyring key can also sign without ever being used twice.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// encryptAndEncode encrypts data with the active key of keys.
+func encryptAndEncode(data []byte, keys *Keyring) (crypted string, err error) {
+	keyID, key, err := keys.ActiveKey()
+	if err != nil {
+		return "", fmt.Errorf("%w : encrypt-encode error", err)
+	}
 	cypherText, iv, err := encrypt(data, key)
 	if err != nil {
 		return "", fmt.Errorf("%w : encrypt-encode error", err)
 	}
-	encoded, err := encode(cypherText, iv)
+	encoded, err := encode(keyID, cypherText, iv)
 	if err != nil {
 		return "", fmt.Errorf("%w : encrypt-encode error", err)
 	}
 	return B64Encode(encoded), nil
 }
 
-func decodeAndDecrypt(crypted string, key []byte) (data []byte, err error) {
-	cypher, iv, err := decode(B64Decode(crypted))
+// decodeAndDecrypt decrypts crypted with the key whose id is in its envelope, as long as that key is not retired.
+// Envelopes without key id are tried with every key not retired.
+func decodeAndDecrypt(crypted string, keys *Keyring) (data []byte, err error) {
+	encoded, err := base64.StdEncoding.DecodeString(crypted)
+	if err != nil {
+		return nil, fmt.Errorf("%w : base64 decode error", err)
+	}
+	keyID, cypher, iv, err := decode(encoded)
 	if err != nil {
 		return nil, fmt.Errorf("%w : decode error when decoding base64 cryptext", err)
 	}
+	if keyID == 0 {
+		err = ErrKeyNotFound
+		for _, key := range keys.DecryptionKeys() {
+			if data, err = decrypt(cypher, iv, key); err == nil {
+				return data, nil
+			}
+		}
+		return nil, fmt.Errorf("%w : decrypt error", err)
+	}
+	key, err := keys.DecryptionKey(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("%w : decrypt error", err)
+	}
 	data, err = decrypt(cypher, iv, key)
 	if err != nil {
 		return nil, fmt.Errorf("%w : decrypt error", err)
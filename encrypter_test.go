@@ -1,10 +1,13 @@
 package hypertrace
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestDecrypt(t *testing.T) {
 	data := "LZYJvvdD2VI7rF+pv5Bm8bkg0ZDvQe/ad5lu6T5YWdwEreVLrCLhUtXjm6hE5AzqmEmeGP8Vdlbnt+c="
-	dataDec, err := decodeAndDecrypt(data, []byte(ENCRYPTIONKEY))
+	dataDec, err := decodeAndDecrypt(data, CryptKeys)
 	if err != nil {
 		t.Error(err.Error())
 	}
@@ -13,15 +16,21 @@ func TestDecrypt(t *testing.T) {
 
 func TestEncryptDecrypt(t *testing.T) {
 	dataString := "thequickbrownfoxjumpsoveralazydogthequickbrownfoxjumpsoveralazydogthequickbrownfoxjumpsoveralazydogthequickbrownfoxjumpsoveralazydog"
-	key := "thisistheencryptionkey0123456789"
+	keys := NewKeyring()
+	if err := keys.AddKey(1, []byte("thisistheencryptionkey0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.SetActive(1); err != nil {
+		t.Fatal(err)
+	}
 
-	crypted, err := encryptAndEncode([]byte(dataString), []byte(key))
+	crypted, err := encryptAndEncode([]byte(dataString), keys)
 	if err != nil {
 		t.Error(err.Error())
 		t.FailNow()
 	}
 
-	data, err := decodeAndDecrypt(crypted, []byte(key))
+	data, err := decodeAndDecrypt(crypted, keys)
 	if err != nil {
 		t.Errorf("error from decodeAndDecrypt : %v", err.Error())
 		t.FailNow()
@@ -32,3 +41,47 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestDecodeAndDecrypt_MalformedIV(t *testing.T) {
+	keyID, key, err := CryptKeys.ActiveKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cypherText, _, err := encrypt([]byte("data"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encode(keyID, cypherText, make([]byte, 45))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeAndDecrypt(B64Encode(encoded), CryptKeys); err == nil {
+		t.Fatal("expect an iv of the wrong size to fail")
+	}
+}
+
+func TestEncodeDecode_LongCypherText(t *testing.T) {
+	keyID, key, err := CryptKeys.ActiveKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("d", 300))
+	cypherText, iv, err := encrypt(data, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := encode(keyID, cypherText, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := decodeAndDecrypt(B64Encode(encoded), CryptKeys); err != nil || string(decrypted) != string(data) {
+		t.Fatalf("expect the long data back, got %v", err)
+	}
+
+	// envelopes made before the long form carry the length truncated to a byte
+	truncated := append([]byte{envelopeMarker, keyID, byte(len(cypherText))}, cypherText...)
+	truncated = append(append(truncated, byte(len(iv))), iv...)
+	if decrypted, err := decodeAndDecrypt(B64Encode(truncated), CryptKeys); err != nil || string(decrypted) != string(data) {
+		t.Fatalf("expect the truncated length envelope to be read, got %v", err)
+	}
+}
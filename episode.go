@@ -0,0 +1,105 @@
+package hypertrace
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ContactEpisode is an encounter of UID with CUID: the sightings of CUID uploaded by UID which follow each other
+// without a gap longer than EpisodeOptions.GapSecond. Times are in unix seconds and RSSI in dBm.
+type ContactEpisode struct {
+	UID      string  `json:"uid"`
+	CUID     string  `json:"cuid"`
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Duration int64   `json:"duration"` // seconds from the first to the last sighting, 0 for a single one
+	Records  int     `json:"records"`
+	RSSIMin  int     `json:"rssiMin"`
+	RSSIMean float64 `json:"rssiMean"`
+	RSSIMax  int     `json:"rssiMax"`
+	Suspect  bool    `json:"suspect,omitempty"` // some sightings are outside of their TempID validity
+}
+
+// EpisodeOptions are the thresholds of AggregateEpisodes.
+type EpisodeOptions struct {
+	GapSecond         int64 // sightings further apart belong to different episodes
+	MinDurationSecond int64 // shorter episodes are left out
+}
+
+// NewEpisodeOptionsFromConfig reads the episode.* keys.
+func NewEpisodeOptionsFromConfig() *EpisodeOptions {
+	return &EpisodeOptions{
+		GapSecond:         int64(ConfigGetInt("episode.gap.second")),
+		MinDurationSecond: int64(ConfigGetInt("episode.min.duration.second")),
+	}
+}
+
+// Validate returns ErrInvalidParameter if the thresholds are negative.
+func (opts *EpisodeOptions) Validate() error {
+	if opts.GapSecond < 0 || opts.MinDurationSecond < 0 {
+		return fmt.Errorf("%w : episode thresholds must not be negative", ErrInvalidParameter)
+	}
+	return nil
+}
+
+// AggregateEpisodes groups traces into contact episodes per UID and CUID, ordered by start then CUID.
+// traces may come in any order.
+func AggregateEpisodes(traces []*TraceData, opts *EpisodeOptions) []*ContactEpisode {
+	type pair struct{ uid, cuid string }
+	byPair := make(map[pair][]*TraceData)
+	for _, trace := range traces {
+		key := pair{trace.UID, trace.CUID}
+		byPair[key] = append(byPair[key], trace)
+	}
+
+	episodes := make([]*ContactEpisode, 0)
+	for key, sightings := range byPair {
+		sort.Slice(sightings, func(i, j int) bool {
+			return sightings[i].Timestamp < sightings[j].Timestamp
+		})
+		var episode *ContactEpisode
+		var rssiSum int
+		closeEpisode := func() {
+			if episode == nil {
+				return
+			}
+			episode.Duration = episode.End - episode.Start
+			episode.RSSIMean = float64(rssiSum) / float64(episode.Records)
+			if episode.Duration >= opts.MinDurationSecond {
+				episodes = append(episodes, episode)
+			}
+		}
+		for _, sighting := range sightings {
+			if episode == nil || sighting.Timestamp-episode.End > opts.GapSecond {
+				closeEpisode()
+				episode = &ContactEpisode{
+					UID:     key.uid,
+					CUID:    key.cuid,
+					Start:   sighting.Timestamp,
+					RSSIMin: sighting.RSSI,
+					RSSIMax: sighting.RSSI,
+				}
+				rssiSum = 0
+			}
+			episode.End = sighting.Timestamp
+			episode.Records++
+			rssiSum += sighting.RSSI
+			if sighting.RSSI < episode.RSSIMin {
+				episode.RSSIMin = sighting.RSSI
+			}
+			if sighting.RSSI > episode.RSSIMax {
+				episode.RSSIMax = sighting.RSSI
+			}
+			episode.Suspect = episode.Suspect || sighting.Suspect
+		}
+		closeEpisode()
+	}
+
+	sort.Slice(episodes, func(i, j int) bool {
+		if episodes[i].Start != episodes[j].Start {
+			return episodes[i].Start < episodes[j].Start
+		}
+		return episodes[i].CUID < episodes[j].CUID
+	})
+	return episodes
+}
@@ -0,0 +1,41 @@
+package hypertrace
+
+import (
+	"testing"
+)
+
+func TestAggregateEpisodes(t *testing.T) {
+	traces := []*TraceData{
+		{UID: "a", CUID: "x", Timestamp: 1120, RSSI: -70},
+		{UID: "a", CUID: "x", Timestamp: 1000, RSSI: -60},
+		{UID: "a", CUID: "x", Timestamp: 1060, RSSI: -80, Suspect: true},
+		{UID: "a", CUID: "x", Timestamp: 2000, RSSI: -50},
+		{UID: "a", CUID: "y", Timestamp: 1000, RSSI: -90},
+		{UID: "a", CUID: "y", Timestamp: 1400, RSSI: -88},
+	}
+
+	episodes := AggregateEpisodes(traces, &EpisodeOptions{GapSecond: 300})
+	if len(episodes) != 4 {
+		t.Fatalf("expect 4 episodes, got %d", len(episodes))
+	}
+	first := episodes[0]
+	if first.CUID != "x" || first.Start != 1000 || first.End != 1120 || first.Duration != 120 || first.Records != 3 {
+		t.Errorf("expect the first 3 sightings of x in one episode, got %+v", first)
+	}
+	if first.RSSIMin != -80 || first.RSSIMax != -60 || first.RSSIMean != -70 || !first.Suspect {
+		t.Errorf("expect the RSSI statistics and suspect sighting of the first episode, got %+v", first)
+	}
+	if episodes[1].CUID != "y" || episodes[1].Start != 1000 || episodes[1].Records != 1 || episodes[1].Duration != 0 {
+		t.Errorf("expect a single sighting episode of y at 1000, got %+v", episodes[1])
+	}
+	if episodes[3].CUID != "x" || episodes[3].Start != 2000 || episodes[3].Suspect {
+		t.Errorf("expect the last episode of x at 2000, got %+v", episodes[3])
+	}
+
+	if episodes := AggregateEpisodes(traces, &EpisodeOptions{GapSecond: 400, MinDurationSecond: 60}); len(episodes) != 2 {
+		t.Errorf("expect the single sighting of x left out and y joined into one, got %d episodes", len(episodes))
+	}
+	if episodes := AggregateEpisodes(nil, &EpisodeOptions{}); episodes == nil || len(episodes) != 0 {
+		t.Errorf("expect no episode, got %v", episodes)
+	}
+}
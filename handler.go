@@ -2,12 +2,18 @@ package hypertrace
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -27,33 +33,109 @@ const (
 
 var (
 	ErrInvalidTempIDLength = fmt.Errorf("invalid temporary id length")
+	ErrTempIDDecrypt       = fmt.Errorf("temporary id can not be decrypted")
+	ErrTooManyTraces       = fmt.Errorf("too many traces")
 	Tracing                ITracing
+	Audit                  AuditLog
 	Forwarder              IForwarder
-	ENCRYPTIONKEY          string
-	ValidPeriod            uint32
-	TempIDAmount           int
+	CryptKeys              *Keyring
+	TempIDThrottle         *Throttle
+	TempIDProofThrottle    *Throttle
 )
 
 func init() {
-	ENCRYPTIONKEY = ConfigGet("tempid.crypt.key")
-	ValidPeriod = uint32(ConfigGetInt("tempid.valid.period.hour"))
-	TempIDAmount = ConfigGetInt("tempid.count")
-
 	Forwarder = &StdOutForwarder{}
 }
 
+// InitTempIDThrottle makes the /getTempIDs throttles out of the tempid.issue.* and tempid.proof.failure.* keys.
+func InitTempIDThrottle() {
+	TempIDThrottle = NewThrottle(ConfigGetInt("tempid.issue.limit"), time.Duration(ConfigGetInt("tempid.issue.window.minute"))*time.Minute)
+	TempIDProofThrottle = NewThrottle(ConfigGetInt("tempid.proof.failure.limit"), time.Duration(ConfigGetInt("tempid.proof.failure.window.minute"))*time.Minute)
+}
+
+// InitKeys loads the encryption keyring through the configured KeyProvider.
+// It stops the server right away if a key is missing or is not KeySize bytes long.
+func InitKeys() {
+	if CryptKeys == nil {
+		provider, err := NewKeyProviderFromConfig()
+		if err != nil {
+			logrus.Fatalf("invalid tempid.key.provider configuration. got %s", err.Error())
+		}
+		keys, err := NewKeyringFromConfig(provider)
+		if err != nil {
+			logrus.Fatalf("invalid tempid keyring configuration. got %s", err.Error())
+		}
+		CryptKeys = keys
+	}
+}
+
 func InitTracing() {
 	if Tracing == nil {
-		if ConfigGet("database") == "mongodb" {
+		switch ConfigGet("database") {
+		case "mongodb":
 			logrus.Warnf("Database using MongoDB")
 			Tracing = NewMongoDBTracing(ConfigGet("mongo.database"), ConfigGet("mongo.host"), ConfigGetInt("mongo.port"), ConfigGet("mongo.user"), ConfigGet("mongo.password"))
-		} else {
-			logrus.Warnf("Database using InMemory. Next server restart will clear all data.")
-			Tracing = NewInMemoryTracing()
+		case "postgres":
+			logrus.Warnf("Database using PostgreSQL")
+			Tracing = NewPostgresTracing(ConfigGet("postgres.database"), ConfigGet("postgres.host"), ConfigGetInt("postgres.port"), ConfigGet("postgres.user"), ConfigGet("postgres.password"), ConfigGet("postgres.sslmode"))
+		case "bolt":
+			logrus.Warnf("Database using Bolt file %s", ConfigGet("bolt.path"))
+			Tracing = NewBoltTracing(ConfigGet("bolt.path"))
+		default:
+			if path := ConfigGet("inmemory.snapshot.path"); len(path) > 0 {
+				logrus.Warnf("Database using InMemory with snapshot file %s", path)
+				Tracing = NewInMemoryTracingWithSnapshot(path, time.Duration(ConfigGetInt("inmemory.snapshot.interval.second"))*time.Second)
+			} else {
+				logrus.Warnf("Database using InMemory. Next server restart will clear all data.")
+				Tracing = NewInMemoryTracing()
+			}
+		}
+		if ConfigGetBoolean("tracing.encryption.enabled") {
+			logrus.Warnf("Trace data encryption enabled")
+			Tracing = NewEncryptedTracing(Tracing, []byte(ConfigGet("tracing.encryption.key")), []byte(ConfigGet("tracing.encryption.index.key")), CryptKeys)
+		}
+		if path := ConfigGet("seed.file"); len(path) > 0 {
+			logrus.Warnf("Seeding the database from %s, do not use on production", path)
+			if err := SeedTracing(context.Background(), Tracing, path); err != nil {
+				logrus.Fatalf("error seeding the database. got %s", err.Error())
+			}
 		}
 	}
 }
 
+// InitAudit opens the audit log of the officer data accesses.
+func InitAudit() {
+	if Audit == nil {
+		switch ConfigGet("audit.log") {
+		case "mongodb":
+			logrus.Warnf("Audit log using MongoDB")
+			Audit = NewMongoDBAuditLog(ConfigGet("mongo.database"), ConfigGet("mongo.host"), ConfigGetInt("mongo.port"), ConfigGet("mongo.user"), ConfigGet("mongo.password"))
+		case "file":
+			logrus.Warnf("Audit log using file %s", ConfigGet("audit.file.path"))
+			Audit = NewFileAuditLog(ConfigGet("audit.file.path"))
+		default:
+			logrus.Warnf("Audit log using InMemory. Next server restart will clear the audit records.")
+			Audit = NewInMemoryAuditLog()
+		}
+	}
+}
+
+// recordAudit appends rec to the audit log on behalf of the caller of r. An access which can not be
+// recorded must not be served, on error the handler answers auditFailed instead.
+func recordAudit(r *http.Request, rec *AuditRecord) error {
+	rec.Actor = PrincipalFromContext(r.Context()).Name()
+	err := Audit.Append(r.Context(), rec)
+	if err != nil {
+		logrus.Errorf("audit %s of %s got %s", rec.Action, rec.Actor, err.Error())
+	}
+	return err
+}
+
+func auditFailed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("audit log unavailable"))
+}
+
 func registerUid(w http.ResponseWriter, r *http.Request) {
 	uid := r.URL.Query().Get("uid")
 	if len(uid) != UID_SIZE {
@@ -69,15 +151,8 @@ func registerUid(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("{\"status\":\"FAIL\""))
 		return
 	}
-	secret := r.URL.Query().Get("secret")
-	_, err := Tracing.GetOfficerID(r.Context(), secret)
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("{\"status\":\"FAIL\""))
-		return
-	}
 
-	err = Tracing.RegisterNewUser(r.Context(), uid, pin)
+	err := Tracing.RegisterNewUser(r.Context(), uid, pin)
 	if err != nil {
 		logrus.Errorf("registerUid: got %s", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -88,52 +163,168 @@ func registerUid(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("{\"status\":\"SUCCESS\"}"))
 }
 
-func getHandshakePin(w http.ResponseWriter, r *http.Request) {
+type VerifyHandshakePinResponse struct {
+	Status string `json:"status"`
+}
+
+// verifyHandshakePin lets an officer check the handshake PIN a user reads out, PINs are only stored hashed
+// so they can no longer be handed out.
+func verifyHandshakePin(w http.ResponseWriter, r *http.Request) {
+	writeStatus := func(code int, status string) {
+		respBytes, _ := json.Marshal(&VerifyHandshakePinResponse{Status: status})
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(respBytes)
+	}
 	uid := r.URL.Query().Get("uid")
 	if len(uid) != UID_SIZE {
-		logrus.Errorf("getHandshakePin: uid %s < %d characters", uid, UID_SIZE)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"status\":\"FAIL\""))
+		logrus.Errorf("verifyHandshakePin: uid %s < %d characters", uid, UID_SIZE)
+		writeStatus(http.StatusBadRequest, "FAIL")
 		return
 	}
-	logrus.Infof("getHandshakePin: uid %s", uid)
+	pin := r.URL.Query().Get("pin")
+	if len(pin) == 0 {
+		logrus.Errorf("verifyHandshakePin: empty pin")
+		writeStatus(http.StatusBadRequest, "FAIL")
+		return
+	}
+	logrus.Infof("verifyHandshakePin: uid %s by officer %s", uid, PrincipalFromContext(r.Context()).OID)
 
-	pin, err := Tracing.GetHandshakePIN(r.Context(), uid)
-	if err != nil {
-		if errors.Is(err, ErrUIDNotFound) {
-			w.Header().Add("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("uid specified not found"))
+	err := Tracing.VerifyHandshakePIN(r.Context(), uid, pin)
+	switch {
+	case err == nil:
+		writeStatus(http.StatusOK, "SUCCESS")
+	case errors.Is(err, ErrUIDNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("uid specified not found"))
+	case errors.Is(err, ErrPINNotValid):
+		writeStatus(http.StatusForbidden, "FAIL")
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// registerOfficer reads oid, secret and the optional comma separated roles from the query or, with POST,
+// from the form body which keeps the secret out of URLs.
+func registerOfficer(w http.ResponseWriter, r *http.Request) {
+	oid := r.FormValue("oid")
+	secret := r.FormValue("secret")
+	var roles []string
+	if sRoles := r.FormValue("roles"); len(sRoles) > 0 {
+		var err error
+		if roles, err = ParseRoles(sRoles); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
 			return
 		}
-		w.Header().Add("Content-Type", "application/json")
+	}
+
+	if len(oid) == 0 || len(secret) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing oid or secret"))
+		return
+	}
+
+	if err := recordAudit(r, &AuditRecord{Action: AuditRegisterOfficer, OID: oid, Detail: strings.Join(roles, ",")}); err != nil {
+		auditFailed(w)
+		return
+	}
+	err := Tracing.RegisterNewOfficer(r.Context(), oid, secret)
+	if err == nil && len(roles) > 0 {
+		err = Tracing.SetOfficerRoles(r.Context(), oid, roles)
+	}
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("{\"status\":\"SUCCESS\", \"pin\":\"%s\"}", pin)))
+	w.Write([]byte("{\"status\":\"SUCCESS\"}"))
 }
 
-func registerOfficer(w http.ResponseWriter, r *http.Request) {
-	adminpassword := r.URL.Query().Get("pass")
-	oid := r.URL.Query().Get("oid")
-	secret := r.URL.Query().Get("secret")
+// DeletionReceipt is the response of /deleteUid, to keep as the proof of an erasure. AuditSeq and AuditHash
+// locate the deleteUser record appended to the audit log before the erasure, whose chain shows the receipt
+// was not made up afterward.
+type DeletionReceipt struct {
+	Status    string `json:"status"`
+	ReceiptID string `json:"receiptId"`
+	UID       string `json:"uid"`
+	DeletedAt int64  `json:"deletedAt"`
+	DeletedBy string `json:"deletedBy"`
+	*UserDeletion
+	AuditSeq  int64  `json:"auditSeq"`
+	AuditHash string `json:"auditHash"`
+}
 
-	if adminpassword != ConfigGet("adminpassword") {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("unauthorized"))
+// deleteUser erases the uid of the form, its traces, the traces it appears in as contact and its upload tokens.
+// Erasing an unknown uid succeeds with nothing deleted, so a request can be repeated.
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	uid := r.FormValue("uid")
+	if len(uid) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing uid"))
+		return
+	}
+	receiptID := make([]byte, UploadTokenLength)
+	if _, err := rand.Read(receiptID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	if len(oid) == 0 || len(secret) == 0 {
+	receipt := &DeletionReceipt{
+		Status:    "SUCCESS",
+		ReceiptID: hex.EncodeToString(receiptID),
+		UID:       uid,
+		DeletedBy: PrincipalFromContext(r.Context()).Name(),
+	}
+	rec := &AuditRecord{
+		Action: AuditDeleteUser,
+		UID:    uid,
+		Detail: fmt.Sprintf("receipt %s", receipt.ReceiptID),
+	}
+	if err := recordAudit(r, rec); err != nil {
+		auditFailed(w)
+		return
+	}
+	deletion, err := Tracing.DeleteUser(r.Context(), uid)
+	if err != nil {
+		logrus.Errorf("deleteUser: uid %s receipt %s got %s", uid, receipt.ReceiptID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	receipt.UserDeletion = deletion
+	receipt.DeletedAt = rec.Timestamp
+	receipt.AuditSeq = rec.Seq
+	receipt.AuditHash = rec.Hash
+	logrus.Infof("deleteUser: uid %s erased by %s, receipt %s, user %t, %d traces, %d contact traces, %d upload tokens",
+		uid, receipt.DeletedBy, receipt.ReceiptID, deletion.User, deletion.Traces, deletion.ContactTraces, deletion.UploadTokens)
+
+	respJson, _ := json.Marshal(receipt)
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("cache-control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+func deleteOfficer(w http.ResponseWriter, r *http.Request) {
+	oid := r.URL.Query().Get("oid")
+
+	if len(oid) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("missing oid or secret"))
 		return
 	}
 
-	err := Tracing.RegisterNewOfficer(r.Context(), oid, secret)
+	if err := recordAudit(r, &AuditRecord{Action: AuditDeleteOfficer, OID: oid}); err != nil {
+		auditFailed(w)
+		return
+	}
+	err := Tracing.DeleteOfficer(r.Context(), oid)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -145,46 +336,435 @@ func registerOfficer(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("{\"status\":\"SUCCESS\"}"))
 }
 
-func deleteOfficer(w http.ResponseWriter, r *http.Request) {
-	adminpassword := r.URL.Query().Get("pass")
+type OfficerRolesResponse struct {
+	Status string   `json:"status"`
+	OID    string   `json:"oid"`
+	Roles  []string `json:"roles"`
+}
+
+func getOfficerRoles(w http.ResponseWriter, r *http.Request) {
 	oid := r.URL.Query().Get("oid")
+	if len(oid) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing oid"))
+		return
+	}
+	off, err := Tracing.GetOfficer(r.Context(), oid)
+	if errors.Is(err, ErrOfficerNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	respJson, _ := json.Marshal(&OfficerRolesResponse{Status: "SUCCESS", OID: oid, Roles: off.EffectiveRoles()})
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
 
-	if adminpassword != ConfigGet("adminpassword") {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("unauthorized"))
+// setOfficerRoles replaces the roles of an officer with the comma separated roles of the form.
+// Officer sessions get the new roles on their next refresh.
+func setOfficerRoles(w http.ResponseWriter, r *http.Request) {
+	oid := r.FormValue("oid")
+	roles, err := ParseRoles(r.FormValue("roles"))
+	if err != nil || len(oid) == 0 || len(roles) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing oid or roles, roles are admin, tracer, auditor or uploader"))
+		return
+	}
+	if !officerExists(w, r, oid) {
+		return
+	}
+	if err := recordAudit(r, &AuditRecord{Action: AuditSetOfficerRoles, OID: oid, Detail: strings.Join(roles, ",")}); err != nil {
+		auditFailed(w)
+		return
+	}
+	err = Tracing.SetOfficerRoles(r.Context(), oid, roles)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logrus.Infof("officer %s roles set to %s by %s", oid, strings.Join(roles, ","), PrincipalFromContext(r.Context()).Name())
+	respJson, _ := json.Marshal(&OfficerRolesResponse{Status: "SUCCESS", OID: oid, Roles: roles})
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+// OfficerInfo is what the admin endpoints tell about an officer, never its secret.
+type OfficerInfo struct {
+	OID        string   `json:"oid"`
+	Roles      []string `json:"roles"`
+	Disabled   bool     `json:"disabled"`
+	CreatedAt  int64    `json:"createdAt,omitempty"`
+	LastUsedAt int64    `json:"lastUsedAt,omitempty"`
+}
+
+func officerInfo(off *Officer) *OfficerInfo {
+	return &OfficerInfo{
+		OID:        off.OID,
+		Roles:      off.EffectiveRoles(),
+		Disabled:   off.Disabled,
+		CreatedAt:  off.CreatedAt,
+		LastUsedAt: off.LastUsedAt,
+	}
+}
+
+type OfficersResponse struct {
+	Status   string         `json:"status"`
+	Officers []*OfficerInfo `json:"officers"`
+}
+
+type OfficerResponse struct {
+	Status string `json:"status"`
+	*OfficerInfo
+}
+
+type RotateSecretResponse struct {
+	Status string `json:"status"`
+	OID    string `json:"oid"`
+	Secret string `json:"secret,omitempty"`
+}
+
+func listOfficers(w http.ResponseWriter, r *http.Request) {
+	officers, err := Tracing.ListOfficers(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	resp := &OfficersResponse{Status: "SUCCESS", Officers: make([]*OfficerInfo, 0, len(officers))}
+	for _, off := range officers {
+		resp.Officers = append(resp.Officers, officerInfo(off))
+	}
+	respJson, _ := json.Marshal(resp)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+// officerExists tells whether the officer oid is registered, otherwise it answers 404, or 500 if the storage failed,
+// so a change of an unknown officer is refused before it is audited.
+func officerExists(w http.ResponseWriter, r *http.Request, oid string) bool {
+	_, err := Tracing.GetOfficer(r.Context(), oid)
+	if errors.Is(err, ErrOfficerNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	return true
+}
+
+// writeOfficer answers with the officer oid as it is stored now.
+func writeOfficer(w http.ResponseWriter, r *http.Request, oid string) {
+	off, err := Tracing.GetOfficer(r.Context(), oid)
+	if errors.Is(err, ErrOfficerNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	respJson, _ := json.Marshal(&OfficerResponse{Status: "SUCCESS", OfficerInfo: officerInfo(off)})
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+func getOfficer(w http.ResponseWriter, r *http.Request) {
+	oid := r.URL.Query().Get("oid")
+	if len(oid) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing oid"))
+		return
+	}
+	writeOfficer(w, r, oid)
+}
+
+// updateOfficer sets the comma separated roles and or the disabled flag of the form.
+// A disabled officer can not log in, refresh its session or use its secret, the access tokens
+// it already holds stay valid until they expire.
+func updateOfficer(w http.ResponseWriter, r *http.Request) {
+	oid := r.FormValue("oid")
+	sRoles, sDisabled := r.FormValue("roles"), r.FormValue("disabled")
+	if len(oid) == 0 || (len(sRoles) == 0 && len(sDisabled) == 0) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing oid, or roles and disabled"))
+		return
+	}
+	update := &OfficerUpdate{}
+	details := make([]string, 0, 2)
+	if len(sRoles) > 0 {
+		roles, err := ParseRoles(sRoles)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		update.Roles = roles
+		details = append(details, "roles "+strings.Join(roles, ","))
+	}
+	if len(sDisabled) > 0 {
+		disabled, err := strconv.ParseBool(sDisabled)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("disabled is true or false"))
+			return
+		}
+		update.Disabled = &disabled
+		details = append(details, fmt.Sprintf("disabled %t", disabled))
+	}
+	if !officerExists(w, r, oid) {
+		return
+	}
+
+	if err := recordAudit(r, &AuditRecord{Action: AuditUpdateOfficer, OID: oid, Detail: strings.Join(details, ", ")}); err != nil {
+		auditFailed(w)
+		return
+	}
+	err := Tracing.UpdateOfficer(r.Context(), oid, update)
+	if errors.Is(err, ErrOfficerNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 		return
 	}
+	logrus.Infof("officer %s updated, %s, by %s", oid, strings.Join(details, ", "), PrincipalFromContext(r.Context()).Name())
+	writeOfficer(w, r, oid)
+}
 
+// rotateOfficerSecret replaces the secret of an officer with the one of the form, or with a generated one
+// which is answered once. The refresh tokens of the officer stop working.
+func rotateOfficerSecret(w http.ResponseWriter, r *http.Request) {
+	oid := r.FormValue("oid")
+	secret := r.FormValue("secret")
 	if len(oid) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("missing oid or secret"))
+		w.Write([]byte("missing oid"))
 		return
 	}
+	resp := &RotateSecretResponse{Status: "SUCCESS", OID: oid}
+	if len(secret) == 0 {
+		generated := make([]byte, UploadTokenLength)
+		if _, err := rand.Read(generated); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		secret = base64.RawURLEncoding.EncodeToString(generated)
+		resp.Secret = secret
+	}
 
-	err := Tracing.DeleteOfficer(r.Context(), oid)
+	if !officerExists(w, r, oid) {
+		return
+	}
+	if err := recordAudit(r, &AuditRecord{Action: AuditRotateSecret, OID: oid}); err != nil {
+		auditFailed(w)
+		return
+	}
+	err := Tracing.RotateOfficerSecret(r.Context(), oid, secret)
+	if errors.Is(err, ErrOfficerNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	logrus.Infof("officer %s secret rotated by %s", oid, PrincipalFromContext(r.Context()).Name())
+	respJson, _ := json.Marshal(resp)
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("cache-control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+// keyRotationSchedulable tells whether a rotation scheduled at runtime applies to every server. The schedule
+// is only kept in the memory of the server receiving it, so it is refused unless that server holds the whole
+// database in memory and keeps nothing across restarts.
+func keyRotationSchedulable() bool {
+	switch ConfigGet("database") {
+	case "mongodb", "postgres", "bolt":
+		return false
+	}
+	return len(ConfigGet("inmemory.snapshot.path")) == 0
+}
+
+// scheduleKeyRotation schedules a rotation of the keyring of this server, see keyRotationSchedulable.
+// Other deployments schedule it with the tempid.keyring.rotate.* keys of every server.
+func scheduleKeyRotation(w http.ResponseWriter, r *http.Request) {
+	if !keyRotationSchedulable() {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("a rotation scheduled at runtime is lost on restart and not shared with other servers, set tempid.keyring.rotate.id and tempid.keyring.rotate.at on every server instead"))
+		return
+	}
+	sID := r.URL.Query().Get("id")
+	sAt := r.URL.Query().Get("at")
+	sRetireAfterHour := r.URL.Query().Get("retireAfterHour")
+
+	id, err := parseKeyID(sID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	at := time.Now()
+	if len(sAt) > 0 {
+		at, err = time.Parse(time.RFC3339, sAt)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid at format, expect RFC3339"))
+			return
+		}
+	}
+	retireAfterHour := 0
+	if len(sRetireAfterHour) > 0 {
+		retireAfterHour, err = strconv.Atoi(sRetireAfterHour)
+		if err != nil || retireAfterHour < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid retireAfterHour format"))
+			return
+		}
+	}
+
+	err = CryptKeys.ScheduleRotation(id, at, time.Duration(retireAfterHour)*time.Hour)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{\"status\":\"SUCCESS\"}"))
 }
 
+type TempIDPolicyResponse struct {
+	Status string `json:"status"`
+	*TempIDPolicy
+}
+
+func getTempIDPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := CurrentTempIDPolicy(r.Context(), Tracing)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	respJson, _ := json.Marshal(&TempIDPolicyResponse{Status: "SUCCESS", TempIDPolicy: policy})
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+// updateTempIDPolicyFromForm sets the periodMinute, overlapSecond, batchSize, refreshLeadMinute and align
+// of the form into policy, missing ones are kept. A refresh lead never set follows the new period and batch size.
+func updateTempIDPolicyFromForm(r *http.Request, policy *TempIDPolicy) error {
+	for name, value := range map[string]*int{
+		"periodMinute":      &policy.PeriodMinute,
+		"overlapSecond":     &policy.OverlapSecond,
+		"batchSize":         &policy.BatchSize,
+		"refreshLeadMinute": &policy.RefreshLeadMinute,
+	} {
+		if sValue := r.FormValue(name); len(sValue) > 0 {
+			i, err := strconv.Atoi(sValue)
+			if err != nil {
+				return fmt.Errorf("invalid %s format", name)
+			}
+			*value = i
+		}
+	}
+	if sAlign := r.FormValue("align"); len(sAlign) > 0 {
+		align, err := strconv.ParseBool(sAlign)
+		if err != nil {
+			return fmt.Errorf("align is true or false")
+		}
+		policy.Align = align
+	}
+	if len(r.FormValue("refreshLeadMinute")) > 0 {
+		policy.RefreshLeadDefault = false
+	} else if policy.RefreshLeadDefault {
+		policy.DefaultRefreshLead()
+	}
+	return policy.Validate()
+}
+
+// setTempIDPolicy changes the TempIDPolicy in force with the fields of the form, see updateTempIDPolicyFromForm.
+// The policy is stored, every server sharing the storage issues the next batches with it, also after a restart.
+// reset=true drops the stored policy instead, to go back to the configured one.
+func setTempIDPolicy(w http.ResponseWriter, r *http.Request) {
+	reset := r.FormValue("reset") == "true"
+	var policy *TempIDPolicy
+	var detail string
+	if reset {
+		policy = ConfiguredTempIDPolicy()
+		policyJson, _ := json.Marshal(policy)
+		detail = "reset to the configured " + string(policyJson)
+	} else {
+		var err error
+		if policy, err = CurrentTempIDPolicy(r.Context(), Tracing); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := updateTempIDPolicyFromForm(r, policy); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		policyJson, _ := json.Marshal(policy)
+		detail = string(policyJson)
+	}
+
+	if err := recordAudit(r, &AuditRecord{Action: AuditSetTempIDPolicy, Detail: detail}); err != nil {
+		auditFailed(w)
+		return
+	}
+	stored := policy
+	if reset {
+		stored = nil
+	}
+	if err := Tracing.SetTempIDPolicy(r.Context(), stored); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logrus.Infof("tempid policy set to %s by %s", detail, PrincipalFromContext(r.Context()).Name())
+	getTempIDPolicy(w, r)
+}
+
 type TempIDResponse struct {
-	Status      string    `json:"status"`
-	TempIDs     []*TempID `json:"tempIDs"`
-	RefreshTime uint32    `json:"refreshTime"`
+	Status      string        `json:"status"`
+	TempIDs     []*TempID     `json:"tempIDs"`
+	RefreshTime uint32        `json:"refreshTime"`
+	DeviceToken string        `json:"deviceToken,omitempty"` // to send as Bearer token on the next request
+	Policy      *TempIDPolicy `json:"policy"`
 }
 
 func purgeTracing(w http.ResponseWriter, r *http.Request) {
-	secret := r.URL.Query().Get("secret")
 	sAgeHour := r.URL.Query().Get("ageHour")
-	if len(secret) == 0 || len(sAgeHour) == 0 {
+	if len(sAgeHour) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("missing secret or ageHour parameter"))
+		w.Write([]byte("missing ageHour parameter"))
 		return
 	}
 	ageHour, err := strconv.ParseInt(sAgeHour, 10, 64)
@@ -197,40 +777,166 @@ func purgeTracing(w http.ResponseWriter, r *http.Request) {
 	age := time.Duration(ageHour) * time.Hour
 	oldest := time.Now().Add(-age)
 
-	_, err = Tracing.GetOfficerID(r.Context(), secret)
+	if err := recordAudit(r, &AuditRecord{Action: AuditPurgeTracing, Detail: fmt.Sprintf("older than %d", oldest.Unix())}); err != nil {
+		auditFailed(w)
+		return
+	}
+	purged, err := Tracing.PurgeOldTraceData(r.Context(), oldest.Unix())
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("invalid secret format"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid uploadToken format"))
+		return
+	}
+	logrus.Infof("purgeTracing: %d traces older than %d purged by %s", purged, oldest.Unix(), PrincipalFromContext(r.Context()).Name())
+	err = Tracing.PurgeUploadTokens(r.Context(), time.Now().Unix())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{\"status\":\"SUCCESS\"}"))
+}
+
+// TempIDFailResponse tells the app why no TempIDs were issued.
+type TempIDFailResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+func tempIDFailed(w http.ResponseWriter, code int, reason string) {
+	respJson, _ := json.Marshal(&TempIDFailResponse{Status: "FAIL", Error: reason})
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respJson)
+}
+
+// tempIDThrottled answers 429 with the Retry-After header.
+func tempIDThrottled(w http.ResponseWriter, retryAfter time.Duration, reason string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	tempIDFailed(w, http.StatusTooManyRequests, reason)
+}
+
+// clientAddress is the IP address the request comes from, a proxy in front of the server shows as a single client.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getTempIDs issues TempIDs to a registered user, which proves it with the uid and pin of the POST form,
+// or with the device token of a previous issuance as Bearer token. Every issuance answers a new device token.
+// Failed proofs are throttled per client address and, for pins, per uid by TempIDProofThrottle, an unknown uid
+// fails as a wrong pin does so uids can not be probed. Issuances are throttled per uid by TempIDThrottle once
+// proven. While tempid.auth.required is false, a registered uid without proof is still served.
+func getTempIDs(w http.ResponseWriter, r *http.Request) {
+	client := "client " + clientAddress(r)
+	if exceeded, retryAfter := TempIDProofThrottle.Exceeded(client); exceeded {
+		tempIDThrottled(w, retryAfter, "too many failed proofs from this client")
+		return
+	}
+	uid := r.FormValue("uid")
+	pin := r.PostFormValue("pin")
+	var device *SessionClaims
+	// proofFailed counts a failed proof against the client, and against the uid unless a device token was sent,
+	// so guessing pins does not lock out the device holding a valid token.
+	proofFailed := func(code int, reason string) {
+		TempIDProofThrottle.Allow(client)
+		if device == nil && len(uid) > 0 {
+			TempIDProofThrottle.Allow("uid " + uid)
+		}
+		tempIDFailed(w, code, reason)
+	}
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		claims, err := ParseSessionToken(strings.TrimSpace(authorization[len("bearer "):]), SessionTokenDevice, CryptKeys)
+		switch {
+		case errors.Is(err, ErrSessionTokenExpired):
+			tempIDFailed(w, http.StatusUnauthorized, "device token expired")
+			return
+		case err != nil:
+			TempIDProofThrottle.Allow(client)
+			tempIDFailed(w, http.StatusUnauthorized, "device token not valid")
+			return
+		case len(uid) > 0 && uid != claims.Subject:
+			tempIDFailed(w, http.StatusUnauthorized, "device token of another uid")
+			return
+		}
+		uid = claims.Subject
+		device = claims
+	}
+	if len(uid) != UID_SIZE {
+		tempIDFailed(w, http.StatusBadRequest, fmt.Sprintf("uid must be %d characters", UID_SIZE))
+		return
+	}
+	legacy := device == nil && len(pin) == 0
+	if legacy && ConfigGetBoolean("tempid.auth.required") {
+		tempIDFailed(w, http.StatusUnauthorized, "pin or device token required")
+		return
+	}
+	if device == nil {
+		if exceeded, retryAfter := TempIDProofThrottle.Exceeded("uid " + uid); exceeded {
+			tempIDThrottled(w, retryAfter, "too many failed proofs for this uid")
+			return
+		}
+	}
+
+	user, err := Tracing.GetUser(r.Context(), uid)
+	if errors.Is(err, ErrUIDNotFound) {
+		proofFailed(http.StatusForbidden, "uid or pin not valid")
+		return
+	}
+	if err != nil {
+		logrus.Errorf("getTempIDs: uid %s got %s", uid, err.Error())
+		tempIDFailed(w, http.StatusInternalServerError, "storage error")
+		return
+	}
+	switch {
+	case device != nil:
+		if !hmac.Equal([]byte(device.SecretVersion), []byte(pinVersion(user))) {
+			tempIDFailed(w, http.StatusUnauthorized, "device token not valid, the uid was registered again")
+			return
+		}
+	case !legacy:
+		if !verifySecret(user.PINHash, pin) {
+			proofFailed(http.StatusForbidden, "uid or pin not valid")
+			return
+		}
+	default:
+		logrus.Warnf("getTempIDs: uid %s served without pin or device token, this is deprecated", uid)
+		w.Header().Set("Deprecation", "true")
+	}
+	if allowed, retryAfter := TempIDThrottle.Allow(uid); !allowed {
+		tempIDThrottled(w, retryAfter, "too many requests for this uid")
 		return
 	}
 
-	err = Tracing.PurgeOldTraceData(r.Context(), oldest.Unix())
+	policy, err := CurrentTempIDPolicy(r.Context(), Tracing)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("invalid uploadToken format"))
+		logrus.Errorf("getTempIDs: tempid policy got %s", err.Error())
+		tempIDFailed(w, http.StatusInternalServerError, "storage error")
 		return
 	}
-
-	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("{\"status\":\"SUCCESS\"}"))
-}
-
-func getTempIDs(w http.ResponseWriter, r *http.Request) {
-	uid := r.URL.Query().Get("uid")
-
-	tempIds, err := GenerateTempIDs(uid)
-	if err != nil && err == ErrInvalidTempIDLength {
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{\"status\":\"FAIL\"}"))
+	now := time.Now()
+	tempIds, err := GenerateTempIDs(uid, policy, now)
+	if err != nil {
+		tempIDFailed(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-
 	resp := &TempIDResponse{
 		Status:      "SUCCESS",
 		TempIDs:     tempIds,
-		RefreshTime: uint32(time.Now().Unix() + 3600*24),
+		RefreshTime: policy.RefreshTime(now),
+		Policy:      policy,
+	}
+	if !legacy {
+		if resp.DeviceToken, err = NewDeviceToken(user, CryptKeys); err != nil {
+			tempIDFailed(w, http.StatusInternalServerError, err.Error())
+			return
+		}
 	}
 	respJson, err := json.Marshal(resp)
 	if err != nil {
@@ -245,37 +951,63 @@ func getTempIDs(w http.ResponseWriter, r *http.Request) {
 
 func getUploadToken(w http.ResponseWriter, r *http.Request) {
 	uid := r.URL.Query().Get("uid")
-	secret := r.URL.Query().Get("secret")
+	oid := PrincipalFromContext(r.Context()).OID
 
 	if len(uid) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Missing 'uid' param"))
 		return
 	}
-	if len(secret) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Missing 'data' param"))
+
+	ut, err := NewUploadToken(uid, oid, 1)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
 		return
 	}
-
-	oid, err := Tracing.GetOfficerID(r.Context(), secret)
+	tok, err := ut.ToToken(CryptKeys)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("secret not valid"))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := recordAudit(r, &AuditRecord{Action: AuditGetUploadToken, UID: uid, Records: 1, Detail: ut.ID}); err != nil {
+		auditFailed(w)
+		return
+	}
+	err = Tracing.RegisterUploadToken(r.Context(), ut)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("{\"status\":\"SUCCESS\", \"token\":\"%s\", \"jti\":\"%s\"}", tok, ut.ID)))
+}
+
+// revokeUploadToken revokes the upload tokens issued by the calling officer, the administrator has none.
+func revokeUploadToken(w http.ResponseWriter, r *http.Request) {
+	jti := r.URL.Query().Get("jti")
+	oid := PrincipalFromContext(r.Context()).OID
+	if len(oid) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("only officers revoke the upload tokens they issued"))
 		return
 	}
 
-	ut := NewUploadToken(uid, oid, 1)
-	tok, err := ut.ToToken([]byte(ENCRYPTIONKEY))
+	revoked, err := Tracing.RevokeUploadTokens(r.Context(), oid, jti)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	logrus.Infof("officer %s revoked %d upload tokens", oid, revoked)
 
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("{\"status\":\"SUCCESS\", \"token\":\"%s\"}", tok)))
+	w.Write([]byte(fmt.Sprintf("{\"status\":\"SUCCESS\", \"revoked\":%d}", revoked)))
 }
 
 func uploadData(w http.ResponseWriter, r *http.Request) {
@@ -297,7 +1029,7 @@ func uploadData(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// validate the token
-	ut, err := NewUploadTokenFromString(upload.UploadToken, []byte(ENCRYPTIONKEY))
+	ut, err := NewUploadTokenFromString(upload.UploadToken, CryptKeys)
 	if err != nil {
 		logrus.Error(err.Error())
 		w.WriteHeader(http.StatusBadRequest)
@@ -305,41 +1037,49 @@ func uploadData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !ut.IsValid() {
-		logrus.Error(err.Error())
+		logrus.Errorf("upload token of uid %s expired", ut.UID)
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte("upload token expired"))
 		return
 	}
+	if upload.UID != ut.UID {
+		logrus.Errorf("upload token of uid %s used to upload for uid %s", ut.UID, upload.UID)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("upload token not issued for this uid"))
+		return
+	}
 
-	traces := make([]*TraceData, 0)
+	traces, results, rejected := ValidateUploadRecords(upload, CryptKeys)
+	if rejected > 0 && !ConfigGetBoolean("upload.partial.accept") {
+		logrus.Errorf("uploadData: %d of %d records of uid %s rejected, discarding the upload", rejected, len(upload.Traces), upload.UID)
+		writeUploadResponse(w, http.StatusBadRequest, &UploadResponse{Status: "FAIL", Records: results})
+		return
+	}
 
-	for _, tr := range upload.Traces {
-		TempID := tr.Message
-		uid, start, exp, err := GetTempIDData([]byte(ENCRYPTIONKEY), TempID)
-		if err != nil {
-			logrus.Error(err.Error())
-			w.WriteHeader(http.StatusBadRequest)
+	err = Tracing.ConsumeUploadToken(r.Context(), ut.ID)
+	if err != nil {
+		logrus.Errorf("upload token %s of uid %s can not be used. got %s", ut.ID, ut.UID, err.Error())
+		switch {
+		case errors.Is(err, ErrTokenConsumed):
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("upload token already used"))
+		case errors.Is(err, ErrTokenRevoked):
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("upload token revoked"))
+		case errors.Is(err, ErrTokenNotFound), errors.Is(err, ErrInvalidParameter):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("upload token not found"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
-			return
-		}
-
-		logrus.Tracef("todo to check if tr.Timestamp %d is between %d and %d", tr.Timestamp, start, exp)
-		// todo Make sure the tr.Timestamp is within start and exp
-
-		td := &TraceData{
-			CUID:      uid,
-			Timestamp: tr.Timestamp,
-			ModelC:    tr.ModelC,
-			ModelP:    tr.ModelP,
-			RSSI:      tr.RSSI,
-			TxPower:   tr.TxPower,
-			Org:       tr.Org,
 		}
-
-		traces = append(traces, td)
+		return
 	}
 
-	err = Tracing.SaveTraceData(r.Context(), upload.UID, ut.OID, traces)
+	saved, duplicates, err := Tracing.SaveTraceData(r.Context(), ut.UID, ut.OID, traces)
+	if err != nil {
+		releaseUploadToken(r, ut)
+	}
 	if err != nil && (errors.Is(err, ErrUIDNotFound) || errors.Is(err, ErrTokenNotFound)) {
 		logrus.Error(err.Error())
 		w.WriteHeader(http.StatusNotFound)
@@ -354,55 +1094,272 @@ func uploadData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = Forwarder.ForwardTraceData(upload.UID, traces)
+	// duplicates were forwarded with the upload that saved them
+	err = Forwarder.ForwardTraceData(ut.UID, saved)
 	if err != nil {
 		logrus.Errorf("forwarder error. got %s", err.Error())
+		releaseUploadToken(r, ut)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("{\"status\":\"SUCCESS\"}"))
+	writeUploadResponse(w, http.StatusOK, &UploadResponse{
+		Status:     "SUCCESS",
+		Inserted:   len(saved),
+		Duplicates: duplicates,
+		Records:    results,
+	})
+}
+
+// releaseUploadToken lets the app retry an upload with ut after it failed on our side.
+// A failure to release is only logged, the app then has to ask for a new upload token.
+func releaseUploadToken(r *http.Request, ut *UploadToken) {
+	if err := Tracing.ReleaseUploadToken(r.Context(), ut.ID); err != nil {
+		logrus.Errorf("upload token %s of uid %s can not be released. got %s", ut.ID, ut.UID, err.Error())
+	}
 }
 
 type TracingResponse struct {
 	Status  string       `json:"status"`
 	Tracing []*TraceData `json:"trace"`
+	Next    string       `json:"next,omitempty"`
+}
+
+// traceFilterFromRequest builds the TraceFilter for uid out of the optional from, to, minRssi, cuid, oid and org query parameters.
+func traceFilterFromRequest(r *http.Request, uid string) (*TraceFilter, error) {
+	query := r.URL.Query()
+	filter := &TraceFilter{
+		UID:  uid,
+		CUID: query.Get("cuid"),
+		OID:  query.Get("oid"),
+		Org:  query.Get("org"),
+	}
+	var err error
+	if sFrom := query.Get("from"); len(sFrom) > 0 {
+		if filter.From, err = strconv.ParseInt(sFrom, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w : invalid from timestamp", ErrInvalidParameter)
+		}
+	}
+	if sTo := query.Get("to"); len(sTo) > 0 {
+		if filter.To, err = strconv.ParseInt(sTo, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w : invalid to timestamp", ErrInvalidParameter)
+		}
+	}
+	if sMinRSSI := query.Get("minRssi"); len(sMinRSSI) > 0 {
+		minRSSI, err := strconv.Atoi(sMinRSSI)
+		if err != nil {
+			return nil, fmt.Errorf("%w : invalid minRssi", ErrInvalidParameter)
+		}
+		filter.MinRSSI = &minRSSI
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, fmt.Errorf("%w : missing uid or from is after to", err)
+	}
+	return filter, nil
 }
 
+// getTracing returns the traces uploaded by uid, optionally narrowed down with the parameters of traceFilterFromRequest.
+// Without pageSize all traces are returned at once. With pageSize a single page is returned together with
+// the cursor of the next one. With format=ndjson every trace is streamed as one JSON line, page by page.
 func getTracing(w http.ResponseWriter, r *http.Request) {
 	uid := r.URL.Query().Get("uid")
-	secret := r.URL.Query().Get("secret")
-	_, err := Tracing.GetOfficerID(r.Context(), secret)
+	filter, err := traceFilterFromRequest(r, uid)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("invalid secret"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	pageSize := 0
+	if sPageSize := r.URL.Query().Get("pageSize"); len(sPageSize) > 0 {
+		pageSize, err = strconv.Atoi(sPageSize)
+		if err != nil || pageSize <= 0 || pageSize > ConfigGetInt("tracing.page.size.max") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("pageSize must be between 1 and %d", ConfigGetInt("tracing.page.size.max"))))
+			return
+		}
+	}
+	cursor := r.URL.Query().Get("cursor")
+
+	if r.URL.Query().Get("format") == "ndjson" {
+		if pageSize == 0 {
+			pageSize = ConfigGetInt("tracing.page.size.max")
+		}
+		// the number of traces is not known before they are streamed, it is recorded once the stream ends
+		opening := &AuditRecord{Action: AuditGetTracing, UID: uid, Detail: "ndjson"}
+		if err := recordAudit(r, opening); err != nil {
+			auditFailed(w)
+			return
+		}
+		streamed := streamTracing(w, r, filter, cursor, pageSize)
+		logrus.Debugf("getTracing: %d traces of %s streamed", streamed, uid)
+		// the client may be gone already, the record must still be appended
+		completion := &AuditRecord{Action: AuditGetTracingStreamed, Actor: opening.Actor, UID: uid, Records: streamed,
+			Detail: fmt.Sprintf("ndjson of record %d", opening.Seq)}
+		if err := Audit.Append(context.Background(), completion); err != nil {
+			logrus.Errorf("audit %s of %s got %s", completion.Action, completion.Actor, err.Error())
+		}
+		return
+	}
+
+	tr := &TracingResponse{
+		Status: "SUCCESS",
+	}
+	if pageSize == 0 {
+		tr.Tracing, err = queryAllTraceData(r.Context(), filter)
+	} else {
+		tr.Tracing, tr.Next, err = Tracing.QueryTraceData(r.Context(), filter, cursor, pageSize)
+	}
+	if err != nil {
+		traceQueryFailed(w, err)
 		return
 	}
-	tdata, err := Tracing.GetTraceData(r.Context(), uid)
+	if err := recordAudit(r, &AuditRecord{Action: AuditGetTracing, UID: uid, Records: len(tr.Tracing)}); err != nil {
+		auditFailed(w)
+		return
+	}
+	respBytes, _ := json.Marshal(tr)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+type ContactEpisodesResponse struct {
+	Status   string            `json:"status"`
+	Episodes []*ContactEpisode `json:"episodes"`
+}
+
+// episodeOptionsFromRequest reads the optional gapSecond and minDurationSecond query parameters over the episode.* keys.
+func episodeOptionsFromRequest(r *http.Request) (*EpisodeOptions, error) {
+	opts := NewEpisodeOptionsFromConfig()
+	var err error
+	if sGap := r.URL.Query().Get("gapSecond"); len(sGap) > 0 {
+		if opts.GapSecond, err = strconv.ParseInt(sGap, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w : invalid gapSecond", ErrInvalidParameter)
+		}
+	}
+	if sMinDuration := r.URL.Query().Get("minDurationSecond"); len(sMinDuration) > 0 {
+		if opts.MinDurationSecond, err = strconv.ParseInt(sMinDuration, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w : invalid minDurationSecond", ErrInvalidParameter)
+		}
+	}
+	return opts, opts.Validate()
+}
+
+// getContactEpisodes returns the traces uploaded by uid aggregated into contact episodes, optionally narrowed down
+// with the parameters of traceFilterFromRequest. Episodes crossing from or to are cut at the bound.
+func getContactEpisodes(w http.ResponseWriter, r *http.Request) {
+	uid := r.URL.Query().Get("uid")
+	filter, err := traceFilterFromRequest(r, uid)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
-	} else {
-		tr := &TracingResponse{
-			Status:  "SUCCESS",
-			Tracing: tdata,
+		return
+	}
+	opts, err := episodeOptionsFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	traces, err := queryAllTraceData(r.Context(), filter)
+	if err != nil {
+		traceQueryFailed(w, err)
+		return
+	}
+	if err := recordAudit(r, &AuditRecord{Action: AuditGetContactEpisodes, UID: uid, Records: len(traces)}); err != nil {
+		auditFailed(w)
+		return
+	}
+	respBytes, _ := json.Marshal(&ContactEpisodesResponse{
+		Status:   "SUCCESS",
+		Episodes: AggregateEpisodes(traces, opts),
+	})
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+// queryAllTraceData collects every page of traces matching filter. It stops with ErrTooManyTraces
+// once more than tracing.query.records.max traces match, 0 collects them all.
+func queryAllTraceData(ctx context.Context, filter *TraceFilter) ([]*TraceData, error) {
+	max := ConfigGetInt("tracing.query.records.max")
+	traces := make([]*TraceData, 0)
+	cursor := ""
+	for {
+		page, next, err := Tracing.QueryTraceData(ctx, filter, cursor, ConfigGetInt("tracing.page.size.max"))
+		if err != nil {
+			return nil, err
+		}
+		traces = append(traces, page...)
+		if max > 0 && len(traces) > max {
+			return nil, fmt.Errorf("%w : more than %d, narrow down with from and to or page with pageSize", ErrTooManyTraces, max)
+		}
+		if len(next) == 0 {
+			return traces, nil
+		}
+		cursor = next
+	}
+}
+
+// traceQueryFailed answers 400 to an invalid filter or cursor and to a query matching too many traces,
+// and 500 to a storage error.
+func traceQueryFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidParameter) || errors.Is(err, ErrInvalidCursor) || errors.Is(err, ErrTooManyTraces) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	logrus.Errorf("trace query error. got %s", err.Error())
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("storage error"))
+}
+
+// streamTracing writes the traces matching filter as newline delimited JSON, fetching and flushing one page at a time.
+// It returns how many traces were written.
+func streamTracing(w http.ResponseWriter, r *http.Request, filter *TraceFilter, cursor string, pageSize int) (streamed int) {
+	traces, next, err := Tracing.QueryTraceData(r.Context(), filter, cursor, pageSize)
+	if err != nil {
+		traceQueryFailed(w, err)
+		return 0
+	}
+	w.Header().Add("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for {
+		for _, td := range traces {
+			if err := encoder.Encode(td); err != nil {
+				logrus.Errorf("streamTracing: error writing trace. got %s", err.Error())
+				return
+			}
+			streamed++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(next) == 0 {
+			return
+		}
+		traces, next, err = Tracing.QueryTraceData(r.Context(), filter, next, pageSize)
+		if err != nil {
+			logrus.Errorf("streamTracing: error fetching page for uid %s. got %s", filter.UID, err.Error())
+			return
 		}
-		respBytes, _ := json.Marshal(tr)
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write(respBytes)
 	}
 }
 
-func GenerateTempIDs(uid string) (tempIds []*TempID, err error) {
+// GenerateTempIDs makes the batch of TempIDs of uid scheduled by policy from now.
+func GenerateTempIDs(uid string, policy *TempIDPolicy, now time.Time) (tempIds []*TempID, err error) {
 	if len(uid) < UID_SIZE {
 		return nil, ErrInvalidTempIDLength
 	}
-	tempIds = make([]*TempID, TempIDAmount)
+	tempIds = make([]*TempID, policy.BatchSize)
 	for i := 0; i < len(tempIds); i++ {
-		tempId, err := generateTempId([]byte(ENCRYPTIONKEY), uid, uint32(i))
+		start, expiry := policy.Window(now, i)
+		tempId, err := generateTempId(CryptKeys, uid, start, expiry)
 		if err != nil {
 			logrus.Errorf(err.Error())
 		}
@@ -417,15 +1374,18 @@ type TempID struct {
 	ExpiryTime uint32 `json:"expiryTime"`
 }
 
-func (tid *TempID) IsValid(key []byte, forTime time.Time) bool {
-	_, err := decodeAndDecrypt(tid.TempID, key)
+func (tid *TempID) IsValid(keys *Keyring, forTime time.Time) bool {
+	_, err := decodeTempID(tid.TempID, keys)
 	return err == nil
 }
 
-func GetTempIDData(key []byte, tempid string) (UID string, start, expiry int32, err error) {
-	data, err := decodeAndDecrypt(tempid, key)
+func GetTempIDData(keys *Keyring, tempid string) (UID string, start, expiry int32, err error) {
+	data, err := decodeTempID(tempid, keys)
 	if err != nil {
-		return "", 0, 0, fmt.Errorf("%w : error processing tempID %s for decodingAndDecrypt process", err, tempid)
+		return "", 0, 0, fmt.Errorf("%w : error processing tempID %s for decodingAndDecrypt process. got %s", ErrTempIDDecrypt, tempid, err.Error())
+	}
+	if len(data) != TEMPID_SIZE {
+		return "", 0, 0, fmt.Errorf("%w : tempID %s holds %d bytes, expect %d", ErrInvalidTempIDLength, tempid, len(data), TEMPID_SIZE)
 	}
 	buff := bytes.NewBuffer(data)
 
@@ -452,11 +1412,7 @@ func GetTempIDData(key []byte, tempid string) (UID string, start, expiry int32,
 	return string(uidBytes), start, expiry, nil
 }
 
-func generateTempId(key []byte, uid string, i uint32) (*TempID, error) {
-	now := uint32(time.Now().Unix())
-	start := now + 3600*ValidPeriod*i - 60
-	expiry := start + 3600*ValidPeriod
-
+func generateTempId(keys *Keyring, uid string, start, expiry uint32) (*TempID, error) {
 	buff := &bytes.Buffer{}
 	buff.Write([]byte(uid))
 
@@ -469,7 +1425,7 @@ func generateTempId(key []byte, uid string, i uint32) (*TempID, error) {
 	buff.Write(startBytes)
 	buff.Write(expiryBytes)
 
-	val, err := encryptAndEncode(buff.Bytes(), key)
+	val, err := encodeTempID(buff.Bytes(), keys)
 
 	return &TempID{
 		TempID:     val,
@@ -478,6 +1434,174 @@ func generateTempId(key []byte, uid string, i uint32) (*TempID, error) {
 	}, err
 }
 
+type loginRequest struct {
+	Secret string `json:"secret"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// login exchanges the secret of an officer for the access and refresh tokens of a new session.
+func login(w http.ResponseWriter, r *http.Request) {
+	req := &loginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || len(req.Secret) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing secret"))
+		return
+	}
+	oid, err := Tracing.GetOfficerID(r.Context(), req.Secret)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("secret not valid"))
+		return
+	}
+	off, err := Tracing.GetOfficer(r.Context(), oid)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if off.Disabled {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("officer disabled"))
+		return
+	}
+	touchOfficer(r.Context(), Tracing, off)
+	writeSessionTokens(w, func() (*SessionTokens, error) {
+		return NewSessionTokens(off, CryptKeys)
+	})
+}
+
+// refreshSession exchanges a refresh token for the tokens of a new session.
+func refreshSession(w http.ResponseWriter, r *http.Request) {
+	req := &refreshRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || len(req.RefreshToken) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing refreshToken"))
+		return
+	}
+	writeSessionTokens(w, func() (*SessionTokens, error) {
+		return RefreshSession(r.Context(), Tracing, req.RefreshToken, CryptKeys)
+	})
+}
+
+func writeSessionTokens(w http.ResponseWriter, newTokens func() (*SessionTokens, error)) {
+	tokens, err := newTokens()
+	if errors.Is(err, ErrSessionTokenNotValid) || errors.Is(err, ErrSessionTokenExpired) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	respJson, err := json.Marshal(tokens)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("cache-control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+type AuditResponse struct {
+	Status  string         `json:"status"`
+	Records []*AuditRecord `json:"records"`
+	// Next is the afterSeq of the next page, 0 when this is the last one.
+	Next int64 `json:"next,omitempty"`
+}
+
+// auditFilterFromRequest builds the AuditFilter out of the optional actor, action, uid, oid, from, to, afterSeq and limit query parameters.
+func auditFilterFromRequest(r *http.Request) (*AuditFilter, error) {
+	query := r.URL.Query()
+	filter := &AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		UID:    query.Get("uid"),
+		OID:    query.Get("oid"),
+	}
+	ints := []struct {
+		name  string
+		value *int64
+	}{
+		{"from", &filter.From},
+		{"to", &filter.To},
+		{"afterSeq", &filter.AfterSeq},
+	}
+	for _, param := range ints {
+		if s := query.Get(param.name); len(s) > 0 {
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("%w : invalid %s", ErrInvalidParameter, param.name)
+			}
+			*param.value = i
+		}
+	}
+	if sLimit := query.Get("limit"); len(sLimit) > 0 {
+		limit, err := strconv.Atoi(sLimit)
+		if err != nil || limit <= 0 || limit > auditQueryLimitDefault {
+			return nil, fmt.Errorf("%w : limit must be between 1 and %d", ErrInvalidParameter, auditQueryLimitDefault)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// getAudit returns the audit records matching the parameters of auditFilterFromRequest, oldest first.
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilterFromRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	records, err := Audit.Query(r.Context(), filter)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	resp := &AuditResponse{Status: "SUCCESS", Records: records}
+	if len(records) == filter.limit() {
+		resp.Next = records[len(records)-1].Seq
+	}
+	respJson, _ := json.Marshal(resp)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
+type AuditVerifyResponse struct {
+	Status string `json:"status"`
+	*AuditVerification
+	Error string `json:"error,omitempty"`
+}
+
+// verifyAudit checks the whole audit chain. A broken chain is reported with status FAIL and the first broken record.
+func verifyAudit(w http.ResponseWriter, r *http.Request) {
+	verification, err := Audit.Verify(r.Context())
+	if err != nil && !errors.Is(err, ErrAuditChainBroken) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	resp := &AuditVerifyResponse{Status: "SUCCESS", AuditVerification: verification}
+	if err != nil {
+		logrus.Errorf("verifyAudit: got %s", err.Error())
+		resp = &AuditVerifyResponse{Status: "FAIL", AuditVerification: &AuditVerification{}, Error: err.Error()}
+	}
+	respJson, _ := json.Marshal(resp)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respJson)
+}
+
 func healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("cache-control", "no-cache")
 	w.WriteHeader(http.StatusNoContent)
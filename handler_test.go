@@ -1,6 +1,26 @@
 package hypertrace
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	SetConfig("secret.hash.cost", "4")
+	InitKeys()
+	InitTempIDPolicy()
+	InitTempIDThrottle()
+	os.Exit(m.Run())
+}
 
 func TestGetTempIDData(t *testing.T) {
 	tempIds := []string{
@@ -8,10 +28,695 @@ func TestGetTempIDData(t *testing.T) {
 		"LbDQGAjIEKtM3r/e9XD9ScOZLw4i2JyFH9M3SQHLmDJZr1KBJwaub/3NMfjDegzhN45P33lsoUVIywg=",
 	}
 	for _, tid := range tempIds {
-		_, _, _, err := GetTempIDData([]byte(ENCRYPTIONKEY), tid)
+		_, _, _, err := GetTempIDData(CryptKeys, tid)
 		if err != nil {
 			t.Errorf("%s - %s", tid, err.Error())
 			t.FailNow()
 		}
 	}
 }
+
+// currentTempID makes the TempID of uid valid now.
+func currentTempID(uid string) (*TempID, error) {
+	start, expiry := ConfiguredTempIDPolicy().Window(time.Now(), 0)
+	return generateTempId(CryptKeys, uid, start, expiry)
+}
+
+// newTestUpload builds an upload body for uid with a fresh token registered into Tracing.
+func newTestUpload(t *testing.T, uid string, timestamps ...int64) *bytes.Buffer {
+	ut, err := NewUploadToken(uid, "officer1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IsValid only accepts a token from the second after it was issued
+	ut.ValidFrom--
+	tok, err := ut.ToToken(CryptKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Tracing.RegisterUploadToken(context.Background(), ut); err != nil {
+		t.Fatal(err)
+	}
+	upload := &DataUpload{
+		UID:         uid,
+		UploadToken: tok,
+	}
+	for _, ts := range timestamps {
+		tempID, err := currentTempID("contactUID00000000001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		upload.Traces = append(upload.Traces, &UploadTraceRecord{Timestamp: ts, Message: tempID.TempID})
+	}
+	body, _ := json.Marshal(upload)
+	return bytes.NewBuffer(body)
+}
+
+func TestUploadData_TempIDWindowPolicy(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	defer func() {
+		Tracing = nil
+		SetConfig("upload.tempid.window.policy", "reject")
+	}()
+	now := time.Now().Unix()
+	stale := now - 10*24*3600
+
+	tests := []struct {
+		policy     string
+		expectCode int
+		expectStat []string
+		expectSave int
+	}{
+		{"reject", http.StatusBadRequest, []string{UploadRecordAccepted, UploadRecordRejected}, 0},
+		{"flag", http.StatusOK, []string{UploadRecordAccepted, UploadRecordFlagged}, 2},
+		{"drop", http.StatusOK, []string{UploadRecordAccepted, UploadRecordDropped}, 1},
+	}
+	for _, tt := range tests {
+		SetConfig("upload.tempid.window.policy", tt.policy)
+		uid := "windowUID" + strings.Repeat("0", UID_SIZE-9-len(tt.policy)) + tt.policy
+		recorder := httptest.NewRecorder()
+		uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", newTestUpload(t, uid, now, stale)))
+		if recorder.Code != tt.expectCode {
+			t.Fatalf("%s : expect code %d, got %d %s", tt.policy, tt.expectCode, recorder.Code, recorder.Body.String())
+		}
+		resp := &UploadResponse{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil {
+			t.Fatalf("%s : %s", tt.policy, err.Error())
+		}
+		for i, status := range tt.expectStat {
+			if resp.Records[i].Status != status {
+				t.Errorf("%s : record %d expect %s, got %s", tt.policy, i, status, resp.Records[i].Status)
+			}
+		}
+		saved, _ := Tracing.GetTraceData(context.Background(), uid)
+		if len(saved) != tt.expectSave {
+			t.Errorf("%s : expect %d saved traces, got %d", tt.policy, tt.expectSave, len(saved))
+		}
+	}
+}
+
+func TestUploadData_PartialAccept(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	defer func() {
+		Tracing = nil
+		SetConfig("upload.partial.accept", "false")
+	}()
+	uid := "partialUID00000000001"
+	now := time.Now().Unix()
+	contact, _ := currentTempID("contactUID00000000001")
+	self, _ := currentTempID(uid)
+	short, _ := encryptAndEncode([]byte("too short"), CryptKeys)
+
+	newUpload := func() *bytes.Buffer {
+		body := newTestUpload(t, uid)
+		upload := &DataUpload{}
+		_ = json.Unmarshal(body.Bytes(), upload)
+		upload.Traces = []*UploadTraceRecord{
+			{Timestamp: now, Message: contact.TempID},
+			{Timestamp: now, Message: "bm90IGEgdGVtcGlk"},
+			{Timestamp: now, Message: short},
+			{Timestamp: now, Message: self.TempID},
+			{Timestamp: now, Message: contact.TempID},
+			{Timestamp: now + 1, Message: contact.TempID},
+		}
+		uploadBytes, _ := json.Marshal(upload)
+		return bytes.NewBuffer(uploadBytes)
+	}
+	expect := []string{"", UploadReasonDecryptFailed, UploadReasonBadLength, UploadReasonSelfContact, UploadReasonDuplicate, ""}
+
+	for _, partial := range []bool{false, true} {
+		SetConfig("upload.partial.accept", strconv.FormatBool(partial))
+		recorder := httptest.NewRecorder()
+		uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", newUpload()))
+		expectCode, expectSaved := http.StatusBadRequest, 0
+		if partial {
+			expectCode, expectSaved = http.StatusOK, 2
+		}
+		if recorder.Code != expectCode {
+			t.Fatalf("partial %v : expect code %d, got %d %s", partial, expectCode, recorder.Code, recorder.Body.String())
+		}
+		resp := &UploadResponse{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil {
+			t.Fatal(err)
+		}
+		for i, reason := range expect {
+			if resp.Records[i].Reason != reason {
+				t.Errorf("partial %v : record %d expect reason %q, got %q", partial, i, reason, resp.Records[i].Reason)
+			}
+		}
+		saved, _ := Tracing.GetTraceData(context.Background(), uid)
+		if len(saved) != expectSaved {
+			t.Errorf("partial %v : expect %d saved traces, got %d", partial, expectSaved, len(saved))
+		}
+	}
+}
+
+func TestUploadData_SingleUseToken(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	defer func() {
+		Tracing = nil
+	}()
+	uid := "singleUID000000000001"
+	now := time.Now().Unix()
+
+	body := newTestUpload(t, uid, now).Bytes()
+	recorder := httptest.NewRecorder()
+	uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", bytes.NewBuffer(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("first upload : expect code %d, got %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", bytes.NewBuffer(body)))
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("replayed upload : expect code %d, got %d %s", http.StatusConflict, recorder.Code, recorder.Body.String())
+	}
+
+	body = newTestUpload(t, uid, now+1).Bytes()
+	recorder = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/revokeUploadToken", nil)
+	req.Header.Set("Authorization", "Bearer secret1")
+	AuthMiddleware(RequireRole(RoleTracer)(revokeUploadToken)).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"revoked":1`) {
+		t.Fatalf("revoke : expect one token revoked, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/revokeUploadToken", nil)
+	req.SetBasicAuth(AdminUser, ConfigGet("adminpassword"))
+	AuthMiddleware(http.HandlerFunc(revokeUploadToken)).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("revoke : expect the administrator forbidden, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", bytes.NewBuffer(body)))
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("revoked upload : expect code %d, got %d %s", http.StatusForbidden, recorder.Code, recorder.Body.String())
+	}
+	if saved, _ := Tracing.GetTraceData(context.Background(), uid); len(saved) != 1 {
+		t.Errorf("expect only the first upload saved, got %d traces", len(saved))
+	}
+}
+
+func TestUploadData_TokenOfAnotherUID(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	defer func() {
+		Tracing = nil
+	}()
+	uid := "tokenUID0000000000001"
+	body := newTestUpload(t, uid, time.Now().Unix()).Bytes()
+	upload := &DataUpload{}
+	if err := json.Unmarshal(body, upload); err != nil {
+		t.Fatal(err)
+	}
+	upload.UID = "victimUID000000000001"
+	forged, _ := json.Marshal(upload)
+
+	recorder := httptest.NewRecorder()
+	uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", bytes.NewBuffer(forged)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("expect an upload for another uid refused, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if saved, _ := Tracing.GetTraceData(context.Background(), upload.UID); len(saved) != 0 {
+		t.Errorf("expect nothing saved for the other uid, got %d traces", len(saved))
+	}
+	recorder = httptest.NewRecorder()
+	uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", bytes.NewBuffer(body)))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expect the token still usable for its uid, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// recordingForwarder keeps the traces forwarded, or fails with err.
+type recordingForwarder struct {
+	forwarded []*TraceData
+	err       error
+}
+
+func (forwarder *recordingForwarder) ForwardTraceData(UID string, data []*TraceData) error {
+	if forwarder.err != nil {
+		return forwarder.err
+	}
+	forwarder.forwarded = append(forwarder.forwarded, data...)
+	return nil
+}
+
+func TestUploadData_ForwardsSavedOnly(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	forwarder := &recordingForwarder{}
+	Forwarder = forwarder
+	defer func() {
+		Tracing = nil
+		Forwarder = &StdOutForwarder{}
+	}()
+	uid := "forwardUID00000000001"
+	now := time.Now().Unix()
+
+	for _, body := range []*bytes.Buffer{newTestUpload(t, uid, now), newTestUpload(t, uid, now, now+1)} {
+		recorder := httptest.NewRecorder()
+		uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", body))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expect code %d, got %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+	}
+	if len(forwarder.forwarded) != 2 || forwarder.forwarded[1].Timestamp != now+1 {
+		t.Errorf("expect the duplicate not forwarded again, got %d forwarded traces", len(forwarder.forwarded))
+	}
+}
+
+func TestUploadData_RetryAfterFailure(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	forwarder := &recordingForwarder{err: errors.New("forwarder down")}
+	Forwarder = forwarder
+	defer func() {
+		Tracing = nil
+		Forwarder = &StdOutForwarder{}
+	}()
+	uid := "retryUID0000000000001"
+
+	body := newTestUpload(t, uid, time.Now().Unix()).Bytes()
+	recorder := httptest.NewRecorder()
+	uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", bytes.NewBuffer(body)))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("expect the forwarder failure, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	forwarder.err = nil
+	recorder = httptest.NewRecorder()
+	uploadData(recorder, httptest.NewRequest(http.MethodPost, "/uploadData", bytes.NewBuffer(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expect the upload token usable again, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDeleteUser_Receipt(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	Audit = NewInMemoryAuditLog()
+	defer func() {
+		Tracing = nil
+		Audit = nil
+	}()
+	ctx := context.Background()
+	uid := "eraseUID0000000000001"
+	if err := Tracing.RegisterNewUser(ctx, uid, "1111"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "other", Timestamp: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Tracing.SaveTraceData(ctx, "other", "officer1", []*TraceData{{CUID: uid, Timestamp: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/deleteUid", strings.NewReader("uid="+uid))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(AdminUser, ConfigGet("adminpassword"))
+	recorder := httptest.NewRecorder()
+	AuthMiddleware(RequireRole(RoleAdmin)(deleteUser)).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expect code %d, got %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	receipt := &DeletionReceipt{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), receipt); err != nil {
+		t.Fatal(err)
+	}
+	if !receipt.User || receipt.Traces != 1 || receipt.ContactTraces != 1 || receipt.DeletedBy != AdminUser || len(receipt.ReceiptID) == 0 {
+		t.Errorf("expect the user and 2 traces erased by admin, got %s", recorder.Body.String())
+	}
+
+	verification, err := Audit.Verify(ctx)
+	if err != nil || verification.Records != receipt.AuditSeq || verification.Head != receipt.AuditHash {
+		t.Errorf("expect the receipt to match the audit head %+v, got %s, %v", verification, recorder.Body.String(), err)
+	}
+	if records, _ := Audit.Query(ctx, &AuditFilter{Action: AuditDeleteUser}); len(records) != 1 || !strings.Contains(records[0].Detail, receipt.ReceiptID) {
+		t.Errorf("expect the deleteUser record to hold receipt %s, got %+v", receipt.ReceiptID, records)
+	}
+	if saved, _ := Tracing.GetTraceData(ctx, "other"); len(saved) != 0 {
+		t.Errorf("expect the contact trace of other erased, got %d traces", len(saved))
+	}
+}
+
+func TestOfficerManagement(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	Audit = NewInMemoryAuditLog()
+	defer func() {
+		Tracing = nil
+		Audit = nil
+	}()
+	adminPost := func(handler http.HandlerFunc, path, form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(AdminUser, ConfigGet("adminpassword"))
+		recorder := httptest.NewRecorder()
+		AuthMiddleware(RequireRole(RoleAdmin)(handler)).ServeHTTP(recorder, req)
+		return recorder
+	}
+	logIn := func(secret string) int {
+		loginJson, _ := json.Marshal(&loginRequest{Secret: secret})
+		recorder := httptest.NewRecorder()
+		login(recorder, httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(loginJson)))
+		return recorder.Code
+	}
+
+	recorder := adminPost(updateOfficer, "/admin/officer", "oid=officer2&disabled=true")
+	officer := &OfficerResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), officer); err != nil || recorder.Code != http.StatusOK || !officer.Disabled {
+		t.Fatalf("expect officer2 disabled, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if code := logIn("secret2"); code != http.StatusForbidden {
+		t.Errorf("expect a disabled officer login to be forbidden, got %d", code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/getTracing?uid=someUID", nil)
+	req.Header.Set("Authorization", "Bearer secret2")
+	recorder = httptest.NewRecorder()
+	AuthMiddleware(RequireRole(RoleTracer)(getTracing)).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expect the secret of a disabled officer to be refused, got %d", recorder.Code)
+	}
+
+	if recorder = adminPost(updateOfficer, "/admin/officer", "oid=officer4&roles=admin&disabled=maybe"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expect an invalid disabled to be a bad request, got %d", recorder.Code)
+	}
+	if off, err := Tracing.GetOfficer(context.Background(), "officer4"); err != nil || len(off.Roles) == 1 && off.Roles[0] == RoleAdmin {
+		t.Errorf("expect officer4 roles unchanged by the rejected update, got %+v, %v", off, err)
+	}
+	if recorder = adminPost(updateOfficer, "/admin/officer", "oid=nobody&disabled=true"); recorder.Code != http.StatusNotFound {
+		t.Errorf("expect updating an unknown officer to be not found, got %d", recorder.Code)
+	}
+
+	recorder = adminPost(rotateOfficerSecret, "/admin/officer/rotateSecret", "oid=officer3")
+	rotated := &RotateSecretResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), rotated); err != nil || recorder.Code != http.StatusOK || len(rotated.Secret) == 0 {
+		t.Fatalf("expect a generated secret, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if code := logIn("secret3"); code != http.StatusUnauthorized {
+		t.Errorf("expect the replaced secret to be refused, got %d", code)
+	}
+	if code := logIn(rotated.Secret); code != http.StatusOK {
+		t.Errorf("expect the generated secret to log in, got %d", code)
+	}
+	if recorder = adminPost(rotateOfficerSecret, "/admin/officer/rotateSecret", "oid=nobody"); recorder.Code != http.StatusNotFound {
+		t.Errorf("expect rotating an unknown officer to be not found, got %d", recorder.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/officers", nil)
+	req.SetBasicAuth(AdminUser, ConfigGet("adminpassword"))
+	recorder = httptest.NewRecorder()
+	AuthMiddleware(RequireRole(RoleAdmin)(listOfficers)).ServeHTTP(recorder, req)
+	officers := &OfficersResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), officers); err != nil || len(officers.Officers) != 5 {
+		t.Fatalf("expect 5 officers, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if off := officers.Officers[2]; off.OID != "officer3" || off.LastUsedAt == 0 || off.CreatedAt == 0 {
+		t.Errorf("expect officer3 created and used, got %+v", off)
+	}
+	if strings.Contains(recorder.Body.String(), "secret") {
+		t.Errorf("expect no secret in the officer list, got %s", recorder.Body.String())
+	}
+
+	records, err := Audit.Query(context.Background(), &AuditFilter{Actor: AdminUser})
+	if err != nil || len(records) != 2 || records[0].Action != AuditUpdateOfficer || records[1].Action != AuditRotateSecret {
+		t.Errorf("expect the update and rotation audited, got %+v, %v", records, err)
+	}
+}
+
+func TestGetTempIDs_ProofOfRegistration(t *testing.T) {
+	Tracing = NewInMemoryTracing()
+	TempIDThrottle = NewThrottle(5, time.Hour)
+	TempIDProofThrottle = NewThrottle(3, time.Hour)
+	SetConfig("tempid.auth.required", "true")
+	defer func() {
+		Tracing = nil
+		InitTempIDThrottle()
+		SetConfig("tempid.auth.required", "")
+	}()
+	uid := "tempidUID000000000001"
+	if err := Tracing.RegisterNewUser(context.Background(), uid, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	request := func(client, form, deviceToken string) (*httptest.ResponseRecorder, *TempIDResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/getTempIDs", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = client + ":1234"
+		if len(deviceToken) > 0 {
+			req.Header.Set("Authorization", "Bearer "+deviceToken)
+		}
+		recorder := httptest.NewRecorder()
+		getTempIDs(recorder, req)
+		resp := &TempIDResponse{}
+		_ = json.Unmarshal(recorder.Body.Bytes(), resp)
+		return recorder, resp
+	}
+	expectFail := func(name string, recorder *httptest.ResponseRecorder, code int, reason string) {
+		t.Helper()
+		fail := &TempIDFailResponse{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), fail); err != nil || recorder.Code != code || fail.Error != reason {
+			t.Errorf("%s : expect %d %s, got %d %s", name, code, reason, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	tests := []struct {
+		name   string
+		form   string
+		token  string
+		expect int
+		error  string
+	}{
+		{"no proof", "uid=" + uid, "", http.StatusUnauthorized, "pin or device token required"},
+		{"short uid", "uid=short&pin=1234", "", http.StatusBadRequest, "uid must be 21 characters"},
+		{"unregistered uid", "uid=fabricatedUID00000001&pin=1234", "", http.StatusForbidden, "uid or pin not valid"},
+		{"wrong pin", "uid=" + uid + "&pin=9999", "", http.StatusForbidden, "uid or pin not valid"},
+		{"forged device token", "", "a.b.c", http.StatusUnauthorized, "device token not valid"},
+	}
+	for _, tt := range tests {
+		recorder, _ := request("192.0.2.1", tt.form, tt.token)
+		expectFail(tt.name, recorder, tt.expect, tt.error)
+	}
+	// the three failed proofs of the client block it, whatever it sends
+	recorder, _ := request("192.0.2.1", "uid="+uid+"&pin=1234", "")
+	expectFail("client with failed proofs", recorder, http.StatusTooManyRequests, "too many failed proofs from this client")
+
+	recorder, resp := request("192.0.2.2", "uid="+uid+"&pin=1234", "")
+	if recorder.Code != http.StatusOK || len(resp.TempIDs) != ConfiguredTempIDPolicy().BatchSize || len(resp.DeviceToken) == 0 {
+		t.Fatalf("expect TempIDs and a device token for the pin, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder, resp = request("192.0.2.2", "", resp.DeviceToken)
+	if recorder.Code != http.StatusOK || len(resp.TempIDs) != ConfiguredTempIDPolicy().BatchSize || len(resp.DeviceToken) == 0 {
+		t.Fatalf("expect TempIDs for the device token, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	SetConfig("tempid.auth.required", "false")
+	if recorder, resp := request("192.0.2.2", "uid="+uid, ""); recorder.Code != http.StatusOK || len(resp.DeviceToken) != 0 || recorder.Header().Get("Deprecation") != "true" {
+		t.Errorf("expect deprecated TempIDs without device token, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	SetConfig("tempid.auth.required", "true")
+
+	// wrong pins from anywhere block pin proofs of the uid, not its device token
+	for _, client := range []string{"192.0.2.3", "192.0.2.4"} {
+		recorder, _ := request(client, "uid="+uid+"&pin=0000", "")
+		expectFail("wrong pin from "+client, recorder, http.StatusForbidden, "uid or pin not valid")
+	}
+	recorder, _ = request("192.0.2.5", "uid="+uid+"&pin=1234", "")
+	expectFail("uid with failed proofs", recorder, http.StatusTooManyRequests, "too many failed proofs for this uid")
+	for i := 4; i <= 5; i++ {
+		recorder, resp = request("192.0.2.5", "", resp.DeviceToken)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expect issuance %d for the device token of a uid with failed pins, got %d %s", i, recorder.Code, recorder.Body.String())
+		}
+	}
+	recorder, _ = request("192.0.2.5", "", resp.DeviceToken)
+	expectFail("6th issuance", recorder, http.StatusTooManyRequests, "too many requests for this uid")
+	if len(recorder.Header().Get("Retry-After")) == 0 {
+		t.Errorf("expect a Retry-After header")
+	}
+
+	if err := Tracing.RegisterNewUser(context.Background(), uid, "5678"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder, _ := request("192.0.2.5", "", resp.DeviceToken); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expect the device token of the replaced pin refused, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestScheduleKeyRotation_SingleInMemoryServer(t *testing.T) {
+	schedule := func() int {
+		recorder := httptest.NewRecorder()
+		scheduleKeyRotation(recorder, httptest.NewRequest(http.MethodGet, "/scheduleKeyRotation?id=1", nil))
+		return recorder.Code
+	}
+	if code := schedule(); code != http.StatusOK {
+		t.Errorf("expect a rotation scheduled on a single inmemory server, got %d", code)
+	}
+	SetConfig("database", "postgres")
+	defer SetConfig("database", "")
+	if code := schedule(); code != http.StatusConflict {
+		t.Errorf("expect a rotation refused with a shared database, got %d", code)
+	}
+}
+
+func TestSetTempIDPolicy(t *testing.T) {
+	Tracing = NewInMemoryTracing()
+	Audit = NewInMemoryAuditLog()
+	defer func() {
+		Tracing = nil
+		Audit = nil
+	}()
+	uid := "policyUID000000000001"
+	if err := Tracing.RegisterNewUser(context.Background(), uid, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	setPolicy := func(form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/tempIDPolicy", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(AdminUser, ConfigGet("adminpassword"))
+		recorder := httptest.NewRecorder()
+		AuthMiddleware(RequireRole(RoleAdmin)(setTempIDPolicy)).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if recorder := setPolicy("batchSize=0"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expect an empty batch refused, got %d", recorder.Code)
+	}
+	if recorder := setPolicy("periodMinute=15&batchSize=3&refreshLeadMinute=10&align=true"); recorder.Code != http.StatusOK {
+		t.Fatalf("expect the policy set, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/getTempIDs", strings.NewReader("uid="+uid+"&pin=1234"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	getTempIDs(recorder, req)
+	resp := &TempIDResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil || len(resp.TempIDs) != 3 || resp.Policy == nil || resp.Policy.PeriodMinute != 15 || resp.Policy.OverlapSecond != 60 {
+		t.Fatalf("expect 3 TempIDs of the new policy, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if last := resp.TempIDs[2]; last.ExpiryTime%900 != 0 || last.ExpiryTime-last.StartTime != 900+60 || resp.RefreshTime != last.ExpiryTime-600 {
+		t.Errorf("expect aligned 15 minutes TempIDs refreshed 10 minutes before the last expires, got %+v, refresh %d", last, resp.RefreshTime)
+	}
+	// another server sharing the storage gets the stored policy over its configuration
+	if policy, err := CurrentTempIDPolicy(context.Background(), Tracing); err != nil || policy.PeriodMinute != 15 || policy.BatchSize != 3 {
+		t.Errorf("expect the stored policy in force, got %+v, %v", policy, err)
+	}
+	if recorder := setPolicy("reset=true"); recorder.Code != http.StatusOK {
+		t.Fatalf("expect the policy reset, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if policy, err := CurrentTempIDPolicy(context.Background(), Tracing); err != nil || *policy != *ConfiguredTempIDPolicy() {
+		t.Errorf("expect the configured policy in force after reset, got %+v, %v", policy, err)
+	}
+	// the configured refresh lead was never set, it follows the batch
+	if recorder := setPolicy("batchSize=24"); recorder.Code != http.StatusOK {
+		t.Fatalf("expect a day long batch accepted with the default refresh lead, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if policy, err := CurrentTempIDPolicy(context.Background(), Tracing); err != nil || policy.RefreshLeadMinute != 0 || !policy.RefreshLeadDefault {
+		t.Errorf("expect the default refresh lead of a day long batch, got %+v, %v", policy, err)
+	}
+	if recorder := setPolicy("refreshLeadMinute=30"); recorder.Code != http.StatusOK {
+		t.Fatalf("expect the refresh lead set, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := setPolicy("batchSize=48"); recorder.Code != http.StatusOK {
+		t.Fatalf("expect the batch size set, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if policy, err := CurrentTempIDPolicy(context.Background(), Tracing); err != nil || policy.RefreshLeadMinute != 30 || policy.RefreshLeadDefault {
+		t.Errorf("expect the refresh lead set kept, got %+v, %v", policy, err)
+	}
+	if records, _ := Audit.Query(context.Background(), &AuditFilter{Action: AuditSetTempIDPolicy}); len(records) != 5 {
+		t.Errorf("expect the policy changes and reset audited, got %+v", records)
+	}
+}
+
+func TestGetContactEpisodes(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	Audit = NewInMemoryAuditLog()
+	defer func() {
+		Tracing = nil
+		Audit = nil
+	}()
+	ctx := context.Background()
+	uid := "episodeUID00000000001"
+	if err := Tracing.RegisterNewUser(ctx, uid, "1111"); err != nil {
+		t.Fatal(err)
+	}
+	traces := []*TraceData{
+		{CUID: "contact", Timestamp: 1000, RSSI: -60},
+		{CUID: "contact", Timestamp: 1100, RSSI: -70},
+		{CUID: "contact", Timestamp: 5000, RSSI: -65},
+	}
+	if _, _, err := Tracing.SaveTraceData(ctx, uid, "officer1", traces); err != nil {
+		t.Fatal(err)
+	}
+	getEpisodes := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/getContactEpisodes?uid="+uid+query, nil)
+		req.Header.Set("Authorization", "Bearer secret1")
+		recorder := httptest.NewRecorder()
+		AuthMiddleware(RequireRole(RoleTracer, RoleAuditor)(getContactEpisodes)).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := getEpisodes("")
+	resp := &ContactEpisodesResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil || recorder.Code != http.StatusOK || len(resp.Episodes) != 2 {
+		t.Fatalf("expect 2 episodes with the default gap, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if episode := resp.Episodes[0]; episode.UID != uid || episode.Duration != 100 || episode.Records != 2 || episode.RSSIMean != -65 {
+		t.Errorf("expect a 100 seconds episode of 2 sightings, got %+v", episode)
+	}
+	if recorder := getEpisodes("&gapSecond=5000&minDurationSecond=60"); recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"records":3`) {
+		t.Errorf("expect a single episode with a longer gap, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := getEpisodes("&gapSecond=-1"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expect a negative gap refused, got %d", recorder.Code)
+	}
+	if records, _ := Audit.Query(ctx, &AuditFilter{Action: AuditGetContactEpisodes}); len(records) != 2 || records[0].Records != 3 {
+		t.Errorf("expect the episode queries audited with the traces read, got %+v", records)
+	}
+
+	SetConfig("tracing.query.records.max", "2")
+	defer SetConfig("tracing.query.records.max", "")
+	if recorder := getEpisodes(""); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expect more traces than tracing.query.records.max refused, got %d %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder := getEpisodes("&from=5000"); recorder.Code != http.StatusOK {
+		t.Errorf("expect a query narrowed down under the cap answered, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	Tracing = &failingQueryTracing{Tracing.(*InMemoryTracing)}
+	if recorder := getEpisodes(""); recorder.Code != http.StatusInternalServerError {
+		t.Errorf("expect a storage error answered 500, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// failingQueryTracing fails every trace query as an unavailable storage would.
+type failingQueryTracing struct {
+	*InMemoryTracing
+}
+
+func (trace *failingQueryTracing) QueryTraceData(ctx context.Context, filter *TraceFilter, cursor string, pageSize int) ([]*TraceData, string, error) {
+	return nil, "", errors.New("storage unavailable")
+}
+
+func TestVerifyHandshakePin(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	defer func() {
+		Tracing = nil
+	}()
+	uid := "handshakeUID000000001"
+	if err := Tracing.RegisterNewUser(context.Background(), uid, "1234"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query  string
+		code   int
+		status string
+	}{
+		{"uid=short&pin=1234", http.StatusBadRequest, "FAIL"},
+		{"uid=" + uid, http.StatusBadRequest, "FAIL"},
+		{"uid=" + uid + "&pin=9999", http.StatusForbidden, "FAIL"},
+		{"uid=" + uid + "&pin=1234", http.StatusOK, "SUCCESS"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/verifyHandshakePin?"+tt.query, nil)
+		req.Header.Set("Authorization", "Bearer secret1")
+		recorder := httptest.NewRecorder()
+		AuthMiddleware(RequireRole(RoleTracer)(verifyHandshakePin)).ServeHTTP(recorder, req)
+		resp := &VerifyHandshakePinResponse{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), resp); err != nil || recorder.Code != tt.code || resp.Status != tt.status {
+			t.Errorf("%s : expect %d %s, got %d %s", tt.query, tt.code, tt.status, recorder.Code, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package hypertrace
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// KeyProvider supplies the material of the keyring keys, so production can keep the keys
+// outside of the process environment.
+type KeyProvider interface {
+	// Key returns the key of id, or ErrKeyNotFound if the provider does not have it.
+	Key(id byte) (key []byte, err error)
+}
+
+// NewKeyProviderFromConfig returns the KeyProvider selected by tempid.key.provider.
+func NewKeyProviderFromConfig() (KeyProvider, error) {
+	switch ConfigGet("tempid.key.provider") {
+	case "config", "":
+		return &ConfigKeyProvider{}, nil
+	case "file":
+		if len(ConfigGet("tempid.key.file.dir")) == 0 {
+			return nil, fmt.Errorf("%w : tempid.key.file.dir is not set", ErrKeyNotFound)
+		}
+		return &FileKeyProvider{Dir: ConfigGet("tempid.key.file.dir")}, nil
+	case "kms":
+		kms, err := NewLocalKMS(ConfigGet("tempid.key.kms.master.file"))
+		if err != nil {
+			return nil, err
+		}
+		return &KMSKeyProvider{KMS: kms}, nil
+	}
+	return nil, fmt.Errorf("unknown tempid.key.provider %s, expect config, file or kms", ConfigGet("tempid.key.provider"))
+}
+
+// configKey returns the configured tempid.keyring.<id>, falling back to tempid.crypt.key for id 1.
+func configKey(id byte) (key string, err error) {
+	key = ConfigGet(fmt.Sprintf("tempid.keyring.%d", id))
+	if len(key) == 0 && id == 1 {
+		key = ConfigGet("tempid.crypt.key")
+	}
+	if len(key) == 0 {
+		return "", fmt.Errorf("%w : tempid.keyring.%d is not set", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+// ConfigKeyProvider reads the plain keys from the configuration, see configKey.
+type ConfigKeyProvider struct{}
+
+func (provider *ConfigKeyProvider) Key(id byte) (key []byte, err error) {
+	sKey, err := configKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(sKey), nil
+}
+
+// FileKeyProvider reads the key of id from the file named after the id in Dir, eg. a mounted secret volume.
+// A trailing line break in the file is ignored.
+type FileKeyProvider struct {
+	Dir string
+}
+
+func (provider *FileKeyProvider) Key(id byte) (key []byte, err error) {
+	return readKeyFile(filepath.Join(provider.Dir, strconv.Itoa(int(id))))
+}
+
+func readKeyFile(path string) (key []byte, err error) {
+	key, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w : key can not be read from %s. got %s", ErrKeyNotFound, path, err.Error())
+	}
+	return []byte(strings.TrimRight(string(key), "\r\n")), nil
+}
+
+// KMSClient unwraps data keys without ever revealing its own master key, the way a PKCS#11 token or a cloud KMS does.
+type KMSClient interface {
+	Unwrap(wrapped []byte) (key []byte, err error)
+}
+
+// KMSKeyProvider reads the keys wrapped by KMS, base64 encoded, from the configuration (see configKey)
+// and has KMS unwrap them. Only the wrapped keys are ever part of the process environment.
+type KMSKeyProvider struct {
+	KMS KMSClient
+}
+
+func (provider *KMSKeyProvider) Key(id byte) (key []byte, err error) {
+	sWrapped, err := configKey(id)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(sWrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w : wrapped key %d is not base64", err, id)
+	}
+	key, err = provider.KMS.Unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w : wrapped key %d can not be unwrapped", err, id)
+	}
+	return key, nil
+}
+
+// LocalKMS is a local stand-in for a KMS. Its master key is read from a file, eg. a volume
+// only mounted for the server, and keys are wrapped with AES-256-GCM as nonce followed by the cypher text.
+type LocalKMS struct {
+	master []byte
+}
+
+// NewLocalKMS creates a LocalKMS with the master key held in masterKeyFile.
+func NewLocalKMS(masterKeyFile string) (*LocalKMS, error) {
+	master, err := readKeyFile(masterKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(master) != KeySize {
+		return nil, fmt.Errorf("%w : master key %s is %d bytes, we expect %d", ErrInvalidKeySize, masterKeyFile, len(master), KeySize)
+	}
+	return &LocalKMS{master: master}, nil
+}
+
+// Wrap encrypts key with the master key.
+func (kms *LocalKMS) Wrap(key []byte) (wrapped []byte, err error) {
+	cypherText, iv, err := encrypt(key, kms.master)
+	if err != nil {
+		return nil, err
+	}
+	return append(iv, cypherText...), nil
+}
+
+// Unwrap decrypts a key made by Wrap.
+func (kms *LocalKMS) Unwrap(wrapped []byte) (key []byte, err error) {
+	if len(wrapped) <= nonceSize {
+		return nil, fmt.Errorf("%w : wrapped key too short", ErrInvalidKeySize)
+	}
+	return decrypt(wrapped[nonceSize:], wrapped[:nonceSize], kms.master)
+}
@@ -0,0 +1,53 @@
+package hypertrace
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyProviders(t *testing.T) {
+	dir := t.TempDir()
+	key := []byte("thisistheencryptionkey0123456789")
+	master := []byte("thisisthelocalkmsmasterkey012345")
+	if err := ioutil.WriteFile(filepath.Join(dir, "2"), append(key, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "3"), []byte("too short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "master"), master, 0600); err != nil {
+		t.Fatal(err)
+	}
+	kms, err := NewLocalKMS(filepath.Join(dir, "master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := kms.Wrap(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetConfig("tempid.keyring.2", base64.StdEncoding.EncodeToString(wrapped))
+	defer SetConfig("tempid.keyring.2", "")
+
+	for name, provider := range map[string]KeyProvider{
+		"file": &FileKeyProvider{Dir: dir},
+		"kms":  &KMSKeyProvider{KMS: kms},
+	} {
+		got, err := provider.Key(2)
+		if err != nil || string(got) != string(key) {
+			t.Errorf("%s : expect key 2 %s, got %q, %v", name, key, got, err)
+		}
+		if _, err := provider.Key(4); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s : expect ErrKeyNotFound for key 4, got %v", name, err)
+		}
+	}
+
+	SetConfig("tempid.keyring.ids", "2,3")
+	defer SetConfig("tempid.keyring.ids", "")
+	if _, err := NewKeyringFromConfig(&FileKeyProvider{Dir: dir}); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("expect a short key to fail the keyring with ErrInvalidKeySize, got %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package hypertrace
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// KeySize is the size of every keyring key, they are AES-256 keys.
+	KeySize = 32
+)
+
+var (
+	ErrInvalidKeyID   = fmt.Errorf("invalid key id")
+	ErrInvalidKeySize = fmt.Errorf("invalid key size")
+	ErrKeyNotFound    = fmt.Errorf("key not found")
+	ErrKeyRetired     = fmt.Errorf("key retired")
+
+	keyringLog = logrus.WithField("module", "Keyring")
+)
+
+// Keyring holds the versioned keys used to encrypt TempIDs and upload tokens.
+// Data is always encrypted with the active key and the id of that key is embedded in the envelope,
+// so it can be decrypted with any key of the ring that is not retired.
+// A rotation can be scheduled, the scheduled key becomes active at the given time and the
+// previously active key may be retired some time later, once everything it encrypted has expired.
+// It is safe for concurrent use.
+type Keyring struct {
+	mutex   sync.Mutex
+	keys    map[byte][]byte
+	retired map[byte]bool
+	active  byte
+
+	rotateTo    byte
+	rotateAt    time.Time
+	retireAfter time.Duration
+	// retirements are pending in the order of their rotation, so a rotation never cancels the one of the key before
+	retirements []keyRetirement
+
+	now func() time.Time
+}
+
+type keyRetirement struct {
+	id byte
+	at time.Time
+}
+
+// NewKeyring creates an empty Keyring, at least one key must be added and activated before encrypting.
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys:    make(map[byte][]byte),
+		retired: make(map[byte]bool),
+		now:     time.Now,
+	}
+}
+
+// NewKeyringFromConfig builds the keyring out of the configuration, taking the keys from provider.
+// tempid.keyring.ids lists the key ids, when no id is listed the keyring holds key 1 alone.
+// Every key must be KeySize bytes long. tempid.keyring.active selects the active key,
+// the highest id by default, and tempid.keyring.retired lists the ids which must no longer decrypt.
+// A rotation to tempid.keyring.rotate.id is scheduled at tempid.keyring.rotate.at (RFC3339) when both are set,
+// retiring the previous key tempid.keyring.retire.after.hour later if that is not zero.
+func NewKeyringFromConfig(provider KeyProvider) (*Keyring, error) {
+	kr := NewKeyring()
+	ids, err := parseKeyIDs(ConfigGet("tempid.keyring.ids"))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []byte{1}
+	}
+	for _, id := range ids {
+		key, err := provider.Key(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := kr.AddKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+
+	active := ids[len(ids)-1]
+	if len(ConfigGet("tempid.keyring.active")) > 0 {
+		active, err = parseKeyID(ConfigGet("tempid.keyring.active"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := kr.SetActive(active); err != nil {
+		return nil, fmt.Errorf("%w : tempid.keyring.active %d", err, active)
+	}
+
+	retired, err := parseKeyIDs(ConfigGet("tempid.keyring.retired"))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range retired {
+		if err := kr.Retire(id); err != nil {
+			return nil, fmt.Errorf("%w : tempid.keyring.retired %d", err, id)
+		}
+	}
+
+	if len(ConfigGet("tempid.keyring.rotate.id")) > 0 && len(ConfigGet("tempid.keyring.rotate.at")) > 0 {
+		rotateTo, err := parseKeyID(ConfigGet("tempid.keyring.rotate.id"))
+		if err != nil {
+			return nil, err
+		}
+		rotateAt, err := time.Parse(time.RFC3339, ConfigGet("tempid.keyring.rotate.at"))
+		if err != nil {
+			return nil, fmt.Errorf("%w : tempid.keyring.rotate.at", err)
+		}
+		retireAfter := time.Duration(ConfigGetInt("tempid.keyring.retire.after.hour")) * time.Hour
+		if err := kr.ScheduleRotation(rotateTo, rotateAt, retireAfter); err != nil {
+			return nil, fmt.Errorf("%w : tempid.keyring.rotate.id %d", err, rotateTo)
+		}
+	}
+	return kr, nil
+}
+
+func parseKeyID(s string) (byte, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+	if err != nil || id == 0 {
+		return 0, fmt.Errorf("%w : %q, expect 1 to 255", ErrInvalidKeyID, s)
+	}
+	return byte(id), nil
+}
+
+// parseKeyIDs parses a comma separated list of key ids, returned in ascending order.
+func parseKeyIDs(s string) ([]byte, error) {
+	ids := make([]byte, 0)
+	for _, sid := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(sid)) == 0 {
+			continue
+		}
+		id, err := parseKeyID(sid)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// AddKey puts key into the ring under id. Id 0 is reserved and key must be KeySize bytes long.
+func (kr *Keyring) AddKey(id byte, key []byte) error {
+	if id == 0 {
+		return ErrInvalidKeyID
+	}
+	if len(key) != KeySize {
+		return fmt.Errorf("%w : key %d is %d bytes, we expect %d", ErrInvalidKeySize, id, len(key), KeySize)
+	}
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+// SetActive makes id the key used to encrypt from now on.
+func (kr *Keyring) SetActive(id byte) error {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	if _, ok := kr.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	if kr.retired[id] {
+		return ErrKeyRetired
+	}
+	kr.active = id
+	return nil
+}
+
+// Retire stops id from decrypting anything. The active key can not be retired.
+func (kr *Keyring) Retire(id byte) error {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.rotate()
+	if _, ok := kr.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	if id == kr.active || id == kr.rotateTo {
+		return fmt.Errorf("%w : key %d is active or about to be", ErrInvalidKeyID, id)
+	}
+	kr.retired[id] = true
+	return nil
+}
+
+// ScheduleRotation makes id the active key at the given time. If retireAfter is not zero the key active
+// until then is retired retireAfter later. It replaces any rotation scheduled before, the retirements
+// of the keys replaced by earlier rotations stay scheduled.
+func (kr *Keyring) ScheduleRotation(id byte, at time.Time, retireAfter time.Duration) error {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.rotate()
+	if _, ok := kr.keys[id]; !ok {
+		return ErrKeyNotFound
+	}
+	if kr.retired[id] {
+		return ErrKeyRetired
+	}
+	kr.rotateTo = id
+	kr.rotateAt = at
+	kr.retireAfter = retireAfter
+	keyringLog.Infof("rotation from key %d to key %d scheduled at %s", kr.active, id, at.Format(time.RFC3339))
+	kr.rotate()
+	return nil
+}
+
+// rotate applies the scheduled rotation and retirement once their time has come. It must be called with the lock held.
+func (kr *Keyring) rotate() {
+	now := kr.now()
+	if kr.rotateTo != 0 && !now.Before(kr.rotateAt) {
+		if kr.retireAfter > 0 && kr.active != 0 && kr.active != kr.rotateTo {
+			kr.retirements = append(kr.retirements, keyRetirement{id: kr.active, at: kr.rotateAt.Add(kr.retireAfter)})
+		}
+		keyringLog.Infof("key %d is now active, replacing key %d", kr.rotateTo, kr.active)
+		kr.active = kr.rotateTo
+		kr.rotateTo = 0
+	}
+	pending := kr.retirements[:0]
+	for _, retirement := range kr.retirements {
+		if now.Before(retirement.at) {
+			pending = append(pending, retirement)
+			continue
+		}
+		// a key made active again since is kept
+		if retirement.id != kr.active && retirement.id != kr.rotateTo {
+			keyringLog.Infof("key %d is now retired", retirement.id)
+			kr.retired[retirement.id] = true
+		}
+	}
+	kr.retirements = pending
+}
+
+// ActiveKey returns the key to encrypt with, together with its id.
+func (kr *Keyring) ActiveKey() (id byte, key []byte, err error) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.rotate()
+	if kr.active == 0 {
+		return 0, nil, fmt.Errorf("%w : no active key", ErrKeyNotFound)
+	}
+	return kr.active, kr.keys[kr.active], nil
+}
+
+// DecryptionKey returns the key of id if it is still allowed to decrypt.
+func (kr *Keyring) DecryptionKey(id byte) (key []byte, err error) {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.rotate()
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w : key %d", ErrKeyNotFound, id)
+	}
+	if kr.retired[id] {
+		return nil, fmt.Errorf("%w : key %d", ErrKeyRetired, id)
+	}
+	return key, nil
+}
+
+// DecryptionKeys returns every key not retired, the active one first.
+// It is used for envelopes made before key ids were embedded.
+func (kr *Keyring) DecryptionKeys() [][]byte {
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+	kr.rotate()
+	keys := make([][]byte, 0, len(kr.keys))
+	if kr.active != 0 {
+		keys = append(keys, kr.keys[kr.active])
+	}
+	for id, key := range kr.keys {
+		if id != kr.active && !kr.retired[id] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
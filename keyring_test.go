@@ -0,0 +1,96 @@
+package hypertrace
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	legacy := "LZYJvvdD2VI7rF+pv5Bm8bkg0ZDvQe/ad5lu6T5YWdwEreVLrCLhUtXjm6hE5AzqmEmeGP8Vdlbnt+c="
+	now := time.Now()
+	keys := NewKeyring()
+	keys.now = func() time.Time { return now }
+	if err := keys.AddKey(1, []byte(ConfigGet("tempid.crypt.key"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.AddKey(2, []byte("thisistheencryptionkey0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.AddKey(3, []byte("short")); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("expect ErrInvalidKeySize, got %v", err)
+	}
+	if err := keys.SetActive(1); err != nil {
+		t.Fatal(err)
+	}
+	before, err := encryptAndEncode([]byte("encrypted with key 1"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.ScheduleRotation(2, now.Add(time.Hour), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := keys.ActiveKey(); id != 1 {
+		t.Fatalf("expect key 1 active before the rotation, got %d", id)
+	}
+	now = now.Add(time.Hour)
+	if id, _, _ := keys.ActiveKey(); id != 2 {
+		t.Fatalf("expect key 2 active after the rotation, got %d", id)
+	}
+	after, err := encryptAndEncode([]byte("encrypted with key 2"), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, crypted := range []string{legacy, before, after} {
+		if _, err := decodeAndDecrypt(crypted, keys); err != nil {
+			t.Errorf("expect %s to decrypt during the grace period, got %v", crypted, err)
+		}
+	}
+
+	now = now.Add(24 * time.Hour)
+	for _, crypted := range []string{legacy, before} {
+		if _, err := decodeAndDecrypt(crypted, keys); err == nil {
+			t.Errorf("expect %s not to decrypt once key 1 is retired", crypted)
+		}
+	}
+	if _, err := decodeAndDecrypt(before, keys); !errors.Is(err, ErrKeyRetired) {
+		t.Errorf("expect ErrKeyRetired, got %v", err)
+	}
+	if data, err := decodeAndDecrypt(after, keys); err != nil || string(data) != "encrypted with key 2" {
+		t.Errorf("expect key 2 to keep decrypting, got %q, %v", data, err)
+	}
+}
+
+func TestKeyringSuccessiveRotations(t *testing.T) {
+	now := time.Now()
+	keys := NewKeyring()
+	keys.now = func() time.Time { return now }
+	for id, key := range map[byte]string{1: "key1key1key1key1key1key1key1key1", 2: "key2key2key2key2key2key2key2key2", 3: "key3key3key3key3key3key3key3key3"} {
+		if err := keys.AddKey(id, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keys.SetActive(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.ScheduleRotation(2, now, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if err := keys.ScheduleRotation(3, now, 48*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(23 * time.Hour)
+	if _, err := keys.DecryptionKey(1); !errors.Is(err, ErrKeyRetired) {
+		t.Errorf("expect key 1 retired despite the second rotation, got %v", err)
+	}
+	if _, err := keys.DecryptionKey(2); err != nil {
+		t.Errorf("expect key 2 still decrypting, got %v", err)
+	}
+	now = now.Add(25 * time.Hour)
+	if _, err := keys.DecryptionKey(2); !errors.Is(err, ErrKeyRetired) {
+		t.Errorf("expect key 2 retired, got %v", err)
+	}
+}
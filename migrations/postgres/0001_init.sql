@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS users (
+    uid VARCHAR(64) NOT NULL PRIMARY KEY,
+    pin VARCHAR(64) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS officers (
+    oid    VARCHAR(128) NOT NULL PRIMARY KEY,
+    secret VARCHAR(256) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS officers_secret_idx ON officers (secret);
+
+CREATE TABLE IF NOT EXISTS trace_data (
+    id        BIGSERIAL    NOT NULL PRIMARY KEY,
+    oid       VARCHAR(128) NOT NULL DEFAULT '',
+    uid       VARCHAR(64)  NOT NULL,
+    cuid      VARCHAR(64)  NOT NULL,
+    timestamp BIGINT       NOT NULL,
+    model_c   VARCHAR(128) NOT NULL DEFAULT '',
+    model_p   VARCHAR(128) NOT NULL DEFAULT '',
+    rssi      INTEGER      NOT NULL DEFAULT 0,
+    tx_power  INTEGER      NOT NULL DEFAULT 0,
+    org       VARCHAR(128) NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS trace_data_uid_idx ON trace_data (uid);
+CREATE INDEX IF NOT EXISTS trace_data_cuid_idx ON trace_data (cuid);
+CREATE INDEX IF NOT EXISTS trace_data_timestamp_idx ON trace_data (timestamp);
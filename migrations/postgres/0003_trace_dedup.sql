@@ -0,0 +1,8 @@
+DELETE FROM trace_data a USING trace_data b
+    WHERE a.id > b.id
+      AND a.uid = b.uid
+      AND a.cuid = b.cuid
+      AND a.timestamp = b.timestamp
+      AND a.model_p = b.model_p;
+
+CREATE UNIQUE INDEX IF NOT EXISTS trace_data_encounter_idx ON trace_data (uid, cuid, timestamp, model_p);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS upload_tokens (
+    jti    VARCHAR(64)  NOT NULL PRIMARY KEY,
+    oid    VARCHAR(128) NOT NULL DEFAULT '',
+    uid    VARCHAR(64)  NOT NULL,
+    nbf    BIGINT       NOT NULL,
+    exp    BIGINT       NOT NULL,
+    status VARCHAR(16)  NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS upload_tokens_oid_idx ON upload_tokens (oid);
+CREATE INDEX IF NOT EXISTS upload_tokens_exp_idx ON upload_tokens (exp);
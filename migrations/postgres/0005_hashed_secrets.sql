@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pin_hash VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE users ALTER COLUMN pin SET DEFAULT '';
+
+ALTER TABLE officers ADD COLUMN IF NOT EXISTS secret_prefix VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE officers ADD COLUMN IF NOT EXISTS secret_hash VARCHAR(128) NOT NULL DEFAULT '';
+ALTER TABLE officers ALTER COLUMN secret SET DEFAULT '';
+
+DROP INDEX IF EXISTS officers_secret_idx;
+CREATE INDEX IF NOT EXISTS officers_secret_prefix_idx ON officers (secret_prefix);
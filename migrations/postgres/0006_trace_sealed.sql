@@ -0,0 +1 @@
+ALTER TABLE trace_data ADD COLUMN IF NOT EXISTS sealed TEXT NOT NULL DEFAULT '';
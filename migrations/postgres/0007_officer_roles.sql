@@ -0,0 +1 @@
+ALTER TABLE officers ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{}';
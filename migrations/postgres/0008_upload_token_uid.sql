@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS upload_tokens_uid_idx ON upload_tokens (uid);
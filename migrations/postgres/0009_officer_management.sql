@@ -0,0 +1,3 @@
+ALTER TABLE officers ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE officers ADD COLUMN IF NOT EXISTS created_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE officers ADD COLUMN IF NOT EXISTS last_used_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    jti VARCHAR(64) NOT NULL PRIMARY KEY,
+    exp BIGINT      NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_exp_idx ON refresh_tokens (exp);
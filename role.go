@@ -0,0 +1,82 @@
+package hypertrace
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// RoleAdmin manages officers and keys and purges trace data.
+	RoleAdmin = "admin"
+	// RoleTracer verifies handshake PINs, issues upload tokens and reads traces.
+	RoleTracer = "tracer"
+	// RoleAuditor reads traces and the audit log, it can not change anything.
+	RoleAuditor = "auditor"
+	// RoleUploader registers users and issues upload tokens.
+	RoleUploader = "uploader"
+)
+
+var (
+	ErrInvalidRole = fmt.Errorf("invalid role")
+
+	knownRoles = map[string]bool{
+		RoleAdmin:    true,
+		RoleTracer:   true,
+		RoleAuditor:  true,
+		RoleUploader: true,
+	}
+)
+
+// ParseRoles parses a comma separated list of roles, returned sorted and without duplicate.
+func ParseRoles(s string) ([]string, error) {
+	roles := make([]string, 0)
+	for _, role := range strings.Split(s, ",") {
+		if role = strings.TrimSpace(role); len(role) > 0 {
+			roles = append(roles, role)
+		}
+	}
+	return NormalizeRoles(roles)
+}
+
+// NormalizeRoles returns roles sorted and without duplicate, or ErrInvalidRole if one of them is unknown.
+func NormalizeRoles(roles []string) ([]string, error) {
+	unique := make(map[string]bool)
+	for _, role := range roles {
+		if !knownRoles[role] {
+			return nil, fmt.Errorf("%w : %q, expect admin, tracer, auditor or uploader", ErrInvalidRole, role)
+		}
+		unique[role] = true
+	}
+	normalized := make([]string, 0, len(unique))
+	for role := range unique {
+		normalized = append(normalized, role)
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// EffectiveRoles returns the roles of the officer. An officer registered before roles existed
+// has the auth.default.roles, so it keeps the access it had.
+func (off *Officer) EffectiveRoles() []string {
+	if len(off.Roles) > 0 {
+		return off.Roles
+	}
+	roles, err := ParseRoles(ConfigGet("auth.default.roles"))
+	if err != nil {
+		authLog.Errorf("invalid auth.default.roles. got %s", err.Error())
+		return []string{}
+	}
+	return roles
+}
+
+func hasAnyRole(held []string, roles ...string) bool {
+	for _, h := range held {
+		for _, role := range roles {
+			if h == role {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package hypertrace
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// SecretPrefixLength is the number of hex characters of the secret lookup prefix.
+	// It is kept short on purpose, it only narrows the officers to verify and tells almost nothing about the secret.
+	SecretPrefixLength = 4
+)
+
+var (
+	ErrPINNotValid = fmt.Errorf("pin not valid")
+
+	// dummySecretHash is verified against when no stored secret matches the lookup prefix,
+	// so an unknown secret takes as long to reject as a wrong one.
+	dummySecretHash, _ = bcrypt.GenerateFromPassword(preHashSecret("hypertrace"), bcrypt.MinCost)
+)
+
+// secretPrefix returns the lookup prefix of secret, the first SecretPrefixLength hex characters of its SHA-256.
+func secretPrefix(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])[:SecretPrefixLength]
+}
+
+// preHashSecret feeds bcrypt with the SHA-256 of secret, so secrets longer than the 72 bytes bcrypt reads are not truncated.
+func preHashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// hashSecret returns the salted bcrypt hash of secret, its cost is secret.hash.cost.
+func hashSecret(secret string) (hash string, err error) {
+	cost := ConfigGetInt("secret.hash.cost")
+	if cost < bcrypt.MinCost {
+		cost = bcrypt.DefaultCost
+	}
+	hashed, err := bcrypt.GenerateFromPassword(preHashSecret(secret), cost)
+	if err != nil {
+		return "", fmt.Errorf("%w : secret hash error", err)
+	}
+	return string(hashed), nil
+}
+
+// verifySecret tells, in constant time, whether secret is the one hashed into hash.
+// An empty hash is verified against a dummy one and never matches.
+func verifySecret(hash, secret string) bool {
+	if len(hash) == 0 {
+		_ = bcrypt.CompareHashAndPassword(dummySecretHash, preHashSecret(secret))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), preHashSecret(secret)) == nil
+}
+
+// verifyOfficerCandidates returns the OID of the officer among candidates, the officers sharing
+// the lookup prefix of secret, whose hash matches secret or ErrSecretNotValid if none does.
+func verifyOfficerCandidates(candidates []*Officer, secret string) (OID string, err error) {
+	if len(candidates) == 0 {
+		verifySecret("", secret)
+	}
+	for _, off := range candidates {
+		if verifySecret(off.SecretHash, secret) {
+			return off.OID, nil
+		}
+	}
+	return "", ErrSecretNotValid
+}
+
+// NewOfficer creates the Officer OID with the lookup prefix and hash of secret, created now.
+func NewOfficer(OID, secret string) (*Officer, error) {
+	hash, err := hashSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &Officer{
+		OID:          OID,
+		SecretPrefix: secretPrefix(secret),
+		SecretHash:   hash,
+		CreatedAt:    time.Now().Unix(),
+	}, nil
+}
+
+// NewUser creates the User UID with the hash of PIN.
+func NewUser(UID, PIN string) (*User, error) {
+	hash, err := hashSecret(PIN)
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		UID:     UID,
+		PINHash: hash,
+	}, nil
+}
+
+// HashLegacySecret replaces the plaintext secret of an officer stored before secrets were hashed,
+// the other fields of the officer are kept. It tells whether the officer was changed.
+func (off *Officer) HashLegacySecret() (changed bool, err error) {
+	if len(off.Secret) == 0 {
+		return false, nil
+	}
+	hash, err := hashSecret(off.Secret)
+	if err != nil {
+		return false, err
+	}
+	off.SecretPrefix = secretPrefix(off.Secret)
+	off.SecretHash = hash
+	off.Secret = ""
+	return true, nil
+}
+
+// HashLegacyPIN replaces the plaintext PIN of a user stored before PINs were hashed.
+// It tells whether the user was changed.
+func (usr *User) HashLegacyPIN() (changed bool, err error) {
+	if len(usr.PIN) == 0 {
+		return false, nil
+	}
+	hashed, err := NewUser(usr.UID, usr.PIN)
+	if err != nil {
+		return false, err
+	}
+	*usr = *hashed
+	return true, nil
+}
@@ -0,0 +1,181 @@
+package hypertrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	seedLog = logrus.WithField("module", "Seed")
+)
+
+// Seed is a fixture of officers, users and traces to load into an ITracing, read from a YAML or JSON file
+// by LoadSeed. It is meant for development and staging servers, its secrets and PINs are in clear text.
+type Seed struct {
+	Officers []*SeedOfficer `json:"officers" yaml:"officers"`
+	Users    []*SeedUser    `json:"users" yaml:"users"`
+	Traces   []*SeedTrace   `json:"traces" yaml:"traces"`
+}
+
+type SeedOfficer struct {
+	OID      string   `json:"oid" yaml:"oid"`
+	Secret   string   `json:"secret" yaml:"secret"`
+	Roles    []string `json:"roles" yaml:"roles"`
+	Disabled bool     `json:"disabled" yaml:"disabled"`
+}
+
+type SeedUser struct {
+	UID string `json:"uid" yaml:"uid"`
+	PIN string `json:"pin" yaml:"pin"`
+}
+
+// SeedTrace is a trace uploaded by UID, with the upload token of the optional OID.
+type SeedTrace struct {
+	UID       string `json:"uid" yaml:"uid"`
+	OID       string `json:"oid" yaml:"oid"`
+	CUID      string `json:"cuid" yaml:"cuid"`
+	Timestamp int64  `json:"timestamp" yaml:"timestamp"`
+	ModelC    string `json:"modelC" yaml:"modelC"`
+	ModelP    string `json:"modelP" yaml:"modelP"`
+	RSSI      int    `json:"rssi" yaml:"rssi"`
+	TxPower   int    `json:"txPower" yaml:"txPower"`
+	Org       string `json:"org" yaml:"org"`
+}
+
+// SeedResult counts what Seed.Apply added, entries already in the database are not counted.
+type SeedResult struct {
+	Officers int
+	Users    int
+	Traces   int
+}
+
+// LoadSeed reads the seed file at path, JSON if it ends with .json, YAML otherwise, and checks its entries.
+// Unknown fields are rejected so a misspelled one is not silently ignored.
+func LoadSeed(path string) (*Seed, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed := &Seed{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(seed)
+	} else {
+		err = yaml.UnmarshalStrict(content, seed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w : seed file %s", err, path)
+	}
+	if err := seed.validate(); err != nil {
+		return nil, fmt.Errorf("%w : seed file %s", err, path)
+	}
+	return seed, nil
+}
+
+func (seed *Seed) validate() error {
+	for i, off := range seed.Officers {
+		if len(off.OID) == 0 || len(off.Secret) == 0 {
+			return fmt.Errorf("%w : officer %d misses its oid or secret", ErrInvalidParameter, i+1)
+		}
+		if _, err := ParseRoles(strings.Join(off.Roles, ",")); err != nil {
+			return fmt.Errorf("%w : officer %s", err, off.OID)
+		}
+	}
+	for i, user := range seed.Users {
+		if len(user.UID) == 0 || len(user.PIN) == 0 {
+			return fmt.Errorf("%w : user %d misses its uid or pin", ErrInvalidParameter, i+1)
+		}
+	}
+	for i, trace := range seed.Traces {
+		if len(trace.UID) == 0 || len(trace.CUID) == 0 {
+			return fmt.Errorf("%w : trace %d misses its uid or cuid", ErrInvalidParameter, i+1)
+		}
+	}
+	return nil
+}
+
+// Apply adds the seed to tracing. It can be applied on every start: officers and users already registered
+// are kept as they are, so secrets rotated or PINs changed since are not reset, and traces already stored
+// are skipped as duplicates.
+func (seed *Seed) Apply(ctx context.Context, tracing ITracing) (result *SeedResult, err error) {
+	result = &SeedResult{}
+	for _, off := range seed.Officers {
+		_, err := tracing.GetOfficer(ctx, off.OID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrOfficerNotFound) {
+			return result, err
+		}
+		if err := tracing.RegisterNewOfficer(ctx, off.OID, off.Secret); err != nil {
+			return result, fmt.Errorf("%w : seeding officer %s", err, off.OID)
+		}
+		update := &OfficerUpdate{}
+		if len(off.Roles) > 0 {
+			update.Roles = off.Roles
+		}
+		if off.Disabled {
+			update.Disabled = &off.Disabled
+		}
+		if !update.IsEmpty() {
+			if err := tracing.UpdateOfficer(ctx, off.OID, update); err != nil {
+				return result, fmt.Errorf("%w : seeding officer %s", err, off.OID)
+			}
+		}
+		result.Officers++
+	}
+	for _, user := range seed.Users {
+		_, err := tracing.GetUser(ctx, user.UID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrUIDNotFound) {
+			return result, err
+		}
+		if err := tracing.RegisterNewUser(ctx, user.UID, user.PIN); err != nil {
+			return result, fmt.Errorf("%w : seeding user %s", err, user.UID)
+		}
+		result.Users++
+	}
+	for _, trace := range seed.Traces {
+		data := []*TraceData{{
+			CUID:      trace.CUID,
+			Timestamp: trace.Timestamp,
+			ModelC:    trace.ModelC,
+			ModelP:    trace.ModelP,
+			RSSI:      trace.RSSI,
+			TxPower:   trace.TxPower,
+			Org:       trace.Org,
+		}}
+		saved, _, err := tracing.SaveTraceData(ctx, trace.UID, trace.OID, data)
+		if err != nil {
+			return result, fmt.Errorf("%w : seeding trace of %s", err, trace.UID)
+		}
+		result.Traces += len(saved)
+	}
+	return result, nil
+}
+
+// SeedTracing applies the seed file at path to tracing.
+func SeedTracing(ctx context.Context, tracing ITracing, path string) error {
+	seed, err := LoadSeed(path)
+	if err != nil {
+		return err
+	}
+	result, err := seed.Apply(ctx, tracing)
+	if err != nil {
+		return err
+	}
+	seedLog.Warnf("seed file %s added %d officers, %d users and %d traces", path, result.Officers, result.Users, result.Traces)
+	return nil
+}
@@ -0,0 +1,93 @@
+package hypertrace
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testSeed registers officer1..5 of secret secret1..5, the officers the handler tests authenticate with.
+var testSeed = &Seed{Officers: []*SeedOfficer{
+	{OID: "officer1", Secret: "secret1"},
+	{OID: "officer2", Secret: "secret2"},
+	{OID: "officer3", Secret: "secret3"},
+	{OID: "officer4", Secret: "secret4"},
+	{OID: "officer5", Secret: "secret5"},
+}}
+
+func newSeededTracing(t *testing.T) ITracing {
+	tracing := NewInMemoryTracing()
+	if _, err := testSeed.Apply(context.Background(), tracing); err != nil {
+		t.Fatal(err)
+	}
+	return tracing
+}
+
+func TestNewInMemoryTracing_NoOfficer(t *testing.T) {
+	if _, err := NewInMemoryTracing().GetOfficerID(context.Background(), "secret1"); !errors.Is(err, ErrSecretNotValid) {
+		t.Fatalf("expect no officer out of the box, got %v", err)
+	}
+}
+
+func TestSeedTracing(t *testing.T) {
+	ctx := context.Background()
+	tracing := NewInMemoryTracing()
+	if err := SeedTracing(ctx, tracing, "seed.example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if oid, err := tracing.GetOfficerID(ctx, "change-me-secret1"); err != nil || oid != "officer1" {
+		t.Fatalf("expect officer1 seeded, got %s, %v", oid, err)
+	}
+	if off, _ := tracing.GetOfficer(ctx, "officer3"); off == nil || len(off.Roles) != 1 || off.Roles[0] != RoleAuditor {
+		t.Errorf("expect officer3 seeded as auditor, got %+v", off)
+	}
+	if err := tracing.VerifyHandshakePIN(ctx, "seedUID00000000000002", "5678"); err != nil {
+		t.Errorf("expect the seeded user to verify, got %v", err)
+	}
+	if traces, _ := tracing.GetTraceData(ctx, "seedUID00000000000001"); len(traces) != 1 || traces[0].OID != "officer2" || traces[0].RSSI != -65 {
+		t.Errorf("expect the seeded trace, got %+v", traces)
+	}
+
+	if err := tracing.RotateOfficerSecret(ctx, "officer1", "rotated"); err != nil {
+		t.Fatal(err)
+	}
+	seed, err := LoadSeed("seed.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := seed.Apply(ctx, tracing)
+	if err != nil || *result != (SeedResult{}) {
+		t.Fatalf("expect seeding again to add nothing, got %+v, %v", result, err)
+	}
+	if oid, err := tracing.GetOfficerID(ctx, "rotated"); err != nil || oid != "officer1" {
+		t.Errorf("expect the rotated secret of officer1 kept, got %s, %v", oid, err)
+	}
+}
+
+func TestLoadSeed(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		valid   bool
+	}{
+		{"json", "seed.json", `{"officers":[{"oid":"officer1","secret":"s","roles":["tracer"]}],"users":[{"uid":"u","pin":"1"}]}`, true},
+		{"json unknown field", "seed.json", `{"officers":[{"oid":"officer1","secrt":"s"}]}`, false},
+		{"yaml unknown field", "seed.yaml", "officers:\n  - oid: officer1\n    secrt: s\n", false},
+		{"missing secret", "seed.yaml", "officers:\n  - oid: officer1\n", false},
+		{"unknown role", "seed.yaml", "officers:\n  - oid: officer1\n    secret: s\n    roles: [root]\n", false},
+		{"trace without cuid", "seed.yaml", "traces:\n  - uid: u\n    timestamp: 1\n", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.file)
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSeed(path); (err == nil) != tt.valid {
+			t.Errorf("%s : expect valid %t, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package hypertrace
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,21 +19,47 @@ var (
 )
 
 func initRoutes() {
+	InitKeys()
+	InitTempIDPolicy()
+	InitTempIDThrottle()
 	InitTracing()
+	InitAudit()
 
 	hmux.UseMiddleware(StaticMiddleware)
-
-	hmux.AddRoute("/registerUid", mux.MethodGet, registerUid)
-	hmux.AddRoute("/getHandshakePin", mux.MethodGet, getHandshakePin)
-
-	hmux.AddRoute("/registerOid", mux.MethodGet, registerOfficer)
-	hmux.AddRoute("/deleteOid", mux.MethodGet, deleteOfficer)
+	hmux.UseMiddleware(AuthMiddleware)
+
+	admin := RequireRole(RoleAdmin)
+	auditor := RequireRole(RoleAdmin, RoleAuditor)
+	hmux.AddRoute("/auth/login", mux.MethodPost, login)
+	hmux.AddRoute("/auth/refresh", mux.MethodPost, refreshSession)
+
+	hmux.AddRoute("/registerUid", mux.MethodGet, RequireRole(RoleUploader, RoleTracer, RoleAdmin)(registerUid))
+	hmux.AddRoute("/verifyHandshakePin", mux.MethodGet, RequireRole(RoleTracer)(verifyHandshakePin))
+
+	hmux.AddRoute("/registerOid", mux.MethodGet, admin(registerOfficer))
+	hmux.AddRoute("/registerOid", mux.MethodPost, admin(registerOfficer))
+	hmux.AddRoute("/deleteOid", mux.MethodGet, admin(deleteOfficer))
+	hmux.AddRoute("/deleteUid", mux.MethodPost, admin(deleteUser))
+	hmux.AddRoute("/admin/officerRoles", mux.MethodGet, admin(getOfficerRoles))
+	hmux.AddRoute("/admin/officerRoles", mux.MethodPost, admin(setOfficerRoles))
+	hmux.AddRoute("/admin/officers", mux.MethodGet, admin(listOfficers))
+	hmux.AddRoute("/admin/officer", mux.MethodGet, admin(getOfficer))
+	hmux.AddRoute("/admin/officer", mux.MethodPost, admin(updateOfficer))
+	hmux.AddRoute("/admin/officer/rotateSecret", mux.MethodPost, admin(rotateOfficerSecret))
+	hmux.AddRoute("/scheduleKeyRotation", mux.MethodGet, admin(scheduleKeyRotation))
+	hmux.AddRoute("/admin/tempIDPolicy", mux.MethodGet, admin(getTempIDPolicy))
+	hmux.AddRoute("/admin/tempIDPolicy", mux.MethodPost, admin(setTempIDPolicy))
+	hmux.AddRoute("/admin/audit", mux.MethodGet, auditor(getAudit))
+	hmux.AddRoute("/admin/audit/verify", mux.MethodGet, auditor(verifyAudit))
 
 	hmux.AddRoute("/getTempIDs", mux.MethodGet, getTempIDs)
-	hmux.AddRoute("/getUploadToken", mux.MethodGet, getUploadToken)
+	hmux.AddRoute("/getTempIDs", mux.MethodPost, getTempIDs)
+	hmux.AddRoute("/getUploadToken", mux.MethodGet, RequireRole(RoleTracer, RoleUploader)(getUploadToken))
+	hmux.AddRoute("/revokeUploadToken", mux.MethodGet, RequireRole(RoleTracer, RoleUploader)(revokeUploadToken))
 	hmux.AddRoute("/uploadData", mux.MethodPost, uploadData)
-	hmux.AddRoute("/getTracing", mux.MethodGet, getTracing)
-	hmux.AddRoute("/purgeTracing", mux.MethodGet, purgeTracing)
+	hmux.AddRoute("/getTracing", mux.MethodGet, RequireRole(RoleTracer, RoleAuditor)(getTracing))
+	hmux.AddRoute("/getContactEpisodes", mux.MethodGet, RequireRole(RoleTracer, RoleAuditor)(getContactEpisodes))
+	hmux.AddRoute("/purgeTracing", mux.MethodGet, admin(purgeTracing))
 	hmux.AddRoute("/health", mux.MethodGet, healthCheck)
 }
 
@@ -79,6 +106,16 @@ func StartServer() {
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	theServer.Shutdown(ctx)
+	if closer, ok := Tracing.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			serverLog.Errorf("error closing tracing storage. got %s", err.Error())
+		}
+	}
+	if closer, ok := Audit.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			serverLog.Errorf("error closing audit log. got %s", err.Error())
+		}
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
@@ -0,0 +1,236 @@
+package hypertrace
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SessionTokenAccess  = "access"
+	SessionTokenRefresh = "refresh"
+	SessionTokenDevice  = "device" // proves a user registration to /getTempIDs
+
+	sessionIssuer     = "hypertrace"
+	sessionAlgorithm  = "HS256"
+	sessionKeyPurpose = "hypertrace session token"
+)
+
+var (
+	ErrSessionTokenNotValid = fmt.Errorf("session token not valid")
+	ErrSessionTokenExpired  = fmt.Errorf("session token expired")
+)
+
+type sessionHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// SessionClaims are the claims of the JWT access and refresh tokens of an officer session,
+// and of the device tokens of a user.
+type SessionClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"` // OID, or UID of a device token
+	Type      string   `json:"typ"` // SessionTokenAccess, SessionTokenRefresh or SessionTokenDevice
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	ID        string   `json:"jti"`
+	Roles     []string `json:"roles,omitempty"` // access only
+	// SecretVersion identifies the secret the session was opened with, or the PIN of a device token.
+	// A refresh token stops working once the officer secret is replaced, a device token once the user
+	// registers again.
+	SecretVersion string `json:"sv,omitempty"`
+}
+
+// SessionTokens is the response of /auth/login and /auth/refresh.
+type SessionTokens struct {
+	Status       string `json:"status"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"` // seconds until the access token expires
+}
+
+// secretVersion returns a short digest of the stored secret hash of off, which is salted
+// so it changes every time the secret is replaced, even by the same secret.
+func secretVersion(off *Officer) string {
+	return hashVersion(off.SecretHash)
+}
+
+// pinVersion is the secretVersion of the PIN of user.
+func pinVersion(user *User) string {
+	return hashVersion(user.PINHash)
+}
+
+func hashVersion(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewDeviceToken makes the device token of user, valid tempid.device.ttl.hour, which the app sends
+// as Bearer token to /getTempIDs instead of the PIN.
+func NewDeviceToken(user *User, keys *Keyring) (string, error) {
+	now := time.Now()
+	return SignSessionToken(&SessionClaims{
+		Subject:       user.UID,
+		Type:          SessionTokenDevice,
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     now.Add(time.Duration(ConfigGetInt("tempid.device.ttl.hour")) * time.Hour).Unix(),
+		SecretVersion: pinVersion(user),
+	}, keys)
+}
+
+// NewSessionTokens opens a session for off: an access token valid auth.access.ttl.minute, carrying the roles
+// of off, and a refresh token valid auth.refresh.ttl.hour, both signed with the active key of keys.
+// Roles are read again from the storage on every refresh.
+func NewSessionTokens(off *Officer, keys *Keyring) (*SessionTokens, error) {
+	now := time.Now()
+	accessTTL := time.Duration(ConfigGetInt("auth.access.ttl.minute")) * time.Minute
+	refreshTTL := time.Duration(ConfigGetInt("auth.refresh.ttl.hour")) * time.Hour
+
+	access, err := SignSessionToken(&SessionClaims{
+		Subject:   off.OID,
+		Type:      SessionTokenAccess,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(accessTTL).Unix(),
+		Roles:     off.EffectiveRoles(),
+	}, keys)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := SignSessionToken(&SessionClaims{
+		Subject:       off.OID,
+		Type:          SessionTokenRefresh,
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     now.Add(refreshTTL).Unix(),
+		SecretVersion: secretVersion(off),
+	}, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTokens{
+		Status:       "SUCCESS",
+		AccessToken:  access,
+		RefreshToken: refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTTL.Seconds()),
+	}, nil
+}
+
+// RefreshSession opens a new session out of refreshToken, as long as its officer still exists with the same secret
+// and is not disabled. A refresh token is used once, the new session comes with a new refresh token and presenting
+// the old one again is refused.
+func RefreshSession(ctx context.Context, tracing ITracing, refreshToken string, keys *Keyring) (*SessionTokens, error) {
+	claims, err := ParseSessionToken(refreshToken, SessionTokenRefresh, keys)
+	if err != nil {
+		return nil, err
+	}
+	off, err := tracing.GetOfficer(ctx, claims.Subject)
+	if errors.Is(err, ErrOfficerNotFound) {
+		return nil, fmt.Errorf("%w : officer %s no longer exists", ErrSessionTokenNotValid, claims.Subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(claims.SecretVersion), []byte(secretVersion(off))) {
+		return nil, fmt.Errorf("%w : secret of officer %s was replaced", ErrSessionTokenNotValid, claims.Subject)
+	}
+	if off.Disabled {
+		return nil, fmt.Errorf("%w : officer %s is disabled", ErrSessionTokenNotValid, claims.Subject)
+	}
+	err = tracing.ConsumeRefreshToken(ctx, claims.ID, claims.ExpiresAt)
+	if errors.Is(err, ErrTokenConsumed) {
+		return nil, fmt.Errorf("%w : refresh token %s was already used", ErrSessionTokenNotValid, claims.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	touchOfficer(ctx, tracing, off)
+	return NewSessionTokens(off, keys)
+}
+
+// SignSessionToken makes the HS256 JWT of claims. It is signed with a key derived from the active key of keys,
+// whose id goes in the kid header. Issuer and ID are filled in.
+func SignSessionToken(claims *SessionClaims, keys *Keyring) (token string, err error) {
+	keyID, key, err := keys.ActiveKey()
+	if err != nil {
+		return "", fmt.Errorf("%w : session token sign error", err)
+	}
+	jti := make([]byte, UploadTokenLength)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("%w : session token id error", err)
+	}
+	claims.Issuer = sessionIssuer
+	claims.ID = hex.EncodeToString(jti)
+
+	headerJson, err := json.Marshal(&sessionHeader{Alg: sessionAlgorithm, Typ: "JWT", Kid: strconv.Itoa(int(keyID))})
+	if err != nil {
+		return "", err
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+	return signingInput + "." + signSessionInput(signingInput, key), nil
+}
+
+func signSessionInput(signingInput string, key []byte) string {
+	mac := hmac.New(sha256.New, deriveKey(key, sessionKeyPurpose))
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseSessionToken verifies the signature and expiry of token and that it is of tokenType.
+// Tokens signed with a key which is no longer in keys, or retired, are not valid.
+func ParseSessionToken(token, tokenType string, keys *Keyring) (*SessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w : malformed token", ErrSessionTokenNotValid)
+	}
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w : malformed header", ErrSessionTokenNotValid)
+	}
+	header := &sessionHeader{}
+	if err := json.Unmarshal(headerJson, header); err != nil || header.Alg != sessionAlgorithm {
+		return nil, fmt.Errorf("%w : unsupported header", ErrSessionTokenNotValid)
+	}
+	keyID, err := parseKeyID(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w : %s", ErrSessionTokenNotValid, err.Error())
+	}
+	key, err := keys.DecryptionKey(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("%w : %s", ErrSessionTokenNotValid, err.Error())
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signSessionInput(parts[0]+"."+parts[1], key))) {
+		return nil, fmt.Errorf("%w : bad signature", ErrSessionTokenNotValid)
+	}
+
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w : malformed claims", ErrSessionTokenNotValid)
+	}
+	claims := &SessionClaims{}
+	if err := json.Unmarshal(claimsJson, claims); err != nil {
+		return nil, fmt.Errorf("%w : malformed claims", ErrSessionTokenNotValid)
+	}
+	if claims.Issuer != sessionIssuer || claims.Type != tokenType || len(claims.Subject) == 0 {
+		return nil, fmt.Errorf("%w : not a %s token", ErrSessionTokenNotValid, tokenType)
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrSessionTokenExpired
+	}
+	return claims, nil
+}
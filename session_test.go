@@ -0,0 +1,131 @@
+package hypertrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionToken(t *testing.T) {
+	keys := NewKeyring()
+	if err := keys.AddKey(1, []byte("thisistheencryptionkey0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.AddKey(2, []byte("thisistheencryptionkey9876543210")); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.SetActive(1); err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims *SessionClaims) string {
+		token, err := SignSessionToken(claims, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	now := time.Now().Unix()
+	valid := sign(&SessionClaims{Subject: "officer1", Type: SessionTokenAccess, IssuedAt: now, ExpiresAt: now + 60})
+
+	claims, err := ParseSessionToken(valid, SessionTokenAccess, keys)
+	if err != nil || claims.Subject != "officer1" {
+		t.Fatalf("expect a valid token of officer1, got %+v, %v", claims, err)
+	}
+
+	parts := strings.Split(valid, ".")
+	forgedClaims, _ := json.Marshal(&SessionClaims{Issuer: sessionIssuer, Subject: "officer2", Type: SessionTokenAccess, ExpiresAt: now + 60})
+	noneHeader, _ := json.Marshal(&sessionHeader{Alg: "none", Typ: "JWT", Kid: "1"})
+	tests := []struct {
+		name      string
+		token     string
+		tokenType string
+		expectErr error
+	}{
+		{"expired", sign(&SessionClaims{Subject: "officer1", Type: SessionTokenAccess, ExpiresAt: now - 1}), SessionTokenAccess, ErrSessionTokenExpired},
+		{"wrong type", valid, SessionTokenRefresh, ErrSessionTokenNotValid},
+		{"forged claims", parts[0] + "." + base64.RawURLEncoding.EncodeToString(forgedClaims) + "." + parts[2], SessionTokenAccess, ErrSessionTokenNotValid},
+		{"alg none", base64.RawURLEncoding.EncodeToString(noneHeader) + "." + parts[1] + ".", SessionTokenAccess, ErrSessionTokenNotValid},
+		{"malformed", "not.a-token", SessionTokenAccess, ErrSessionTokenNotValid},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSessionToken(tt.token, tt.tokenType, keys); !errors.Is(err, tt.expectErr) {
+			t.Errorf("%s : expect %v, got %v", tt.name, tt.expectErr, err)
+		}
+	}
+
+	// tokens keep verifying after a rotation, until their key is retired
+	if err := keys.SetActive(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSessionToken(valid, SessionTokenAccess, keys); err != nil {
+		t.Fatalf("expect the token of key 1 valid after rotation, got %v", err)
+	}
+	if err := keys.Retire(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseSessionToken(valid, SessionTokenAccess, keys); !errors.Is(err, ErrSessionTokenNotValid) {
+		t.Fatalf("expect the token of a retired key not valid, got %v", err)
+	}
+}
+
+func TestLoginAndRefresh(t *testing.T) {
+	Tracing = newSeededTracing(t)
+	defer func() {
+		Tracing = nil
+	}()
+	post := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body)))
+		return recorder
+	}
+
+	if recorder := post(login, `{"secret":"wrong"}`); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("login with a wrong secret : expect %d, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+	recorder := post(login, `{"secret":"secret1"}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("login : expect %d, got %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	tokens := &SessionTokens{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), tokens); err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := ParseSessionToken(tokens.AccessToken, SessionTokenAccess, CryptKeys); err != nil || claims.Subject != "officer1" {
+		t.Fatalf("expect an access token of officer1, got %+v, %v", claims, err)
+	}
+
+	refresh := `{"refreshToken":"` + tokens.RefreshToken + `"}`
+	if recorder := post(refreshSession, `{"refreshToken":"`+tokens.AccessToken+`"}`); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh with an access token : expect %d, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+	recorder = post(refreshSession, refresh)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("refresh : expect %d, got %d %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	refreshed := &SessionTokens{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh : expect a new refresh token")
+	}
+	if recorder := post(refreshSession, refresh); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh token replayed : expect %d, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+	refresh = `{"refreshToken":"` + refreshed.RefreshToken + `"}`
+
+	// replacing the secret, even by the same one, ends the sessions opened with it
+	if err := Tracing.RegisterNewOfficer(context.Background(), "officer1", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := post(refreshSession, refresh); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh after secret change : expect %d, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package hypertrace
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TempIDFormatHypertrace is the hypertrace envelope made by encryptAndEncode, it carries the key id.
+	TempIDFormatHypertrace = "hypertrace"
+	// TempIDFormatBlueTrace is the BlueTrace / OpenTrace layout understood by the stock OpenTrace apps.
+	TempIDFormatBlueTrace = "bluetrace"
+)
+
+// TempIDCodec encrypts the TempID payload, UID start expiry, into the string broadcast by phones and back.
+type TempIDCodec interface {
+	Encode(payload []byte, keys *Keyring) (tempID string, err error)
+	Decode(tempID string, keys *Keyring) (payload []byte, err error)
+}
+
+var tempIDCodecs = map[string]TempIDCodec{
+	TempIDFormatHypertrace: &HypertraceTempIDCodec{},
+	TempIDFormatBlueTrace:  &BlueTraceTempIDCodec{},
+}
+
+// GetTempIDFormat returns the configured tempid.format, falling back to TempIDFormatHypertrace.
+func GetTempIDFormat() string {
+	format := ConfigGet("tempid.format")
+	if _, ok := tempIDCodecs[format]; ok {
+		return format
+	}
+	logrus.Warnf("unknown tempid.format %s, using %s", format, TempIDFormatHypertrace)
+	return TempIDFormatHypertrace
+}
+
+// encodeTempID encrypts payload in the configured tempid.format.
+func encodeTempID(payload []byte, keys *Keyring) (tempID string, err error) {
+	return tempIDCodecs[GetTempIDFormat()].Encode(payload, keys)
+}
+
+// decodeTempID decrypts tempID in the configured tempid.format and, failing that, in the other formats,
+// so the TempIDs handed out before the format was switched keep working.
+func decodeTempID(tempID string, keys *Keyring) (payload []byte, err error) {
+	format := GetTempIDFormat()
+	payload, err = tempIDCodecs[format].Decode(tempID, keys)
+	if err == nil {
+		return payload, nil
+	}
+	for other, codec := range tempIDCodecs {
+		if other == format {
+			continue
+		}
+		if otherPayload, otherErr := codec.Decode(tempID, keys); otherErr == nil {
+			return otherPayload, nil
+		}
+	}
+	return nil, err
+}
+
+// HypertraceTempIDCodec encrypts with encryptAndEncode.
+type HypertraceTempIDCodec struct{}
+
+func (codec *HypertraceTempIDCodec) Encode(payload []byte, keys *Keyring) (tempID string, err error) {
+	return encryptAndEncode(payload, keys)
+}
+
+func (codec *HypertraceTempIDCodec) Decode(tempID string, keys *Keyring) (payload []byte, err error) {
+	return decodeAndDecrypt(tempID, keys)
+}
+
+// BlueTraceTempIDCodec follows the BlueTrace protocol: base64 of the payload encrypted with AES-256-GCM,
+// followed by the IV_SIZE bytes IV and the AUTHTAG_SIZE bytes auth tag.
+// The layout has no room for a key id, so decoding tries every key not retired.
+type BlueTraceTempIDCodec struct{}
+
+func newBlueTraceGCM(key []byte) (cipher.AEAD, error) {
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w : bluetrace cipher error", err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(aesBlock, IV_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("%w : bluetrace cipher error", err)
+	}
+	return gcm, nil
+}
+
+func (codec *BlueTraceTempIDCodec) Encode(payload []byte, keys *Keyring) (tempID string, err error) {
+	_, key, err := keys.ActiveKey()
+	if err != nil {
+		return "", fmt.Errorf("%w : bluetrace encode error", err)
+	}
+	gcm, err := newBlueTraceGCM(key)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, IV_SIZE)
+	if _, err = rand.Read(iv); err != nil {
+		return "", fmt.Errorf("%w : bluetrace encode error", err)
+	}
+	// Seal yields the cypher text followed by the auth tag, the IV goes in between
+	sealed := gcm.Seal(nil, iv, payload, nil)
+	cypherLen := len(sealed) - AUTHTAG_SIZE
+	encoded := make([]byte, 0, len(sealed)+IV_SIZE)
+	encoded = append(encoded, sealed[:cypherLen]...)
+	encoded = append(encoded, iv...)
+	encoded = append(encoded, sealed[cypherLen:]...)
+	return base64.StdEncoding.EncodeToString(encoded), nil
+}
+
+func (codec *BlueTraceTempIDCodec) Decode(tempID string, keys *Keyring) (payload []byte, err error) {
+	encoded, err := base64.StdEncoding.DecodeString(tempID)
+	if err != nil {
+		return nil, fmt.Errorf("%w : base64 decode error", err)
+	}
+	if len(encoded) <= IV_SIZE+AUTHTAG_SIZE {
+		return nil, fmt.Errorf("bluetrace decode error : %d bytes is too short", len(encoded))
+	}
+	cypherLen := len(encoded) - IV_SIZE - AUTHTAG_SIZE
+	iv := encoded[cypherLen : cypherLen+IV_SIZE]
+	sealed := make([]byte, 0, cypherLen+AUTHTAG_SIZE)
+	sealed = append(sealed, encoded[:cypherLen]...)
+	sealed = append(sealed, encoded[cypherLen+IV_SIZE:]...)
+
+	err = ErrKeyNotFound
+	for _, key := range keys.DecryptionKeys() {
+		gcm, gcmErr := newBlueTraceGCM(key)
+		if gcmErr != nil {
+			return nil, gcmErr
+		}
+		if payload, err = gcm.Open(nil, iv, sealed, nil); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, fmt.Errorf("%w : bluetrace decrypt error", err)
+}
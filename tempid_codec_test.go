@@ -0,0 +1,37 @@
+package hypertrace
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestBlueTraceTempIDCodec(t *testing.T) {
+	// made by the OpenTrace cloud functions encryptTempID with IV 000102...0f
+	openTrace := "0/muhTscpJYs/uqaoVZhaZH4jrQ7LxcR9Nlln14AAQIDBAUGBwgJCgsMDQ4P0Zx7D5yIc7eAQ+I0vlEI7A=="
+	uid, start, expiry, err := GetTempIDData(CryptKeys, openTrace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != "opentraceUID000000001" || start != 1600000000 || expiry != 1600003600 {
+		t.Errorf("unexpected opentrace tempID data %s %d %d", uid, start, expiry)
+	}
+
+	SetConfig("tempid.format", TempIDFormatBlueTrace)
+	defer SetConfig("tempid.format", TempIDFormatHypertrace)
+	tempID, err := currentTempID("bluetraceUID000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := base64.StdEncoding.DecodeString(tempID.TempID)
+	if len(encoded) != TEMPID_SIZE+IV_SIZE+AUTHTAG_SIZE {
+		t.Errorf("expect %d bytes bluetrace tempID, got %d", TEMPID_SIZE+IV_SIZE+AUTHTAG_SIZE, len(encoded))
+	}
+	if uid, _, _, err := GetTempIDData(CryptKeys, tempID.TempID); err != nil || uid != "bluetraceUID000000001" {
+		t.Errorf("expect bluetrace tempID to decode, got %s, %v", uid, err)
+	}
+
+	SetConfig("tempid.format", TempIDFormatHypertrace)
+	if uid, _, _, err := GetTempIDData(CryptKeys, tempID.TempID); err != nil || uid != "bluetraceUID000000001" {
+		t.Errorf("expect bluetrace tempID to decode after switching format, got %s, %v", uid, err)
+	}
+}
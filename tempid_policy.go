@@ -0,0 +1,146 @@
+package hypertrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tempIDBatchSizeMax bounds the TempIDs encrypted for a single request.
+	tempIDBatchSizeMax = 1000
+	// tempIDRefreshAfterMinute is how long after an issuance the app refreshed before the policy existed.
+	tempIDRefreshAfterMinute = 24 * 60
+)
+
+var (
+	ErrInvalidTempIDPolicy  = fmt.Errorf("invalid tempid policy")
+	ErrTempIDPolicyNotFound = fmt.Errorf("tempid policy not found")
+
+	tempIDPolicy      *TempIDPolicy
+	tempIDPolicyMutex sync.RWMutex
+)
+
+// TempIDPolicy is how /getTempIDs schedules a batch of TempIDs. The TempIDs of a batch follow each other
+// every PeriodMinute, each one valid from OverlapSecond before its period starts, so a phone with a slightly
+// late clock or switching TempID never goes without a valid one. The app asks for the next batch at the
+// refresh time, RefreshLeadMinute before the last TempID expires.
+type TempIDPolicy struct {
+	PeriodMinute      int  `json:"periodMinute"`
+	OverlapSecond     int  `json:"overlapSecond"`
+	BatchSize         int  `json:"batchSize"`
+	RefreshLeadMinute int  `json:"refreshLeadMinute"`
+	Align             bool `json:"align"` // start the periods at multiples of PeriodMinute since the epoch, eg. on the hour
+	// RefreshLeadDefault is true while RefreshLeadMinute was never set, it then follows the batch, see DefaultRefreshLead
+	RefreshLeadDefault bool `json:"refreshLeadDefault,omitempty"`
+}
+
+// NewTempIDPolicyFromConfig reads the tempid.* policy keys. tempid.period.minute defaults to
+// the deprecated tempid.valid.period.hour. tempid.refresh.lead.minute defaults to a refresh a day after
+// the issuance, as before the policy existed, or when the last TempID expires for a batch shorter than a day.
+func NewTempIDPolicyFromConfig() (*TempIDPolicy, error) {
+	policy := &TempIDPolicy{
+		PeriodMinute:      ConfigGetInt("tempid.period.minute"),
+		OverlapSecond:     ConfigGetInt("tempid.overlap.second"),
+		BatchSize:         ConfigGetInt("tempid.count"),
+		RefreshLeadMinute: ConfigGetInt("tempid.refresh.lead.minute"),
+		Align:             ConfigGetBoolean("tempid.align"),
+	}
+	if policy.PeriodMinute == 0 {
+		policy.PeriodMinute = ConfigGetInt("tempid.valid.period.hour") * 60
+	}
+	if len(ConfigGet("tempid.refresh.lead.minute")) == 0 {
+		policy.RefreshLeadDefault = true
+		policy.DefaultRefreshLead()
+	}
+	return policy, policy.Validate()
+}
+
+// DefaultRefreshLead sets RefreshLeadMinute for a refresh a day after the issuance, as before the policy existed,
+// or when the last TempID expires for a batch shorter than a day.
+func (policy *TempIDPolicy) DefaultRefreshLead() {
+	policy.RefreshLeadMinute = policy.PeriodMinute*policy.BatchSize - tempIDRefreshAfterMinute
+	if policy.RefreshLeadMinute < 0 {
+		policy.RefreshLeadMinute = 0
+	}
+}
+
+// Validate checks the policy schedules TempIDs without gaps and lets the app refresh before they run out.
+func (policy *TempIDPolicy) Validate() error {
+	switch {
+	case policy.PeriodMinute < 1:
+		return fmt.Errorf("%w : period must be at least a minute", ErrInvalidTempIDPolicy)
+	case policy.BatchSize < 1 || policy.BatchSize > tempIDBatchSizeMax:
+		return fmt.Errorf("%w : batch size must be within 1 and %d", ErrInvalidTempIDPolicy, tempIDBatchSizeMax)
+	case policy.OverlapSecond < 0 || policy.OverlapSecond >= policy.PeriodMinute*60:
+		return fmt.Errorf("%w : overlap must be positive and shorter than the period", ErrInvalidTempIDPolicy)
+	case policy.RefreshLeadMinute < 0 || policy.RefreshLeadMinute >= policy.PeriodMinute*policy.BatchSize:
+		return fmt.Errorf("%w : refresh lead must be positive and shorter than the batch", ErrInvalidTempIDPolicy)
+	}
+	return nil
+}
+
+// batchStart is when the period of the first TempID of a batch issued at now starts.
+func (policy *TempIDPolicy) batchStart(now time.Time) int64 {
+	start := now.Unix()
+	if policy.Align {
+		period := int64(policy.PeriodMinute) * 60
+		start -= start % period
+	}
+	return start
+}
+
+// Window returns the validity of the TempID i of a batch issued at now.
+func (policy *TempIDPolicy) Window(now time.Time, i int) (start, expiry uint32) {
+	period := int64(policy.PeriodMinute) * 60
+	periodStart := policy.batchStart(now) + period*int64(i)
+	return uint32(periodStart - int64(policy.OverlapSecond)), uint32(periodStart + period)
+}
+
+// RefreshTime returns when the app should ask for the batch following the one issued at now.
+func (policy *TempIDPolicy) RefreshTime(now time.Time) uint32 {
+	end := policy.batchStart(now) + int64(policy.PeriodMinute)*60*int64(policy.BatchSize)
+	refresh := end - int64(policy.RefreshLeadMinute)*60
+	if refresh < now.Unix() {
+		refresh = now.Unix()
+	}
+	return uint32(refresh)
+}
+
+// InitTempIDPolicy reads the configured TempIDPolicy, in force while no policy is stored.
+// It stops the server right away if the configuration is not a valid policy.
+func InitTempIDPolicy() {
+	policy, err := NewTempIDPolicyFromConfig()
+	if err != nil {
+		logrus.Fatalf("invalid tempid policy configuration. got %s", err.Error())
+		return
+	}
+	tempIDPolicyMutex.Lock()
+	defer tempIDPolicyMutex.Unlock()
+	tempIDPolicy = policy
+}
+
+// ConfiguredTempIDPolicy returns a copy of the TempIDPolicy read by InitTempIDPolicy.
+func ConfiguredTempIDPolicy() *TempIDPolicy {
+	tempIDPolicyMutex.RLock()
+	defer tempIDPolicyMutex.RUnlock()
+	policy := *tempIDPolicy
+	return &policy
+}
+
+// CurrentTempIDPolicy returns the TempIDPolicy in force: the one stored in tracing by /admin/tempIDPolicy,
+// shared by every server and kept across restarts, or the configured one if none is stored.
+func CurrentTempIDPolicy(ctx context.Context, tracing ITracing) (*TempIDPolicy, error) {
+	policy, err := tracing.GetTempIDPolicy(ctx)
+	if errors.Is(err, ErrTempIDPolicyNotFound) {
+		return ConfiguredTempIDPolicy(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
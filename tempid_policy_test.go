@@ -0,0 +1,69 @@
+package hypertrace
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTempIDPolicy_Schedule(t *testing.T) {
+	quarter := int64(1_000_000_800) // a multiple of 15 minutes
+	now := time.Unix(quarter+334, 0)
+
+	policy := &TempIDPolicy{PeriodMinute: 15, OverlapSecond: 30, BatchSize: 4, RefreshLeadMinute: 20}
+	if start, expiry := policy.Window(now, 0); start != uint32(now.Unix()-30) || expiry != uint32(now.Unix()+900) {
+		t.Errorf("expect the first TempID valid from 30 seconds ago for 15 minutes, got %d to %d", start, expiry)
+	}
+	_, previousExpiry := policy.Window(now, 1)
+	if start, _ := policy.Window(now, 2); start >= previousExpiry {
+		t.Errorf("expect consecutive TempIDs to overlap, got start %d after expiry %d", start, previousExpiry)
+	}
+	if refresh := policy.RefreshTime(now); refresh != uint32(now.Unix()+4*900-20*60) {
+		t.Errorf("expect a refresh 20 minutes before the batch ends, got %d", refresh)
+	}
+
+	policy.Align = true
+	aligned := quarter
+	if start, expiry := policy.Window(now, 1); start != uint32(aligned+900-30) || expiry != uint32(aligned+1800) {
+		t.Errorf("expect the second TempID on the next quarter, got %d to %d", start, expiry)
+	}
+	if refresh := policy.RefreshTime(now); refresh != uint32(aligned+4*900-20*60) {
+		t.Errorf("expect an aligned refresh, got %d", refresh)
+	}
+}
+
+func TestTempIDPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy TempIDPolicy
+		valid  bool
+	}{
+		{"default", TempIDPolicy{PeriodMinute: 60, OverlapSecond: 60, BatchSize: 100, RefreshLeadMinute: 1440}, true},
+		{"no period", TempIDPolicy{PeriodMinute: 0, BatchSize: 1}, false},
+		{"empty batch", TempIDPolicy{PeriodMinute: 60, BatchSize: 0}, false},
+		{"huge batch", TempIDPolicy{PeriodMinute: 60, BatchSize: tempIDBatchSizeMax + 1}, false},
+		{"overlap of a period", TempIDPolicy{PeriodMinute: 1, OverlapSecond: 60, BatchSize: 1}, false},
+		{"lead of the batch", TempIDPolicy{PeriodMinute: 60, BatchSize: 2, RefreshLeadMinute: 120}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid || (err != nil && !errors.Is(err, ErrInvalidTempIDPolicy)) {
+			t.Errorf("%s : expect valid %t, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestNewTempIDPolicyFromConfig(t *testing.T) {
+	defer SetConfig("tempid.period.minute", "")
+	policy, err := NewTempIDPolicyFromConfig()
+	if err != nil || policy.PeriodMinute != 60 || policy.BatchSize != 100 || policy.OverlapSecond != 60 {
+		t.Fatalf("expect the period of tempid.valid.period.hour by default, got %+v, %v", policy, err)
+	}
+	now := time.Unix(1_000_000_334, 0)
+	if refresh := policy.RefreshTime(now); refresh != uint32(now.Unix()+24*3600) {
+		t.Errorf("expect the default refresh a day after the issuance, got %d", int64(refresh)-now.Unix())
+	}
+	SetConfig("tempid.period.minute", "10")
+	if policy, err := NewTempIDPolicyFromConfig(); err != nil || policy.PeriodMinute != 10 || policy.RefreshLeadMinute != 0 {
+		t.Fatalf("expect a batch shorter than a day refreshed when it ends, got %+v, %v", policy, err)
+	}
+}
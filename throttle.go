@@ -0,0 +1,80 @@
+package hypertrace
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle allows at most limit events per key within a fixed window, a limit of zero or less allows everything.
+// It is kept in memory and safe for concurrent use, servers behind a load balancer each throttle on their own.
+type Throttle struct {
+	limit     int
+	window    time.Duration
+	windows   map[string]*throttleWindow
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+type throttleWindow struct {
+	start time.Time
+	count int
+}
+
+func NewThrottle(limit int, window time.Duration) *Throttle {
+	return &Throttle{
+		limit:     limit,
+		window:    window,
+		windows:   make(map[string]*throttleWindow),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow counts an event of key. Beyond the limit it returns false and how long until the window of key ends.
+func (throttle *Throttle) Allow(key string) (allowed bool, retryAfter time.Duration) {
+	if throttle.limit <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	w := throttle.current(key, now)
+	if w.count >= throttle.limit {
+		return false, w.start.Add(throttle.window).Sub(now)
+	}
+	w.count++
+	return true, 0
+}
+
+// Exceeded tells whether key already reached the limit, and how long until its window ends, without counting an event.
+func (throttle *Throttle) Exceeded(key string) (exceeded bool, retryAfter time.Duration) {
+	if throttle.limit <= 0 {
+		return false, 0
+	}
+	now := time.Now()
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	w := throttle.current(key, now)
+	if w.count >= throttle.limit {
+		return true, w.start.Add(throttle.window).Sub(now)
+	}
+	return false, 0
+}
+
+// current returns the current window of key, sweeping the ended windows of every key once per window.
+// The caller holds the mutex.
+func (throttle *Throttle) current(key string, now time.Time) *throttleWindow {
+	if now.Sub(throttle.lastSweep) >= throttle.window {
+		for k, w := range throttle.windows {
+			if now.Sub(w.start) >= throttle.window {
+				delete(throttle.windows, k)
+			}
+		}
+		throttle.lastSweep = now
+	}
+	w, ok := throttle.windows[key]
+	if !ok || now.Sub(w.start) >= throttle.window {
+		w = &throttleWindow{start: now}
+		throttle.windows[key] = w
+	}
+	return w
+}
@@ -0,0 +1,790 @@
+package hypertrace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTracingConformance runs the ITracing behaviour every backend must agree on.
+// newTracing must return an empty storage (apart from anything the constructor seeds).
+func testTracingConformance(t *testing.T, newTracing func(t *testing.T) ITracing) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, tracing ITracing)
+	}{
+		{"InvalidParameter", conformInvalidParameter},
+		{"UserRegistration", conformUserRegistration},
+		{"SaveAndGetTraceData", conformSaveAndGetTraceData},
+		{"PurgeBoundary", conformPurgeBoundary},
+		{"Deduplication", conformDeduplication},
+		{"Pagination", conformPagination},
+		{"QueryFilter", conformQueryFilter},
+		{"OfficerLifecycle", conformOfficerLifecycle},
+		{"OfficerManagement", conformOfficerManagement},
+		{"UploadTokenLifecycle", conformUploadTokenLifecycle},
+		{"RefreshTokenReuse", conformRefreshTokenReuse},
+		{"TempIDPolicy", conformTempIDPolicy},
+		{"DeleteUser", conformDeleteUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newTracing(t))
+		})
+	}
+}
+
+func conformInvalidParameter(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	checks := map[string]error{
+		"RegisterNewUser empty UID":     tracing.RegisterNewUser(ctx, "", "1234"),
+		"RegisterNewUser empty PIN":     tracing.RegisterNewUser(ctx, "conformUID00000000001", ""),
+		"RegisterNewOfficer empty OID":  tracing.RegisterNewOfficer(ctx, "", "conform-secret"),
+		"RegisterNewOfficer empty sec":  tracing.RegisterNewOfficer(ctx, "conform-officer", ""),
+		"DeleteOfficer empty OID":       tracing.DeleteOfficer(ctx, ""),
+		"SetOfficerRoles empty OID":     tracing.SetOfficerRoles(ctx, "", []string{RoleTracer}),
+		"UpdateOfficer empty OID":       tracing.UpdateOfficer(ctx, "", &OfficerUpdate{Roles: []string{RoleTracer}}),
+		"UpdateOfficer empty update":    tracing.UpdateOfficer(ctx, "conform-officer", &OfficerUpdate{}),
+		"TouchOfficer empty OID":        tracing.TouchOfficer(ctx, "", 1),
+		"RotateOfficerSecret empty OID": tracing.RotateOfficerSecret(ctx, "", "conform-secret"),
+		"RotateOfficerSecret empty sec": tracing.RotateOfficerSecret(ctx, "conform-officer", ""),
+	}
+	_, _, checks["SaveTraceData empty UID"] = tracing.SaveTraceData(ctx, "", "conform-officer", []*TraceData{{CUID: "x"}})
+	checks["VerifyHandshakePIN empty UID"] = tracing.VerifyHandshakePIN(ctx, "", "1234")
+	_, checks["GetUser empty UID"] = tracing.GetUser(ctx, "")
+	_, checks["DeleteUser empty UID"] = tracing.DeleteUser(ctx, "")
+	_, checks["GetTraceData empty UID"] = tracing.GetTraceData(ctx, "")
+	_, checks["GetOfficerID empty secret"] = tracing.GetOfficerID(ctx, "")
+	_, checks["GetOfficer empty OID"] = tracing.GetOfficer(ctx, "")
+	for name, err := range checks {
+		if !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("%s : expect ErrInvalidParameter, got %v", name, err)
+		}
+	}
+}
+
+func conformUserRegistration(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	uid := "conformUID00000000001"
+
+	if err := tracing.VerifyHandshakePIN(ctx, uid, "1111"); !errors.Is(err, ErrUIDNotFound) {
+		t.Fatalf("unregistered uid : expect ErrUIDNotFound, got %v", err)
+	}
+	if _, err := tracing.GetUser(ctx, uid); !errors.Is(err, ErrUIDNotFound) {
+		t.Fatalf("GetUser of unregistered uid : expect ErrUIDNotFound, got %v", err)
+	}
+	if err := tracing.RegisterNewUser(ctx, uid, "1111"); err != nil {
+		t.Fatalf("RegisterNewUser got %v", err)
+	}
+	user, err := tracing.GetUser(ctx, uid)
+	if err != nil || user.UID != uid || len(user.PINHash) == 0 || len(user.PIN) != 0 {
+		t.Fatalf("expect GetUser to return the hashed pin of %s, got %+v, %v", uid, user, err)
+	}
+	if err := tracing.VerifyHandshakePIN(ctx, uid, "1111"); err != nil {
+		t.Fatalf("expect pin 1111 to verify, got %v", err)
+	}
+	if err := tracing.VerifyHandshakePIN(ctx, uid, "9999"); !errors.Is(err, ErrPINNotValid) {
+		t.Fatalf("wrong pin : expect ErrPINNotValid, got %v", err)
+	}
+	if err := tracing.RegisterNewUser(ctx, uid, "2222"); err != nil {
+		t.Fatalf("re-RegisterNewUser got %v", err)
+	}
+	if err := tracing.VerifyHandshakePIN(ctx, uid, "2222"); err != nil {
+		t.Fatalf("expect re-registration to replace pin with 2222, got %v", err)
+	}
+	if replaced, _ := tracing.GetUser(ctx, uid); replaced == nil || replaced.PINHash == user.PINHash {
+		t.Fatalf("expect re-registration to replace the pin hash, got %+v", replaced)
+	}
+	if err := tracing.VerifyHandshakePIN(ctx, uid, "1111"); !errors.Is(err, ErrPINNotValid) {
+		t.Fatalf("replaced pin : expect ErrPINNotValid, got %v", err)
+	}
+}
+
+func conformSaveAndGetTraceData(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	uid := "conformUID00000000001"
+	other := "conformUID00000000002"
+
+	_, _, err := tracing.SaveTraceData(ctx, uid, "conform-officer", []*TraceData{
+		{UID: "spoofed", OID: "spoofed", CUID: other, Timestamp: 100, ModelC: "c", ModelP: "p", RSSI: -60, TxPower: 7, Org: "ORG"},
+		{CUID: other, Timestamp: 200, Sealed: "sealed"},
+	})
+	if err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, other, "", []*TraceData{{CUID: uid, Timestamp: 150}}); err != nil {
+		t.Fatalf("SaveTraceData with empty OID got %v", err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, other, "conform-officer", nil); err != nil {
+		t.Fatalf("SaveTraceData with no data got %v", err)
+	}
+
+	traces, err := tracing.GetTraceData(ctx, uid)
+	if err != nil {
+		t.Fatalf("GetTraceData got %v", err)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("expect 2 traces, got %d", len(traces))
+	}
+	for _, td := range traces {
+		if td.UID != uid || td.OID != "conform-officer" || td.CUID != other {
+			t.Errorf("unexpected trace %+v", td)
+		}
+		if td.Timestamp == 100 && (td.ModelC != "c" || td.ModelP != "p" || td.RSSI != -60 || td.TxPower != 7 || td.Org != "ORG") {
+			t.Errorf("trace fields not preserved %+v", td)
+		}
+		if _, encrypted := tracing.(*EncryptedTracing); !encrypted && td.Timestamp == 200 && td.Sealed != "sealed" {
+			t.Errorf("sealed field not preserved %+v", td)
+		}
+	}
+
+	traces, err = tracing.GetTraceData(ctx, "conformUID00000000404")
+	if err != nil {
+		t.Fatalf("GetTraceData unknown uid got %v", err)
+	}
+	if traces == nil || len(traces) != 0 {
+		t.Fatalf("expect empty non nil traces for unknown uid, got %v", traces)
+	}
+}
+
+func conformPurgeBoundary(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	uid := "conformUID00000000001"
+	other := "conformUID00000000002"
+
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "conform-officer", []*TraceData{
+		{CUID: other, Timestamp: 999},
+		{CUID: other, Timestamp: 1000},
+		{CUID: other, Timestamp: 1001},
+	}); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, other, "conform-officer", []*TraceData{{CUID: uid, Timestamp: 1}}); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+	purged, err := tracing.PurgeOldTraceData(ctx, 1000)
+	if err != nil {
+		t.Fatalf("PurgeOldTraceData got %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("expect 2 purged traces, got %d", purged)
+	}
+
+	traces, err := tracing.GetTraceData(ctx, uid)
+	if err != nil {
+		t.Fatalf("GetTraceData got %v", err)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("expect 2 traces left, got %d", len(traces))
+	}
+	for _, td := range traces {
+		if td.Timestamp < 1000 {
+			t.Errorf("trace older than purge boundary left %+v", td)
+		}
+	}
+	if traces, _ := tracing.GetTraceData(ctx, other); len(traces) != 0 {
+		t.Errorf("expect purge to apply to every uid, got %d traces left", len(traces))
+	}
+}
+
+func conformDeduplication(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	uid := "conformUID00000000001"
+	other := "conformUID00000000002"
+	batch := func() []*TraceData {
+		return []*TraceData{
+			{CUID: other, Timestamp: 100, ModelP: "p1", RSSI: -60},
+			{CUID: other, Timestamp: 100, ModelP: "p2"},
+			{CUID: other, Timestamp: 200, ModelP: "p1"},
+		}
+	}
+
+	saved, duplicates, err := tracing.SaveTraceData(ctx, uid, "conform-officer", batch())
+	if err != nil || len(saved) != 3 || duplicates != 0 {
+		t.Fatalf("first upload : expect 3 inserted 0 duplicates, got %d, %d, %v", len(saved), duplicates, err)
+	}
+	retry := append(batch(), &TraceData{CUID: other, Timestamp: 300, ModelP: "p1"})
+	retry[0].RSSI = -70
+	saved, duplicates, err = tracing.SaveTraceData(ctx, uid, "another-officer", retry)
+	if err != nil || len(saved) != 1 || duplicates != 3 {
+		t.Fatalf("re-upload : expect 1 inserted 3 duplicates, got %d, %d, %v", len(saved), duplicates, err)
+	}
+	if saved[0].Timestamp != 300 {
+		t.Errorf("re-upload : expect the new record saved, got %+v", saved[0])
+	}
+	saved, duplicates, err = tracing.SaveTraceData(ctx, uid, "conform-officer", []*TraceData{
+		{CUID: other, Timestamp: 400, ModelP: "p1"},
+		{CUID: other, Timestamp: 400, ModelP: "p1"},
+	})
+	if err != nil || len(saved) != 1 || duplicates != 1 {
+		t.Fatalf("in batch duplicate : expect 1 inserted 1 duplicates, got %d, %d, %v", len(saved), duplicates, err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, other, "conform-officer", []*TraceData{{CUID: uid, Timestamp: 100, ModelP: "p1"}}); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+
+	traces, err := tracing.GetTraceData(ctx, uid)
+	if err != nil {
+		t.Fatalf("GetTraceData got %v", err)
+	}
+	if len(traces) != 5 {
+		t.Fatalf("expect 5 traces stored, got %d", len(traces))
+	}
+	for _, td := range traces {
+		if td.Timestamp == 100 && td.ModelP == "p1" && (td.RSSI != -60 || td.OID != "conform-officer") {
+			t.Errorf("expect the first stored record to be kept, got %+v", td)
+		}
+	}
+	if traces, _ := tracing.GetTraceData(ctx, other); len(traces) != 1 {
+		t.Errorf("expect the mirrored encounter of the other uid to be kept, got %d traces", len(traces))
+	}
+
+	if _, err := tracing.PurgeOldTraceData(ctx, 150); err != nil {
+		t.Fatalf("PurgeOldTraceData got %v", err)
+	}
+	saved, duplicates, err = tracing.SaveTraceData(ctx, uid, "conform-officer", batch())
+	if err != nil || len(saved) != 2 || duplicates != 1 {
+		t.Fatalf("upload after purge : expect 2 inserted 1 duplicates, got %d, %d, %v", len(saved), duplicates, err)
+	}
+}
+
+func conformPagination(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	uid := "conformUID00000000001"
+	other := "conformUID00000000002"
+
+	data := make([]*TraceData, 0)
+	for i := 0; i < 7; i++ {
+		data = append(data, &TraceData{CUID: other, Timestamp: int64(100 + i)})
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "conform-officer", data); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, other, "conform-officer", []*TraceData{{CUID: uid, Timestamp: 100}}); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+
+	if _, _, err := tracing.QueryTraceData(ctx, &TraceFilter{UID: uid}, "", 0); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("zero page size : expect ErrInvalidParameter, got %v", err)
+	}
+	if _, _, err := tracing.QueryTraceData(ctx, &TraceFilter{}, "", 3); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("empty UID : expect ErrInvalidParameter, got %v", err)
+	}
+	if _, _, err := tracing.QueryTraceData(ctx, &TraceFilter{UID: uid}, "%%%", 3); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("malformed cursor : expect ErrInvalidCursor, got %v", err)
+	}
+
+	seen := make(map[int64]bool)
+	cursor := ""
+	pages := 0
+	for {
+		traces, next, err := tracing.QueryTraceData(ctx, &TraceFilter{UID: uid}, cursor, 3)
+		if err != nil {
+			t.Fatalf("QueryTraceData got %v", err)
+		}
+		pages++
+		if len(traces) > 3 {
+			t.Fatalf("expect at most 3 traces per page, got %d", len(traces))
+		}
+		for _, td := range traces {
+			if td.UID != uid || seen[td.Timestamp] {
+				t.Fatalf("unexpected or repeated trace %+v", td)
+			}
+			seen[td.Timestamp] = true
+		}
+		if len(next) == 0 {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 7 || pages != 3 {
+		t.Fatalf("expect 7 traces over 3 pages, got %d traces over %d pages", len(seen), pages)
+	}
+
+	traces, next, err := tracing.QueryTraceData(ctx, &TraceFilter{UID: "conformUID00000000404"}, "", 3)
+	if err != nil || len(traces) != 0 || len(next) != 0 {
+		t.Fatalf("unknown uid : expect empty last page, got %v, %q, %v", traces, next, err)
+	}
+
+	traces, next, err = tracing.QueryTraceData(ctx, &TraceFilter{UID: uid}, "", 3)
+	if err != nil || len(traces) != 3 || len(next) == 0 {
+		t.Fatalf("expect a first page of 3 traces, got %v, %q, %v", traces, next, err)
+	}
+	if _, err := tracing.PurgeOldTraceData(ctx, 101); err != nil {
+		t.Fatalf("PurgeOldTraceData got %v", err)
+	}
+	traces, _, err = tracing.QueryTraceData(ctx, &TraceFilter{UID: uid}, next, 3)
+	if err != nil || len(traces) == 0 || traces[0].Timestamp != 103 {
+		t.Fatalf("purge between pages : expect the next page to start at 103, got %v, %v", traces, err)
+	}
+}
+
+func conformQueryFilter(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	uid := "conformUID00000000001"
+	contactA := "conformUID00000000002"
+	contactB := "conformUID00000000003"
+
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "officer-a", []*TraceData{
+		{CUID: contactA, Timestamp: 100, RSSI: -90, Org: "ORG1"},
+		{CUID: contactA, Timestamp: 200, RSSI: -50, Org: "ORG1"},
+		{CUID: contactB, Timestamp: 300, RSSI: -60, Org: "ORG2"},
+	}); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "officer-b", []*TraceData{
+		{CUID: contactB, Timestamp: 400, RSSI: -70, Org: "ORG2"},
+	}); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+
+	minRSSI := -65
+	tests := []struct {
+		name   string
+		filter *TraceFilter
+		expect []int64
+	}{
+		{"uid only", &TraceFilter{UID: uid}, []int64{100, 200, 300, 400}},
+		{"time window inclusive", &TraceFilter{UID: uid, From: 200, To: 300}, []int64{200, 300}},
+		{"from only", &TraceFilter{UID: uid, From: 300}, []int64{300, 400}},
+		{"to only", &TraceFilter{UID: uid, To: 100}, []int64{100}},
+		{"min rssi", &TraceFilter{UID: uid, MinRSSI: &minRSSI}, []int64{200, 300}},
+		{"cuid", &TraceFilter{UID: uid, CUID: contactB}, []int64{300, 400}},
+		{"oid", &TraceFilter{UID: uid, OID: "officer-b"}, []int64{400}},
+		{"org", &TraceFilter{UID: uid, Org: "ORG1"}, []int64{100, 200}},
+		{"combined", &TraceFilter{UID: uid, From: 150, CUID: contactB, MinRSSI: &minRSSI}, []int64{300}},
+	}
+	for _, tt := range tests {
+		got := make(map[int64]bool)
+		cursor := ""
+		for {
+			traces, next, err := tracing.QueryTraceData(ctx, tt.filter, cursor, 1)
+			if err != nil {
+				t.Fatalf("%s : QueryTraceData got %v", tt.name, err)
+			}
+			for _, td := range traces {
+				got[td.Timestamp] = true
+			}
+			if len(next) == 0 {
+				break
+			}
+			cursor = next
+		}
+		if len(got) != len(tt.expect) {
+			t.Errorf("%s : expect timestamps %v, got %v", tt.name, tt.expect, got)
+			continue
+		}
+		for _, ts := range tt.expect {
+			if !got[ts] {
+				t.Errorf("%s : expect timestamps %v, got %v", tt.name, tt.expect, got)
+				break
+			}
+		}
+	}
+
+	if _, _, err := tracing.QueryTraceData(ctx, &TraceFilter{UID: uid, From: 300, To: 200}, "", 10); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("from after to : expect ErrInvalidParameter, got %v", err)
+	}
+}
+
+func conformOfficerLifecycle(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+
+	if _, err := tracing.GetOfficerID(ctx, "conform-secret"); !errors.Is(err, ErrSecretNotValid) {
+		t.Fatalf("unknown secret : expect ErrSecretNotValid, got %v", err)
+	}
+	if err := tracing.RegisterNewOfficer(ctx, "conform-officer", "conform-secret"); err != nil {
+		t.Fatalf("RegisterNewOfficer got %v", err)
+	}
+	if oid, err := tracing.GetOfficerID(ctx, "conform-secret"); err != nil || oid != "conform-officer" {
+		t.Fatalf("expect conform-officer, got %q, %v", oid, err)
+	}
+	off, err := tracing.GetOfficer(ctx, "conform-officer")
+	if err != nil || off.OID != "conform-officer" || len(off.Secret) > 0 || !verifySecret(off.SecretHash, "conform-secret") {
+		t.Fatalf("expect conform-officer with its hashed secret only, got %+v, %v", off, err)
+	}
+	if len(off.Roles) != 0 {
+		t.Fatalf("expect no role for a new officer, got %v", off.Roles)
+	}
+	if err := tracing.SetOfficerRoles(ctx, "conform-unknown", []string{RoleTracer}); !errors.Is(err, ErrOfficerNotFound) {
+		t.Fatalf("SetOfficerRoles of unknown officer : expect ErrOfficerNotFound, got %v", err)
+	}
+	if err := tracing.SetOfficerRoles(ctx, "conform-officer", []string{RoleAuditor, RoleTracer}); err != nil {
+		t.Fatalf("SetOfficerRoles got %v", err)
+	}
+
+	if err := tracing.RegisterNewOfficer(ctx, "conform-officer", "conform-secret-2"); err != nil {
+		t.Fatalf("re-RegisterNewOfficer got %v", err)
+	}
+	if _, err := tracing.GetOfficerID(ctx, "conform-secret"); !errors.Is(err, ErrSecretNotValid) {
+		t.Fatalf("replaced secret : expect ErrSecretNotValid, got %v", err)
+	}
+	if oid, err := tracing.GetOfficerID(ctx, "conform-secret-2"); err != nil || oid != "conform-officer" {
+		t.Fatalf("expect conform-officer with new secret, got %q, %v", oid, err)
+	}
+	if off, err := tracing.GetOfficer(ctx, "conform-officer"); err != nil || len(off.Roles) != 2 || off.Roles[0] != RoleAuditor || off.Roles[1] != RoleTracer {
+		t.Fatalf("expect roles kept across secret replacement, got %+v, %v", off, err)
+	}
+
+	if err := tracing.DeleteOfficer(ctx, "conform-officer"); err != nil {
+		t.Fatalf("DeleteOfficer got %v", err)
+	}
+	if _, err := tracing.GetOfficerID(ctx, "conform-secret-2"); !errors.Is(err, ErrSecretNotValid) {
+		t.Fatalf("deleted officer : expect ErrSecretNotValid, got %v", err)
+	}
+	if _, err := tracing.GetOfficer(ctx, "conform-officer"); !errors.Is(err, ErrOfficerNotFound) {
+		t.Fatalf("deleted officer : expect ErrOfficerNotFound, got %v", err)
+	}
+	if err := tracing.DeleteOfficer(ctx, "conform-officer"); err != nil {
+		t.Fatalf("DeleteOfficer of unknown officer got %v", err)
+	}
+}
+
+func conformDeleteUser(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	uid := "conformUID00000000001"
+	other := "conformUID00000000002"
+	third := "conformUID00000000003"
+	now := time.Now().Unix()
+
+	for _, u := range []string{uid, other} {
+		if err := tracing.RegisterNewUser(ctx, u, "1111"); err != nil {
+			t.Fatalf("RegisterNewUser got %v", err)
+		}
+	}
+	uploaded := func() []*TraceData {
+		return []*TraceData{{CUID: other, Timestamp: 100}, {CUID: third, Timestamp: 200}}
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "conform-officer", uploaded()); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, other, "conform-officer", []*TraceData{{CUID: uid, Timestamp: 100}, {CUID: third, Timestamp: 300}}); err != nil {
+		t.Fatalf("SaveTraceData got %v", err)
+	}
+	for _, ut := range []*UploadToken{
+		{ID: "conform-jti-1", OID: "conform-officer", UID: uid, ValidFrom: now, ValidUntil: now + 3600},
+		{ID: "conform-jti-2", OID: "conform-officer", UID: uid, ValidFrom: now, ValidUntil: now + 3600},
+		{ID: "conform-jti-3", OID: "conform-officer", UID: other, ValidFrom: now, ValidUntil: now + 3600},
+	} {
+		if err := tracing.RegisterUploadToken(ctx, ut); err != nil {
+			t.Fatalf("RegisterUploadToken got %v", err)
+		}
+	}
+
+	deletion, err := tracing.DeleteUser(ctx, uid)
+	if err != nil {
+		t.Fatalf("DeleteUser got %v", err)
+	}
+	if *deletion != (UserDeletion{User: true, Traces: 2, ContactTraces: 1, UploadTokens: 2}) {
+		t.Errorf("expect the user, 2 traces, 1 contact trace and 2 tokens deleted, got %+v", deletion)
+	}
+	if err := tracing.VerifyHandshakePIN(ctx, uid, "1111"); !errors.Is(err, ErrUIDNotFound) {
+		t.Errorf("deleted uid : expect ErrUIDNotFound, got %v", err)
+	}
+	if traces, err := tracing.GetTraceData(ctx, uid); err != nil || len(traces) != 0 {
+		t.Errorf("deleted uid : expect no traces, got %d, %v", len(traces), err)
+	}
+	traces, err := tracing.GetTraceData(ctx, other)
+	if err != nil || len(traces) != 1 || traces[0].CUID != third {
+		t.Errorf("expect only the trace of other with third to be kept, got %v, %v", traces, err)
+	}
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-1"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("token of deleted uid : expect ErrTokenNotFound, got %v", err)
+	}
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-3"); err != nil {
+		t.Errorf("token of other : expect to be consumed, got %v", err)
+	}
+	if err := tracing.VerifyHandshakePIN(ctx, other, "1111"); err != nil {
+		t.Errorf("other uid : expect to be kept, got %v", err)
+	}
+
+	if saved, _, err := tracing.SaveTraceData(ctx, uid, "conform-officer", uploaded()); err != nil || len(saved) != 2 {
+		t.Errorf("upload after delete : expect 2 inserted, got %d, %v", len(saved), err)
+	}
+	deletion, err = tracing.DeleteUser(ctx, "conformUID00000000404")
+	if err != nil || *deletion != (UserDeletion{}) {
+		t.Errorf("unknown uid : expect nothing deleted, got %+v, %v", deletion, err)
+	}
+}
+
+func conformOfficerManagement(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	before := time.Now().Unix()
+	for _, oid := range []string{"conform-officer-b", "conform-officer-a"} {
+		if err := tracing.RegisterNewOfficer(ctx, oid, oid+"-secret"); err != nil {
+			t.Fatalf("RegisterNewOfficer got %v", err)
+		}
+	}
+	officers, err := tracing.ListOfficers(ctx)
+	if err != nil {
+		t.Fatalf("ListOfficers got %v", err)
+	}
+	listed := make([]string, 0)
+	for _, off := range officers {
+		if strings.HasPrefix(off.OID, "conform-officer-") {
+			listed = append(listed, off.OID)
+			if off.CreatedAt < before || off.Disabled || off.LastUsedAt != 0 {
+				t.Errorf("expect %s created now, enabled and never used, got %+v", off.OID, off)
+			}
+		}
+	}
+	if len(listed) != 2 || listed[0] != "conform-officer-a" || listed[1] != "conform-officer-b" {
+		t.Fatalf("expect conform-officer-a then conform-officer-b, got %v", listed)
+	}
+
+	for name, err := range map[string]error{
+		"RotateOfficerSecret": tracing.RotateOfficerSecret(ctx, "conform-unknown", "conform-secret"),
+		"UpdateOfficer":       tracing.UpdateOfficer(ctx, "conform-unknown", &OfficerUpdate{Roles: []string{RoleTracer}}),
+		"TouchOfficer":        tracing.TouchOfficer(ctx, "conform-unknown", 1),
+	} {
+		if !errors.Is(err, ErrOfficerNotFound) {
+			t.Errorf("%s of unknown officer : expect ErrOfficerNotFound, got %v", name, err)
+		}
+	}
+
+	created, err := tracing.GetOfficer(ctx, "conform-officer-a")
+	if err != nil {
+		t.Fatalf("GetOfficer got %v", err)
+	}
+	disabled := true
+	if err := tracing.UpdateOfficer(ctx, "conform-officer-a", &OfficerUpdate{Roles: []string{RoleTracer}, Disabled: &disabled}); err != nil {
+		t.Fatalf("UpdateOfficer got %v", err)
+	}
+	if err := tracing.TouchOfficer(ctx, "conform-officer-a", before+60); err != nil {
+		t.Fatalf("TouchOfficer got %v", err)
+	}
+	if err := tracing.RotateOfficerSecret(ctx, "conform-officer-a", "conform-rotated"); err != nil {
+		t.Fatalf("RotateOfficerSecret got %v", err)
+	}
+	if _, err := tracing.GetOfficerID(ctx, "conform-officer-a-secret"); !errors.Is(err, ErrSecretNotValid) {
+		t.Errorf("rotated secret : expect ErrSecretNotValid, got %v", err)
+	}
+	if oid, err := tracing.GetOfficerID(ctx, "conform-rotated"); err != nil || oid != "conform-officer-a" {
+		t.Errorf("expect conform-officer-a with the rotated secret, got %q, %v", oid, err)
+	}
+	off, err := tracing.GetOfficer(ctx, "conform-officer-a")
+	if err != nil || !off.Disabled || off.LastUsedAt != before+60 || off.CreatedAt != created.CreatedAt || len(off.Roles) != 1 {
+		t.Fatalf("expect disabled, used, created and roles kept across rotation, got %+v, %v", off, err)
+	}
+
+	if err := tracing.RegisterNewOfficer(ctx, "conform-officer-a", "conform-secret-2"); err != nil {
+		t.Fatalf("re-RegisterNewOfficer got %v", err)
+	}
+	if off, err := tracing.GetOfficer(ctx, "conform-officer-a"); err != nil || !off.Disabled || off.LastUsedAt != before+60 || off.CreatedAt != created.CreatedAt {
+		t.Fatalf("expect disabled, used and created kept across registration, got %+v, %v", off, err)
+	}
+	disabled = false
+	if err := tracing.UpdateOfficer(ctx, "conform-officer-a", &OfficerUpdate{Disabled: &disabled}); err != nil {
+		t.Fatalf("UpdateOfficer got %v", err)
+	}
+	if off, err := tracing.GetOfficer(ctx, "conform-officer-a"); err != nil || off.Disabled || len(off.Roles) != 1 || off.Roles[0] != RoleTracer {
+		t.Fatalf("expect conform-officer-a enabled again with its roles kept, got %+v, %v", off, err)
+	}
+}
+
+func conformUploadTokenLifecycle(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	tokens := []*UploadToken{
+		{ID: "conform-jti-1", OID: "conform-officer", UID: "conformUID00000000001", ValidFrom: now, ValidUntil: now + 3600},
+		{ID: "conform-jti-2", OID: "conform-officer", UID: "conformUID00000000001", ValidFrom: now, ValidUntil: now + 3600},
+		{ID: "conform-jti-3", OID: "conform-officer", UID: "conformUID00000000002", ValidFrom: now, ValidUntil: now + 3600},
+		{ID: "conform-jti-4", OID: "another-officer", UID: "conformUID00000000002", ValidFrom: now, ValidUntil: now + 3600},
+		{ID: "conform-jti-5", OID: "another-officer", UID: "conformUID00000000002", ValidFrom: now - 7200, ValidUntil: now - 3600},
+	}
+	for _, ut := range tokens {
+		if err := tracing.RegisterUploadToken(ctx, ut); err != nil {
+			t.Fatalf("RegisterUploadToken %s got %v", ut.ID, err)
+		}
+	}
+	if err := tracing.RegisterUploadToken(ctx, &UploadToken{OID: "conform-officer"}); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("RegisterUploadToken empty ID : expect ErrInvalidParameter, got %v", err)
+	}
+
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-1"); err != nil {
+		t.Fatalf("ConsumeUploadToken got %v", err)
+	}
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-1"); !errors.Is(err, ErrTokenConsumed) {
+		t.Errorf("second ConsumeUploadToken : expect ErrTokenConsumed, got %v", err)
+	}
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-404"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("ConsumeUploadToken unknown : expect ErrTokenNotFound, got %v", err)
+	}
+	if err := tracing.ReleaseUploadToken(ctx, "conform-jti-1"); err != nil {
+		t.Fatalf("ReleaseUploadToken got %v", err)
+	}
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-1"); err != nil {
+		t.Errorf("released token : expect to be consumed again, got %v", err)
+	}
+	if err := tracing.ReleaseUploadToken(ctx, "conform-jti-404"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("ReleaseUploadToken unknown : expect ErrTokenNotFound, got %v", err)
+	}
+
+	if revoked, err := tracing.RevokeUploadTokens(ctx, "conform-officer", "conform-jti-4"); err != nil || revoked != 0 {
+		t.Errorf("revoking the token of another officer : expect 0 revoked, got %d, %v", revoked, err)
+	}
+	if revoked, err := tracing.RevokeUploadTokens(ctx, "conform-officer", "conform-jti-2"); err != nil || revoked != 1 {
+		t.Errorf("RevokeUploadTokens by jti : expect 1 revoked, got %d, %v", revoked, err)
+	}
+	if revoked, err := tracing.RevokeUploadTokens(ctx, "conform-officer", ""); err != nil || revoked != 1 {
+		t.Errorf("RevokeUploadTokens all : expect 1 revoked, got %d, %v", revoked, err)
+	}
+	if err := tracing.ReleaseUploadToken(ctx, "conform-jti-2"); err != nil {
+		t.Errorf("ReleaseUploadToken revoked : expect to be left untouched, got %v", err)
+	}
+	for jti, expect := range map[string]error{
+		"conform-jti-1": ErrTokenConsumed,
+		"conform-jti-2": ErrTokenRevoked,
+		"conform-jti-3": ErrTokenRevoked,
+		"conform-jti-4": nil,
+	} {
+		if err := tracing.ConsumeUploadToken(ctx, jti); !errors.Is(err, expect) {
+			t.Errorf("ConsumeUploadToken %s : expect %v, got %v", jti, expect, err)
+		}
+	}
+
+	if err := tracing.PurgeUploadTokens(ctx, now); err != nil {
+		t.Fatalf("PurgeUploadTokens got %v", err)
+	}
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-5"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("purged token : expect ErrTokenNotFound, got %v", err)
+	}
+	if err := tracing.ConsumeUploadToken(ctx, "conform-jti-4"); !errors.Is(err, ErrTokenConsumed) {
+		t.Errorf("token still valid must survive purge, got %v", err)
+	}
+}
+
+func conformRefreshTokenReuse(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	if err := tracing.ConsumeRefreshToken(ctx, "", now+3600); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("ConsumeRefreshToken empty : expect ErrInvalidParameter, got %v", err)
+	}
+	if err := tracing.ConsumeRefreshToken(ctx, "conform-refresh-1", now+3600); err != nil {
+		t.Fatalf("ConsumeRefreshToken got %v", err)
+	}
+	if err := tracing.ConsumeRefreshToken(ctx, "conform-refresh-2", now-3600); err != nil {
+		t.Fatalf("ConsumeRefreshToken got %v", err)
+	}
+	if err := tracing.ConsumeRefreshToken(ctx, "conform-refresh-1", now+3600); !errors.Is(err, ErrTokenConsumed) {
+		t.Errorf("ConsumeRefreshToken reused : expect ErrTokenConsumed, got %v", err)
+	}
+
+	if err := tracing.PurgeUploadTokens(ctx, now); err != nil {
+		t.Fatalf("PurgeUploadTokens got %v", err)
+	}
+	if err := tracing.ConsumeRefreshToken(ctx, "conform-refresh-1", now+3600); !errors.Is(err, ErrTokenConsumed) {
+		t.Errorf("refresh token still valid must survive purge, got %v", err)
+	}
+	if err := tracing.ConsumeRefreshToken(ctx, "conform-refresh-2", now-3600); err != nil {
+		t.Errorf("expired refresh token must be purged, got %v", err)
+	}
+}
+
+func conformTempIDPolicy(t *testing.T, tracing ITracing) {
+	ctx := context.Background()
+	if _, err := tracing.GetTempIDPolicy(ctx); !errors.Is(err, ErrTempIDPolicyNotFound) {
+		t.Fatalf("GetTempIDPolicy before any : expect ErrTempIDPolicyNotFound, got %v", err)
+	}
+	for _, policy := range []*TempIDPolicy{
+		{PeriodMinute: 15, OverlapSecond: 30, BatchSize: 96, RefreshLeadMinute: 60, Align: true},
+		{PeriodMinute: 60, OverlapSecond: 60, BatchSize: 24, RefreshLeadMinute: 0, RefreshLeadDefault: true},
+	} {
+		if err := tracing.SetTempIDPolicy(ctx, policy); err != nil {
+			t.Fatalf("SetTempIDPolicy got %v", err)
+		}
+		if stored, err := tracing.GetTempIDPolicy(ctx); err != nil || *stored != *policy {
+			t.Errorf("GetTempIDPolicy : expect %+v, got %+v, %v", policy, stored, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := tracing.SetTempIDPolicy(ctx, nil); err != nil {
+			t.Fatalf("SetTempIDPolicy nil got %v", err)
+		}
+	}
+	if _, err := tracing.GetTempIDPolicy(ctx); !errors.Is(err, ErrTempIDPolicyNotFound) {
+		t.Errorf("GetTempIDPolicy after removal : expect ErrTempIDPolicyNotFound, got %v", err)
+	}
+}
+
+func TestInMemoryTracingConformance(t *testing.T) {
+	testTracingConformance(t, func(t *testing.T) ITracing {
+		return NewInMemoryTracing()
+	})
+}
+
+func TestBoltTracingConformance(t *testing.T) {
+	testTracingConformance(t, func(t *testing.T) ITracing {
+		tracing := NewBoltTracing(filepath.Join(t.TempDir(), "conformance.db"))
+		t.Cleanup(func() {
+			_ = tracing.(*BoltTracing).Close()
+		})
+		return tracing
+	})
+}
+
+func TestBoltTracingNegativeTimestamp(t *testing.T) {
+	tracing := NewBoltTracing(filepath.Join(t.TempDir(), "negative.db"))
+	defer tracing.(*BoltTracing).Close()
+	ctx := context.Background()
+	uid := "negativeUID0000000001"
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "a", Timestamp: 100}, {CUID: "b", Timestamp: -1}}); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("expect a negative timestamp refused, got %v", err)
+	}
+	if _, _, err := tracing.SaveTraceData(ctx, uid, "officer1", []*TraceData{{CUID: "a", Timestamp: 100}}); err != nil {
+		t.Fatal(err)
+	}
+	if traces, _, err := tracing.QueryTraceData(ctx, &TraceFilter{UID: uid, From: -100, To: 200}, "", 10); err != nil || len(traces) != 1 {
+		t.Errorf("expect a negative from to start at the first trace, got %d traces, %v", len(traces), err)
+	}
+}
+
+// TestMongoDBTracingConformance runs against the mongo.* configured server when TRACE_TEST_MONGODB is true.
+// Each sub test uses its own database which is dropped afterward.
+func TestMongoDBTracingConformance(t *testing.T) {
+	if os.Getenv("TRACE_TEST_MONGODB") != "true" {
+		t.Skip("set TRACE_TEST_MONGODB=true to run against MongoDB")
+	}
+	testTracingConformance(t, newMongoDBConformanceTracing)
+}
+
+// newMongoDBConformanceTracing connects to a new database of the mongo.* configured server, dropped once t is done.
+func newMongoDBConformanceTracing(t *testing.T) ITracing {
+	database := fmt.Sprintf("hypertrace_conformance_%d", time.Now().UnixNano())
+	tracing := NewMongoDBTracing(database, ConfigGet("mongo.host"), ConfigGetInt("mongo.port"), ConfigGet("mongo.user"), ConfigGet("mongo.password"))
+	t.Cleanup(func() {
+		_ = tracing.(*MongoDBTracing).client.Database(database).Drop(context.Background())
+	})
+	return tracing
+}
+
+// TestPostgresTracingConformance runs against the postgres.* configured database when TRACE_TEST_POSTGRES is true.
+// The tables are truncated before every sub test, never point it at a production database.
+func TestPostgresTracingConformance(t *testing.T) {
+	if os.Getenv("TRACE_TEST_POSTGRES") != "true" {
+		t.Skip("set TRACE_TEST_POSTGRES=true to run against PostgreSQL")
+	}
+	testTracingConformance(t, func(t *testing.T) ITracing {
+		tracing := NewPostgresTracing(ConfigGet("postgres.database"), ConfigGet("postgres.host"), ConfigGetInt("postgres.port"), ConfigGet("postgres.user"), ConfigGet("postgres.password"), ConfigGet("postgres.sslmode"))
+		pg := tracing.(*PostgresTracing)
+		// every table the migrations created, so tables added by later migrations are reset too
+		var tables string
+		err := pg.db.QueryRow(`SELECT string_agg(quote_ident(tablename), ', ') FROM pg_tables
+			WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'`).Scan(&tables)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pg.db.Exec("TRUNCATE " + tables); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = pg.Close()
+		})
+		return tracing
+	})
+}
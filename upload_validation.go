@@ -0,0 +1,155 @@
+package hypertrace
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TempIDWindowPolicy tells what to do with an uploaded record whose timestamp is outside
+// the validity window of the TempID it carries.
+type TempIDWindowPolicy string
+
+const (
+	// TempIDWindowReject fails the whole upload, nothing is saved.
+	TempIDWindowReject TempIDWindowPolicy = "reject"
+	// TempIDWindowFlag saves the record marked as suspect.
+	TempIDWindowFlag TempIDWindowPolicy = "flag"
+	// TempIDWindowDrop silently leaves the record out while saving the others.
+	TempIDWindowDrop TempIDWindowPolicy = "drop"
+)
+
+const (
+	UploadRecordAccepted = "ACCEPTED"
+	UploadRecordFlagged  = "FLAGGED"
+	UploadRecordDropped  = "DROPPED"
+	UploadRecordRejected = "REJECTED"
+
+	UploadReasonDecryptFailed = "DECRYPT_FAILED"
+	UploadReasonBadLength     = "BAD_LENGTH"
+	UploadReasonOutOfWindow   = "OUT_OF_WINDOW"
+	UploadReasonSelfContact   = "SELF_CONTACT"
+	UploadReasonDuplicate     = "DUPLICATE"
+)
+
+// ValidateUploadRecords decrypts the TempID of every record of upload and checks it.
+// It returns the traces to save, the result of every record and how many records are rejected.
+// A record is rejected when its TempID can not be decrypted or has a bad length, when it is a contact of the
+// uploader with itself, when it repeats an earlier record of the same upload, or when its timestamp is outside
+// of the TempID validity window and the window policy is TempIDWindowReject.
+func ValidateUploadRecords(upload *DataUpload, keys *Keyring) (traces []*TraceData, results []*UploadRecordResult, rejected int) {
+	traces = make([]*TraceData, 0, len(upload.Traces))
+	results = make([]*UploadRecordResult, 0, len(upload.Traces))
+	policy := GetTempIDWindowPolicy()
+	skew := int64(ConfigGetInt("upload.tempid.skew.second"))
+	seen := make(map[traceDataKey]bool)
+
+	reject := func(result *UploadRecordResult, reason string) {
+		result.Status = UploadRecordRejected
+		result.Reason = reason
+		rejected++
+	}
+
+	for i, tr := range upload.Traces {
+		result := &UploadRecordResult{
+			Index:  i,
+			Status: UploadRecordAccepted,
+		}
+		results = append(results, result)
+
+		uid, start, exp, err := GetTempIDData(keys, tr.Message)
+		if err != nil {
+			logrus.Warnf("ValidateUploadRecords: record %d of uid %s. got %s", i, upload.UID, err.Error())
+			if errors.Is(err, ErrInvalidTempIDLength) {
+				reject(result, UploadReasonBadLength)
+			} else {
+				reject(result, UploadReasonDecryptFailed)
+			}
+			continue
+		}
+		if uid == upload.UID {
+			reject(result, UploadReasonSelfContact)
+			continue
+		}
+
+		td := &TraceData{
+			CUID:      uid,
+			Timestamp: tr.Timestamp,
+			ModelC:    tr.ModelC,
+			ModelP:    tr.ModelP,
+			RSSI:      tr.RSSI,
+			TxPower:   tr.TxPower,
+			Org:       tr.Org,
+		}
+		if seen[td.key()] {
+			reject(result, UploadReasonDuplicate)
+			continue
+		}
+		seen[td.key()] = true
+
+		if !IsWithinTempIDWindow(tr.Timestamp, start, exp, skew) {
+			logrus.Warnf("ValidateUploadRecords: record %d of uid %s at %d is outside tempID window %d - %d", i, upload.UID, tr.Timestamp, start, exp)
+			switch policy {
+			case TempIDWindowDrop:
+				result.Status = UploadRecordDropped
+				result.Reason = UploadReasonOutOfWindow
+				continue
+			case TempIDWindowFlag:
+				result.Status = UploadRecordFlagged
+				result.Reason = UploadReasonOutOfWindow
+				td.Suspect = true
+			default:
+				reject(result, UploadReasonOutOfWindow)
+				continue
+			}
+		}
+
+		traces = append(traces, td)
+	}
+	return traces, results, rejected
+}
+
+// UploadRecordResult is the outcome of one record of DataUpload.Traces, identified by its index.
+type UploadRecordResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type UploadResponse struct {
+	Status     string                `json:"status"`
+	Inserted   int                   `json:"inserted"`
+	Duplicates int                   `json:"duplicates"`
+	Records    []*UploadRecordResult `json:"records"`
+}
+
+// GetTempIDWindowPolicy returns the configured upload.tempid.window.policy, falling back to TempIDWindowReject.
+func GetTempIDWindowPolicy() TempIDWindowPolicy {
+	policy := TempIDWindowPolicy(ConfigGet("upload.tempid.window.policy"))
+	switch policy {
+	case TempIDWindowReject, TempIDWindowFlag, TempIDWindowDrop:
+		return policy
+	}
+	logrus.Warnf("unknown upload.tempid.window.policy %s, using %s", policy, TempIDWindowReject)
+	return TempIDWindowReject
+}
+
+// IsWithinTempIDWindow tells whether timestamp lies within the start and expiry of a TempID,
+// tolerating a clock skew of skew seconds on both ends.
+func IsWithinTempIDWindow(timestamp int64, start, expiry int32, skew int64) bool {
+	return timestamp >= int64(start)-skew && timestamp <= int64(expiry)+skew
+}
+
+func writeUploadResponse(w http.ResponseWriter, code int, resp *UploadResponse) {
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(respBytes)
+}